@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cespare/erebus/erebus"
+)
+
+// listenControl listens on a Unix socket at path for control connections (see serveControl), replacing any
+// socket left there by a previous run. Only the user running erebus may connect: the socket is created inside a
+// new directory which only that user can use, and isn't moved into place until its permissions are tightened,
+// so there's no moment when others could connect.
+func listenControl(path string) (net.Listener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".erebus") // Mode 0700
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "sock") // Short, as socket paths are limited to ~100 bytes
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	l.SetUnlinkOnClose(false) // The socket won't be at tmp for long
+	if err := os.Chmod(tmp, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			l.Close()
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		os.Remove(path)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return &controlListener{UnixListener: l, path: path}, nil
+}
+
+// A controlListener is the listener for a control socket at path; closing it removes the socket.
+type controlListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l *controlListener) Close() error {
+	err := l.UnixListener.Close()
+	os.Remove(l.path)
+	return err
+}
+
+const controlHelp = `Commands:
+  rules          Print the current rules
+  reload         Reload the configuration
+  drain ADDR     Stop sending requests to a backend (where there are alternatives)
+  undrain ADDR   Return a drained backend to service
+  drains         List the draining backends
+  stats          Print the requests in flight for each rule and backend
+  help           Print this help
+`
+
+// serveControl serves the control protocol on connections accepted from l until l is closed. The protocol is
+// line-based: each line is a command (see controlHelp), and its output ends with a line "ok" or, if it failed,
+// a line beginning "error: ".
+func (rl *reloader) serveControl(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go rl.handleControl(conn)
+	}
+}
+
+func (rl *reloader) handleControl(conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	w := bufio.NewWriter(conn)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if err := rl.controlCommand(w, fields[0], fields[1:]); err != nil {
+			fmt.Fprintf(w, "error: %s\n", err)
+		} else {
+			fmt.Fprintln(w, "ok")
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (rl *reloader) controlCommand(w io.Writer, cmd string, args []string) error {
+	wantArgs := 0
+	if cmd == "drain" || cmd == "undrain" {
+		wantArgs = 1
+	}
+	if len(args) != wantArgs {
+		return fmt.Errorf("%s takes %d argument(s); got %d", cmd, wantArgs, len(args))
+	}
+	switch cmd {
+	case "rules":
+		b, err := json.MarshalIndent(rl.current().Rules, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\n", b)
+	case "reload":
+		proxy, err := rl.reload()
+		if err != nil {
+			erebus.LogErrorf("#red{Error reloading configuration (keeping the current rules):} %s", err)
+			return fmt.Errorf("error reloading configuration: %s", err)
+		}
+		erebus.LogInfof("#green{Reloaded configuration} (%d rules)", len(proxy.Rules))
+		fmt.Fprintf(w, "Reloaded configuration (%d rules).\n", len(proxy.Rules))
+	case "drain":
+		rl.drains.Drain(args[0])
+		erebus.LogInfof("#yellow{Draining backend} %s", args[0])
+	case "undrain":
+		rl.drains.Undrain(args[0])
+		erebus.LogInfof("#green{Undrained backend} %s", args[0])
+	case "drains":
+		fmt.Fprintf(w, "Draining backends: [%s]\n", strings.Join(rl.drains.Addrs(), " "))
+	case "stats":
+		writeStats(w, rl.current())
+	case "help":
+		io.WriteString(w, controlHelp)
+	default:
+		return fmt.Errorf("unknown command %q (try help)", cmd)
+	}
+	return nil
+}
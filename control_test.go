@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestControlSocket(t *testing.T) {
+	rl, write := newFileReloader(t, `[{"from": {"host": "a.com"}, "to": {"addr": "localhost:1"}}]`)
+	path := filepath.Join(t.TempDir(), "control.sock")
+	l, err := listenControl(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go rl.serveControl(l)
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Errorf("control socket has permissions %o; want 600", perm)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("got %d entries in the socket's directory; want just the socket", len(entries))
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	// command sends a command and returns its output and final status line.
+	command := func(cmd string) (output, status string) {
+		t.Helper()
+		if _, err := fmt.Fprintln(conn, cmd); err != nil {
+			t.Fatal(err)
+		}
+		var lines []string
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatalf("%s: %s", cmd, err)
+			}
+			line = strings.TrimSuffix(line, "\n")
+			if line == "ok" || strings.HasPrefix(line, "error: ") {
+				return strings.Join(lines, "\n"), line
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	for _, tt := range []struct {
+		cmd        string
+		wantOutput string // A substring of the output
+		wantStatus string // A prefix of the status line
+	}{
+		{"rules", `"Host": "a.com"`, "ok"},
+		{"stats", "  1: 0", "ok"},
+		{"drain localhost:1", "", "ok"},
+		{"drains", "Draining backends: [localhost:1]", "ok"},
+		{"undrain localhost:1", "", "ok"},
+		{"drains", "Draining backends: []", "ok"},
+		{"drain", "", "error: drain takes 1 argument(s); got 0"},
+		{"stats now", "", "error: stats takes 0 argument(s)"},
+		{"frobnicate", "", `error: unknown command "frobnicate"`},
+		{"help", "reload", "ok"},
+	} {
+		output, status := command(tt.cmd)
+		if !strings.Contains(output, tt.wantOutput) || !strings.HasPrefix(status, tt.wantStatus) {
+			t.Errorf("%s: got output %q and status %q; want output containing %q and status %q", tt.cmd,
+				output, status, tt.wantOutput, tt.wantStatus)
+		}
+	}
+
+	write(`[{"from": {"host": "a.com"}, "to": {"addr": "localhost:1"}},
+	        {"from": {"host": "b.com"}, "to": {"addr": "localhost:2"}}]`)
+	if output, status := command("reload"); status != "ok" || !strings.Contains(output, "2 rules") {
+		t.Errorf("reload: got output %q and status %q; want a summary of the rules and ok", output, status)
+	}
+	if n := len(rl.current().Rules); n != 2 {
+		t.Errorf("after reloading, got %d rules; want 2", n)
+	}
+	write(`[{"from": {"pathregex": "("}, "to": {"addr": "localhost:1"}}]`)
+	if _, status := command("reload"); !strings.HasPrefix(status, "error: error reloading configuration") {
+		t.Errorf("reloading a bad config: got status %q; want an error", status)
+	}
+	if n := len(rl.current().Rules); n != 2 {
+		t.Errorf("after a failed reload, got %d rules; want 2", n)
+	}
+
+	// Closing the listener removes the socket.
+	l.Close()
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("after closing the listener, got %v from stat; want the socket gone", err)
+	}
+
+	// A stale socket from a previous run is replaced.
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+	l2, err := listenControl(path)
+	if err != nil {
+		t.Fatalf("listening again on the socket path: %s", err)
+	}
+	l2.Close()
+
+	// Anything else at the path is left alone.
+	if err := os.WriteFile(path, []byte("not a socket"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenControl(path); err == nil {
+		t.Error("listening on the path of a regular file: expected an error")
+	}
+	if b, err := os.ReadFile(path); err != nil || string(b) != "not a socket" {
+		t.Errorf("the file at the socket path was changed: got %q, %v", b, err)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/cespare/erebus/erebus"
+)
+
+const (
+	drainPath   = "/__erebus_drain"
+	undrainPath = "/__erebus_undrain"
+)
+
+// serveDrain serves the admin endpoints for draining backends. A POST to drainPath or undrainPath with an addr
+// drains that backend or returns it to service; a GET to drainPath lists the draining backends.
+func (rl *reloader) serveDrain(w http.ResponseWriter, r *http.Request) {
+	if !rl.adminAllowed(r) {
+		http.Error(w, "Forbidden.", http.StatusForbidden)
+		return
+	}
+	switch {
+	case r.Method == "GET" && r.URL.Path == drainPath:
+	case r.Method == "POST":
+		addr := r.FormValue("addr")
+		if addr == "" {
+			http.Error(w, "an addr is required", http.StatusBadRequest)
+			return
+		}
+		if r.URL.Path == drainPath {
+			rl.drains.Drain(addr)
+			erebus.LogInfof("#yellow{Draining backend} %s", addr)
+		} else {
+			rl.drains.Undrain(addr)
+			erebus.LogInfof("#green{Undrained backend} %s", addr)
+		}
+	default:
+		allow := "POST"
+		if r.URL.Path == drainPath {
+			allow = "GET, POST"
+		}
+		w.Header().Set("Allow", allow)
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	fmt.Fprintf(w, "Draining backends: [%s]\n", strings.Join(rl.drains.Addrs(), " "))
+}
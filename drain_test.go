@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDrain(t *testing.T) {
+	backend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		}))
+	}
+	stable := backend("stable")
+	defer stable.Close()
+	canary := backend("canary")
+	defer canary.Close()
+	stableAddr := strings.TrimPrefix(stable.URL, "http://")
+	canaryAddr := strings.TrimPrefix(canary.URL, "http://")
+
+	rl, write := newFileReloader(t, fmt.Sprintf(
+		`[{"from": {}, "to": {"addr": %q, "canaryaddr": %q, "canarypercent": 100}}]`, stableAddr, canaryAddr))
+	getPath := func(path string) string {
+		w := httptest.NewRecorder()
+		rl.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Body.String()
+	}
+	get := func() string { return getPath("/") }
+	admin := func(method, path, remoteAddr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		rl.ServeHTTP(w, r)
+		return w
+	}
+
+	if got := get(); got != "canary" {
+		t.Fatalf("before draining: got %q; want \"canary\"", got)
+	}
+	if w := admin("POST", drainPath+"?addr="+canaryAddr, "192.0.2.1:5000"); w.Code != http.StatusForbidden {
+		t.Errorf("draining from a disallowed client: got status %d; want 403", w.Code)
+	}
+	if w := admin("POST", drainPath, "127.0.0.1:5000"); w.Code != http.StatusBadRequest {
+		t.Errorf("draining without an addr: got status %d; want 400", w.Code)
+	}
+	if w := admin("POST", drainPath+"?addr="+canaryAddr, "127.0.0.1:5000"); w.Code != http.StatusOK {
+		t.Fatalf("draining: got status %d; want 200", w.Code)
+	}
+	if got := get(); got != "stable" {
+		t.Errorf("with the canary draining: got %q; want \"stable\"", got)
+	}
+	w := admin("GET", drainPath, "127.0.0.1:5000")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), canaryAddr) {
+		t.Errorf("listing drains: got %d %q; want 200 listing %s", w.Code, w.Body, canaryAddr)
+	}
+
+	// Draining survives a reload.
+	if w := postReload(rl, "127.0.0.1:5000"); w.Code != http.StatusOK {
+		t.Fatalf("reload: got status %d; want 200", w.Code)
+	}
+	if got := get(); got != "stable" {
+		t.Errorf("with the canary draining after a reload: got %q; want \"stable\"", got)
+	}
+
+	if w := admin("GET", undrainPath, "127.0.0.1:5000"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET %s: got status %d; want 405", undrainPath, w.Code)
+	}
+	if w := admin("POST", undrainPath+"?addr="+canaryAddr, "127.0.0.1:5000"); w.Code != http.StatusOK {
+		t.Fatalf("undraining: got status %d; want 200", w.Code)
+	}
+	if got := get(); got != "canary" {
+		t.Errorf("after undraining: got %q; want \"canary\"", got)
+	}
+
+	// Draining one of a rule's addrs moves only the requests hashed to it.
+	third := backend("third")
+	defer third.Close()
+	write(fmt.Sprintf(`[{"from": {}, "to": {"addrs": [%q, %q, %q], "hashby": "path"}}]`,
+		stableAddr, canaryAddr, strings.TrimPrefix(third.URL, "http://")))
+	if w := postReload(rl, "127.0.0.1:5000"); w.Code != http.StatusOK {
+		t.Fatalf("reload: got status %d; want 200", w.Code)
+	}
+	before := make(map[string]string)
+	for i := 0; i < 30; i++ {
+		path := fmt.Sprintf("/item/%d", i)
+		before[path] = getPath(path)
+	}
+	if w := admin("POST", drainPath+"?addr="+canaryAddr, "127.0.0.1:5000"); w.Code != http.StatusOK {
+		t.Fatalf("draining: got status %d; want 200", w.Code)
+	}
+	moved := 0
+	for path, old := range before {
+		got := getPath(path)
+		switch {
+		case got == "canary":
+			t.Errorf("with the canary draining, %s was sent to it", path)
+		case old != "canary" && got != old:
+			t.Errorf("with the canary draining, %s moved from %s to %s", path, old, got)
+		case got != old:
+			moved++
+		}
+	}
+	if moved == 0 {
+		t.Error("no requests were hashed to the canary")
+	}
+}
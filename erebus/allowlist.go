@@ -0,0 +1,81 @@
+package erebus
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"sort"
+	"strings"
+)
+
+// CheckBackends returns an error if p.BackendAllowlist is malformed or if any rule names a backend which it
+// doesn't allow. (Backends are checked again for each request; this catches mistakes when the rules are
+// loaded.)
+func (p *Proxy) CheckBackends() error {
+	for _, pattern := range p.BackendAllowlist {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("bad backend pattern %q: %s", pattern, err)
+		}
+	}
+	if p.BackendAllowlist == nil {
+		return nil
+	}
+	for i, rule := range p.Rules {
+		if rule.To == nil {
+			continue
+		}
+		for _, addr := range rule.To.backendAddrs() {
+			if !backendAllowed(addr, p.BackendAllowlist) {
+				return fmt.Errorf("rule %d: backend %q is not in the allowlist", i+1, addr)
+			}
+		}
+	}
+	return nil
+}
+
+// checkBackend returns an error if p.BackendAllowlist doesn't allow a request to be sent to addr.
+func (p *Proxy) checkBackend(addr string) error {
+	if p.BackendAllowlist == nil || backendAllowed(addr, p.BackendAllowlist) {
+		return nil
+	}
+	return fmt.Errorf("backend %q is not in the allowlist", addr)
+}
+
+// backendAddrs returns the addresses of all the backends the rule may send requests to.
+func (c *ToConf) backendAddrs() []string {
+	var addrs []string
+	for _, addr := range append([]string{c.Addr, c.CanaryAddr}, c.Addrs...) {
+		if addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	addrs = append(addrs, c.Mirror...)
+	var statuses []int
+	for status := range c.OnStatus {
+		statuses = append(statuses, status)
+	}
+	sort.Ints(statuses) // For a consistent error
+	for _, status := range statuses {
+		addrs = append(addrs, c.OnStatus[status])
+	}
+	return addrs
+}
+
+func backendAllowed(addr string, patterns []string) bool {
+	host := addr
+	if name, ok := srvName(addr); ok {
+		host, addr = name, name
+	} else if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	for _, pattern := range patterns {
+		s := host
+		if strings.Contains(pattern, ":") {
+			s = addr
+		}
+		if ok, _ := path.Match(pattern, s); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package erebus
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCheckBackends(t *testing.T) {
+	patterns := []string{"*.internal", "localhost", "10.0.0.1:8080"}
+	for _, tt := range []struct {
+		rules string
+		want  string // A substring of the error, or empty for none
+	}{
+		{`[{"from": {}, "to": {"addr": "api.internal:80"}}]`, ""},
+		{`[{"from": {}, "to": {"addr": "localhost:3000"}}]`, ""},
+		{`[{"from": {}, "to": {"addr": "10.0.0.1:8080"}}]`, ""},
+		{`[{"from": {}, "to": {"addr": "srv:_http._tcp.api.internal"}}]`, ""},
+		{`[{"from": {}, "respond": {"status": 200}}]`, ""},
+		{`[{"from": {}, "to": {"addr": "10.0.0.1:9090"}}]`, `rule 1: backend "10.0.0.1:9090"`},
+		{`[{"from": {}, "to": {"addr": "169.254.169.254:80"}}]`, `backend "169.254.169.254:80"`},
+		{`[{"from": {}, "to": {"addr": "api.internal.evil.com:80"}}]`, `backend "api.internal.evil.com:80"`},
+		{`[{"from": {}, "to": {"addr": "srv:_http._tcp.example.com"}}]`, `backend "srv:_http._tcp.example.com"`},
+		{`[{"from": {}, "to": {"addr": "a.internal:80", "mirror": ["example.com:80"]}}]`, `"example.com:80"`},
+		{`[{"from": {}, "to": {"addr": "a.internal:80", "canaryaddr": "example.com:80", "canarypercent": 5}}]`,
+			`"example.com:80"`},
+		{`[{"from": {}, "to": {"addrs": ["a.internal:80", "example.com:80"], "hashby": "path"}}]`, `"example.com:80"`},
+		{`[{"from": {}, "to": {"addr": "a.internal:80", "onstatus": {"503": "example.com:80"}}}]`,
+			`"example.com:80"`},
+		{`[{"from": {"path": "/a"}, "to": {"addr": "a.internal:80"}},
+		   {"from": {}, "to": {"addr": "example.com:80"}}]`, `rule 2: backend "example.com:80"`},
+	} {
+		proxy, err := NewProxyFromRules([]byte(tt.rules))
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxy.BackendAllowlist = patterns
+		err = proxy.CheckBackends()
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("%s: got error %q; want none", tt.rules, err)
+		case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+			t.Errorf("%s: got error %v; want one containing %q", tt.rules, err, tt.want)
+		}
+	}
+
+	proxy, err := NewProxyFromRules([]byte(`[{"from": {}, "to": {"addr": "localhost:1"}}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.BackendAllowlist = []string{"["}
+	if err := proxy.CheckBackends(); err == nil {
+		t.Error("with a malformed pattern: got no error")
+	}
+}
+
+func TestBackendAllowlistPerRequest(t *testing.T) {
+	allowed := NewRecordingBackend()
+	forbidden := NewRecordingBackend()
+	forbiddenAddr := strings.TrimPrefix(forbidden.Server.URL, "http://")
+	hook := writeHook(t, fmt.Sprintf(`cat > /dev/null
+echo '{"addr": %q}'
+`, forbiddenAddr))
+	rules := fmt.Sprintf(`[{"from": {}, "to": {"addr": "{{backend1}}", "hook": {"command": [%q]}}}]`, hook)
+	proxy, server := startProxy(t, rules, allowed.Server)
+	proxy.BackendAllowlist = []string{strings.TrimPrefix(allowed.Server.URL, "http://")}
+	if err := proxy.CheckBackends(); err != nil {
+		t.Fatal(err)
+	}
+	captureLog(t)
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("hook redirecting to a disallowed backend: got status %d; want 502", resp.StatusCode)
+	}
+	select {
+	case r := <-forbidden.Received:
+		t.Errorf("disallowed backend got a request: %s %s", r.Method, r.URL)
+	default:
+	}
+}
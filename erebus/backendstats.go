@@ -0,0 +1,49 @@
+package erebus
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// backendErrors counts errors (failures to get a response) by backend address, so that the log shows when a
+// backend's problems are escalating. The zero value is ready to use.
+type backendErrors struct {
+	m sync.Map // addr -> *backendErrorCount
+}
+
+type backendErrorCount struct {
+	total       int64 // Accessed atomically
+	consecutive int64 // Accessed atomically; reset by a successful request
+}
+
+func (b *backendErrors) count(addr string) *backendErrorCount {
+	if c, ok := b.m.Load(addr); ok {
+		return c.(*backendErrorCount)
+	}
+	c, _ := b.m.LoadOrStore(addr, &backendErrorCount{})
+	return c.(*backendErrorCount)
+}
+
+// failure records an error from the backend at addr, returning its number of consecutive and total errors.
+func (b *backendErrors) failure(addr string) (consecutive, total int64) {
+	c := b.count(addr)
+	return atomic.AddInt64(&c.consecutive, 1), atomic.AddInt64(&c.total, 1)
+}
+
+// success records a response from the backend at addr, ending any streak of errors. It reports whether there
+// was one (that is, whether the backend has just recovered).
+func (b *backendErrors) success(addr string) bool {
+	if c, ok := b.m.Load(addr); ok {
+		return atomic.SwapInt64(&c.(*backendErrorCount).consecutive, 0) > 0
+	}
+	return false
+}
+
+// BackendErrors returns the total number of errors (failures to get any response) from the backend at addr
+// since the Proxy was created.
+func (p *Proxy) BackendErrors(addr string) int64 {
+	if c, ok := p.backendErrors.m.Load(addr); ok {
+		return atomic.LoadInt64(&c.(*backendErrorCount).total)
+	}
+	return 0
+}
@@ -0,0 +1,46 @@
+package erebus
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBackendErrorCounts(t *testing.T) {
+	proxy, err := NewProxyFromRules([]byte(`[{"from": {}, "to": {"addr": "backend:80"}}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs := captureLog(t)
+	get := func() {
+		proxy.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+
+	// Two errors, then a success ending the streak, then another error.
+	proxy.Transport = &failingTransport{n: 2}
+	get()
+	get()
+	get()
+	proxy.Transport = &failingTransport{n: 1}
+	get()
+	if got := proxy.BackendErrors("backend:80"); got != 3 {
+		t.Errorf("got %d errors for the backend; want 3", got)
+	}
+	if got := proxy.BackendErrors("other:80"); got != 0 {
+		t.Errorf("got %d errors for an unused backend; want 0", got)
+	}
+	var counts []string
+	for _, line := range logLines(logs) {
+		if i := strings.Index(line, "(backend:80: "); i >= 0 {
+			counts = append(counts, line[i:])
+		}
+	}
+	want := []string{
+		"(backend:80: 1 consecutive, 1 total)",
+		"(backend:80: 2 consecutive, 2 total)",
+		"(backend:80: 1 consecutive, 3 total)",
+	}
+	if strings.Join(counts, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got error counts logged:\n%s\nwant:\n%s", strings.Join(counts, "\n"), strings.Join(want, "\n"))
+	}
+}
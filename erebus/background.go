@@ -0,0 +1,39 @@
+package erebus
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults for Proxy.MaxBackground and Proxy.BackgroundTimeout.
+const (
+	defaultMaxBackground     = 100
+	defaultBackgroundTimeout = 30 * time.Second
+)
+
+// goBackground runs f, which makes a background request (one not tied to any client request, such as a
+// mirrored request or a cache refresh), in a new goroutine. f's context times out after p.BackgroundTimeout.
+// If p.MaxBackground background requests are already in flight, f is dropped instead and goBackground
+// returns false.
+func (p *Proxy) goBackground(f func(ctx context.Context)) bool {
+	max := p.MaxBackground
+	if max == 0 {
+		max = defaultMaxBackground
+	}
+	if atomic.AddInt64(&p.background, 1) > int64(max) {
+		atomic.AddInt64(&p.background, -1)
+		return false
+	}
+	timeout := p.BackgroundTimeout
+	if timeout == 0 {
+		timeout = defaultBackgroundTimeout
+	}
+	go func() {
+		defer atomic.AddInt64(&p.background, -1)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		f(ctx)
+	}()
+	return true
+}
@@ -0,0 +1,243 @@
+package erebus
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxCachedBodySize is the size of the largest response body which is cached.
+const maxCachedBodySize = 1 << 20
+
+// A responseCache holds backend responses for a rule, as permitted by their Cache-Control headers.
+type responseCache struct {
+	maxEntries int
+	keepStale  bool             // Keep responses which can no longer be served normally, for getStale
+	now        func() time.Time // For testing; defaults to time.Now
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+type cacheEntry struct {
+	status     int
+	header     http.Header
+	body       []byte
+	stored     time.Time
+	age        time.Duration // The age of the response when it was stored (from the backend's Age header)
+	expires    time.Time     // When the response becomes stale
+	staleUntil time.Time     // How long the response may be served stale while it is refreshed
+	refreshing bool
+}
+
+func newResponseCache(maxEntries int) *responseCache {
+	return &responseCache{maxEntries: maxEntries, now: time.Now, entries: make(map[string]*cacheEntry)}
+}
+
+// cacheKey returns the key under which the response to r is cached, or "" if the response to r may not be
+// served from (or stored in) the cache.
+func cacheKey(r *http.Request) string {
+	if r.Method != "GET" || r.Header.Get("Authorization") != "" {
+		return ""
+	}
+	return r.Host + r.URL.RequestURI()
+}
+
+// get looks up the response cached under key. If the response is stale (but may still be served), refresh is
+// true for exactly one caller, which should refresh it from the backend and then call store (or, if that
+// fails, refreshFailed).
+func (c *responseCache) get(key string) (e *cacheEntry, refresh bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	now := c.now()
+	switch {
+	case now.Before(e.expires):
+		return e, false
+	case now.Before(e.staleUntil):
+		refresh = !e.refreshing
+		e.refreshing = true
+		return e, refresh
+	}
+	if !c.keepStale {
+		delete(c.entries, key)
+	}
+	return nil, false
+}
+
+// getStale looks up the response cached under key, however stale it is. Responses which can no longer be
+// served normally are only kept for this if c.keepStale is set.
+func (c *responseCache) getStale(key string) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries[key]
+}
+
+// store caches a response under key if its Cache-Control header permits it.
+func (c *responseCache) store(key string, status int, header http.Header, body []byte) {
+	maxAge, stale, ok := cacheLifetime(status, header)
+	if !ok || len(body) > maxCachedBodySize {
+		c.refreshFailed(key)
+		return
+	}
+	age, _ := strconv.Atoi(header.Get("Age"))
+	now := c.now()
+	header = header.Clone()
+	removeHopHeaders(header) // Such as a Keep-Alive meant for the backend connection
+	e := &cacheEntry{
+		status: status,
+		header: header,
+		body:   body,
+		stored: now,
+		age:    time.Duration(age) * time.Second,
+	}
+	e.expires = now.Add(maxAge - e.age)
+	e.staleUntil = e.expires.Add(stale)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.maxEntries {
+		c.evict(now)
+	}
+	c.entries[key] = e
+}
+
+// refreshFailed allows another attempt at refreshing the stale response cached under key.
+func (c *responseCache) refreshFailed(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		e.refreshing = false
+	}
+}
+
+// evict makes room for a new entry, removing any which can no longer be served or, if there are none, an
+// arbitrary one. c.mu must be held.
+func (c *responseCache) evict(now time.Time) {
+	for key, e := range c.entries {
+		if !now.Before(e.staleUntil) {
+			delete(c.entries, key)
+		}
+	}
+	for key := range c.entries {
+		if len(c.entries) < c.maxEntries {
+			break
+		}
+		delete(c.entries, key)
+	}
+}
+
+// serve writes the cached response to w, marking it as a hit in the header statusHeader (if given).
+func (e *cacheEntry) serve(w http.ResponseWriter, now time.Time, statusHeader string) {
+	copyHeader(w.Header(), e.header)
+	age := e.age + now.Sub(e.stored)
+	w.Header().Set("Age", strconv.Itoa(int(age/time.Second)))
+	if statusHeader != "" {
+		w.Header().Set(statusHeader, "HIT") // Replacing the stored MISS
+	}
+	w.WriteHeader(e.status)
+	w.Write(e.body)
+}
+
+// cacheLifetime determines, from its status and Cache-Control header, how long a response may be cached
+// (maxAge) and for how long after that it may be served stale while being refreshed.
+func cacheLifetime(status int, header http.Header) (maxAge, stale time.Duration, ok bool) {
+	if status != http.StatusOK || header.Get("Set-Cookie") != "" || header.Get("Vary") != "" {
+		return 0, 0, false
+	}
+	directives := parseCacheControl(header.Get("Cache-Control"))
+	for _, d := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := directives[d]; ok {
+			return 0, 0, false
+		}
+	}
+	seconds := func(name string) (time.Duration, bool) {
+		v, ok := directives[name]
+		if !ok {
+			return 0, false
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, false
+		}
+		return time.Duration(n) * time.Second, true
+	}
+	if maxAge, ok = seconds("s-maxage"); !ok {
+		maxAge, ok = seconds("max-age")
+	}
+	if !ok || maxAge == 0 {
+		return 0, 0, false
+	}
+	stale, _ = seconds("stale-while-revalidate")
+	return maxAge, stale, true
+}
+
+// parseCacheControl parses the directives of a Cache-Control header, mapping their (lowercased) names to their
+// values ("" for directives without one).
+func parseCacheControl(s string) map[string]string {
+	directives := make(map[string]string)
+	for _, d := range strings.Split(s, ",") {
+		d = strings.TrimSpace(d)
+		if d == "" {
+			continue
+		}
+		name, value := d, ""
+		if i := strings.IndexByte(d, '='); i >= 0 {
+			name, value = d[:i], strings.Trim(d[i+1:], `"`)
+		}
+		directives[strings.ToLower(strings.TrimSpace(name))] = strings.TrimSpace(value)
+	}
+	return directives
+}
+
+// A cappedBuffer buffers what is written to it, up to maxCachedBodySize; beyond that it discards everything.
+type cappedBuffer struct {
+	buf      bytes.Buffer
+	overflow bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if !b.overflow {
+		if b.buf.Len()+len(p) > maxCachedBodySize {
+			b.overflow = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// refresh fetches a new copy of a stale cached response, sending out (which is not tied to any client request)
+// to the backend of rule and caching the response under key.
+func (p *Proxy) refresh(rule *Conf, out *http.Request, key string) {
+	cache := rule.To.cache
+	resp, err := p.roundTrip(rule, out)
+	if err != nil {
+		LogWarnf("#red{cache refresh error} (%s): %s", out.URL, err)
+		cache.refreshFailed(key)
+		return
+	}
+	defer resp.Body.Close()
+	header := make(http.Header)
+	rule.To.copyResponseHeader(header, resp.Header)
+	var body io.Reader = resp.Body
+	if rule.To.shouldReplaceBody(out, resp) {
+		header.Del("Content-Length")
+		body = newReplaceReader(body, rule.To.BodyReplace)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(body, maxCachedBodySize+1))
+	if err != nil {
+		LogWarnf("#red{cache refresh error} (%s): %s", out.URL, err)
+		cache.refreshFailed(key)
+		return
+	}
+	cache.store(key, resp.StatusCode, header, b)
+}
@@ -0,0 +1,234 @@
+package erebus
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeClock is a manually advanced clock, safe for concurrent use.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	var hits int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&hits, 1)
+		switch r.URL.Path {
+		case "/nostore":
+			w.Header().Set("Cache-Control", "no-store")
+		default:
+			w.Header().Set("Cache-Control", "public, max-age=60, stale-while-revalidate=30")
+		}
+		fmt.Fprintf(w, "v%d", n)
+	}))
+	proxy, server := startProxy(t, `[{"from": {}, "to": {"addr": "{{backend1}}", "cache": true}}]`, backend)
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	proxy.Rules[0].To.cache.now = clock.Now
+
+	get := func(path string) (string, string) {
+		t.Helper()
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body), resp.Header.Get("Age")
+	}
+	check := func(desc, path, wantBody string, wantHits int32) {
+		t.Helper()
+		if body, _ := get(path); body != wantBody {
+			t.Errorf("%s: got body %q; want %q", desc, body, wantBody)
+		}
+		if got := atomic.LoadInt32(&hits); got != wantHits {
+			t.Errorf("%s: backend got %d requests; want %d", desc, got, wantHits)
+		}
+	}
+
+	check("first request", "/", "v1", 1)
+	clock.Advance(10 * time.Second)
+	if body, age := get("/"); body != "v1" || age != "10" {
+		t.Errorf("fresh cache hit: got body %q and Age %q; want v1 and 10", body, age)
+	}
+	if got := atomic.LoadInt32(&hits); got != 1 {
+		t.Errorf("fresh cache hit: backend got %d requests; want 1", got)
+	}
+
+	// Once stale, the cached response is served while it is refreshed in the background.
+	clock.Advance(60 * time.Second)
+	if body, _ := get("/"); body != "v1" {
+		t.Errorf("stale cache hit: got body %q; want v1", body)
+	}
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt32(&hits) < 2; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the stale response was not refreshed")
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if body, _ := get("/"); body == "v2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the refreshed response was not cached")
+		}
+	}
+	if got := atomic.LoadInt32(&hits); got != 2 {
+		t.Errorf("after the refresh: backend got %d requests; want 2", got)
+	}
+
+	// Beyond the stale-while-revalidate window, the backend is asked directly.
+	clock.Advance(200 * time.Second)
+	check("expired", "/", "v3", 3)
+
+	check("no-store (1 of 2)", "/nostore", "v4", 4)
+	check("no-store (2 of 2)", "/nostore", "v5", 5)
+}
+
+func TestOnAllDownStale(t *testing.T) {
+	var up int32 = 1
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&up) == 0 {
+			panic(http.ErrAbortHandler) // Drop the connection, as if the backend were down
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(w, "cached")
+	}))
+	proxy, server := startProxy(t, `[{"from": {}, "to": {"addr": "{{backend1}}", "cache": true,
+	  "onalldown": {"mode": "stale", "retryafter": 5}}}]`, backend)
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	proxy.Rules[0].To.cache.now = clock.Now
+
+	get := func(path string) (*http.Response, string) {
+		t.Helper()
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, string(body)
+	}
+
+	get("/")
+	atomic.StoreInt32(&up, 0)
+	clock.Advance(time.Hour)
+	resp, body := get("/")
+	if resp.StatusCode != http.StatusOK || body != "cached" {
+		t.Errorf("with the backend down: got %d %q; want the stale cached response", resp.StatusCode, body)
+	}
+	if age := resp.Header.Get("Age"); age != "3600" {
+		t.Errorf("stale response: got Age %q; want 3600", age)
+	}
+
+	// Without a cached response, the client is told to come back later.
+	resp, _ = get("/uncached")
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "5" {
+		t.Errorf("uncached with the backend down: got %d with Retry-After %q; want 503 with 5",
+			resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	// Once the backend is back, it's asked again.
+	atomic.StoreInt32(&up, 1)
+	if resp, _ := get("/"); resp.Header.Get("X-Cache") != "MISS" {
+		t.Errorf("with the backend back up: got X-Cache %q; want MISS", resp.Header.Get("X-Cache"))
+	}
+}
+
+func TestCacheLifetime(t *testing.T) {
+	for _, tc := range []struct {
+		status       int
+		cacheControl string
+		maxAge       time.Duration
+		stale        time.Duration
+		ok           bool
+	}{
+		{200, "max-age=60", time.Minute, 0, true},
+		{200, "max-age=60, s-maxage=120, stale-while-revalidate=30", 2 * time.Minute, 30 * time.Second, true},
+		{200, `Max-Age="5"`, 5 * time.Second, 0, true},
+		{200, "max-age=0", 0, 0, false},
+		{200, "max-age=60, private", 0, 0, false},
+		{200, "no-cache, max-age=60", 0, 0, false},
+		{200, "", 0, 0, false},
+		{404, "max-age=60", 0, 0, false},
+	} {
+		h := http.Header{"Cache-Control": {tc.cacheControl}}
+		maxAge, stale, ok := cacheLifetime(tc.status, h)
+		if maxAge != tc.maxAge || stale != tc.stale || ok != tc.ok {
+			t.Errorf("%d %q: got (%s, %s, %t); want (%s, %s, %t)", tc.status, tc.cacheControl, maxAge, stale, ok,
+				tc.maxAge, tc.stale, tc.ok)
+		}
+	}
+}
+
+func TestCacheStatusHeader(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("X-Cache", "backend's own") // Replaced by erebus's
+		fmt.Fprint(w, "cached")
+	}))
+	_, server := startProxy(t, `[
+		{"from": {"pathprefix": "/default/"}, "to": {"addr": "{{backend1}}", "cache": true}},
+		{"from": {"pathprefix": "/named/"}, "to": {"addr": "{{backend1}}", "cache": true,
+		                                           "cachestatusheader": "X-Erebus-Cache"}},
+		{"from": {"pathprefix": "/none/"}, "to": {"addr": "{{backend1}}", "cache": true,
+		                                          "cachestatusheader": "-"}}
+	]`, backend)
+	captureLog(t)
+	get := func(path, header string) string {
+		t.Helper()
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if vv := resp.Header[header]; len(vv) > 1 {
+			t.Errorf("%s: got %s %q; want one value", path, header, vv)
+		}
+		return resp.Header.Get(header)
+	}
+	for _, tc := range []struct {
+		path   string
+		header string
+	}{
+		{"/default/a", "X-Cache"},
+		{"/named/a", "X-Erebus-Cache"},
+	} {
+		if got := get(tc.path, tc.header); got != "MISS" {
+			t.Errorf("first request for %s: got %s %q; want MISS", tc.path, tc.header, got)
+		}
+		if got := get(tc.path, tc.header); got != "HIT" {
+			t.Errorf("second request for %s: got %s %q; want HIT", tc.path, tc.header, got)
+		}
+	}
+	get("/none/a", "X-Cache")
+	if got := get("/none/a", "X-Cache"); got != "backend's own" {
+		t.Errorf("with cachestatusheader \"-\": got X-Cache %q; want the backend's", got)
+	}
+}
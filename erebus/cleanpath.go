@@ -0,0 +1,37 @@
+package erebus
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+// CleanRequestPath returns r with its URL path in canonical form, as given by path.Clean: dot segments
+// ("/a/../b") are resolved and repeated slashes ("//a") are collapsed. A trailing slash is kept. If the path
+// is already clean, r itself is returned.
+//
+// Without cleaning, rules are matched against the path exactly as the client sent it, so that a client may
+// reach a path such as /admin/ through a request for /public/../admin/ which matches a rule for /public/
+// instead (though whether the backend resolves the dot segments is up to the backend). Likewise, "//admin/"
+// doesn't match a pathprefix of "/admin/".
+func CleanRequestPath(r *http.Request) *http.Request {
+	p := r.URL.Path
+	if !strings.HasPrefix(p, "/") {
+		return r // Such as the "*" of OPTIONS *
+	}
+	clean := path.Clean(p)
+	if strings.HasSuffix(p, "/") && clean != "/" {
+		clean += "/"
+	}
+	if clean == p {
+		return r
+	}
+	r2 := new(http.Request)
+	*r2 = *r
+	u := *r.URL
+	u.Path = clean
+	u.RawPath = "" // The original escaping can't be kept
+	r2.URL = &u
+	r2.RequestURI = u.RequestURI() // So that a rule's RawPath doesn't send the uncleaned path
+	return r2
+}
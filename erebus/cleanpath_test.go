@@ -0,0 +1,79 @@
+package erebus
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCleanRequestPath(t *testing.T) {
+	for _, tc := range []struct {
+		path string
+		want string
+	}{
+		{"/", "/"},
+		{"/a/b", "/a/b"},
+		{"/a/b/", "/a/b/"},
+		{"//a//b", "/a/b"},
+		{"/a/../b", "/b"},
+		{"/a/./b/", "/a/b/"},
+		{"/../../etc/passwd", "/etc/passwd"},
+		{"/a/b/..", "/a"},
+		{"*", "*"},
+	} {
+		r := httptest.NewRequest("OPTIONS", "/", nil)
+		r.URL.Path = tc.path
+		if got := CleanRequestPath(r).URL.Path; got != tc.want {
+			t.Errorf("CleanRequestPath(%q): got %q; want %q", tc.path, got, tc.want)
+		}
+		if r.URL.Path != tc.path {
+			t.Errorf("CleanRequestPath(%q) modified the request", tc.path)
+		}
+	}
+}
+
+func TestCleanPath(t *testing.T) {
+	backend := NewRecordingBackend()
+	proxy, server := startProxy(t, `[
+		{"from": {"pathprefix": "/public/"}, "to": {"addr": "{{backend1}}"}},
+		{"from": {}, "respond": {"status": 403, "body": "forbidden"}}
+	]`, backend.Server)
+	captureLog(t)
+	for _, tc := range []struct {
+		clean    bool
+		path     string
+		wantCode int
+		wantPath string
+	}{
+		{false, "/public/a", 200, "/public/a"},
+		{true, "/public/a", 200, "/public/a"},
+		// Dot segments and double slashes can't reach around the prefix.
+		{false, "/public/../admin/", 200, "/public/../admin/"},
+		{true, "/public/../admin/", 403, ""},
+		{false, "/.//public/a", 403, ""},
+		{true, "/.//public//a", 200, "/public/a"},
+		{true, "/admin/../public/./a", 200, "/public/a"},
+	} {
+		proxy.CleanPath = tc.clean
+		// Send the raw path; http.NewRequest would keep it, but some clients clean it themselves.
+		req, err := http.NewRequest("GET", server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.URL.Opaque = tc.path
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.wantCode {
+			t.Errorf("cleanpath=%t, %s: got status %d; want %d", tc.clean, tc.path, resp.StatusCode, tc.wantCode)
+			continue
+		}
+		if tc.wantPath != "" {
+			if got := backend.Next(t).URL.Path; got != tc.wantPath {
+				t.Errorf("cleanpath=%t, %s: backend got path %q; want %q", tc.clean, tc.path, got, tc.wantPath)
+			}
+		}
+	}
+}
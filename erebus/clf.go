@@ -0,0 +1,85 @@
+package erebus
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LogFormatCLF is the Proxy.LogFormat for access logs in the Apache Combined Log Format.
+const LogFormatCLF = "clf"
+
+// A statusRecorder is an http.ResponseWriter which records the status and the number of body bytes written.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	n      int64
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	// Informational responses (such as 103 Early Hints) precede the final status.
+	if w.status == 0 && (status >= 200 || status == http.StatusSwitchingProtocols) {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *statusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack allows connection upgrades to pass through the recorder.
+func (w *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("connection cannot be hijacked")
+	}
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return hj.Hijack()
+}
+
+var clfEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// clfLine formats a Combined Log Format line for r, which was received at start and answered as recorded by w:
+//
+//	127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /a.gif HTTP/1.0" 200 2326 "http://x.com/" "Mozilla/4.08"
+func clfLine(r *http.Request, start time.Time, w *statusRecorder) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK // The server sends a 200 if nothing was written
+	}
+	size := "-"
+	if w.n > 0 {
+		size = strconv.FormatInt(w.n, 10)
+	}
+	quote := func(s string) string {
+		if s == "" {
+			return `"-"`
+		}
+		return `"` + clfEscaper.Replace(s) + `"`
+	}
+	requestLine := fmt.Sprintf("%s %s %s", r.Method, r.RequestURI, r.Proto)
+	return fmt.Sprintf("%s - - [%s] %s %d %s %s %s", host, start.Format("02/Jan/2006:15:04:05 -0700"),
+		quote(requestLine), status, size, quote(r.Referer()), quote(r.UserAgent()))
+}
@@ -0,0 +1,73 @@
+package erebus
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCLF(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello world")
+	}))
+	rules := `[{"from": {"path": "/empty"}, "respond": {"status": 204}},
+	           {"from": {}, "to": {"addr": "{{backend1}}"}}]`
+	proxy, server := startProxy(t, rules, backend)
+	proxy.LogFormat = LogFormatCLF
+	logs := captureLog(t)
+
+	for _, path := range []string{"/a?b=c", "/empty"} {
+		req, err := http.NewRequest("GET", server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Referer", "http://example.com/")
+		req.Header.Set("User-Agent", `agent "quoted"`)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	wants := []*regexp.Regexp{
+		regexp.MustCompile(`^127\.0\.0\.1 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [-+]\d{4}\] "GET /a\?b=c HTTP/1\.1" ` +
+			`200 11 "http://example\.com/" "agent \\"quoted\\""$`),
+		regexp.MustCompile(`^127\.0\.0\.1 - - \[[^]]+\] "GET /empty HTTP/1\.1" 204 - "http://example\.com/" "[^"]+`),
+	}
+	if len(lines) != len(wants) {
+		t.Fatalf("got log lines %q; want %d lines", lines, len(wants))
+	}
+	for i, want := range wants {
+		if !want.MatchString(lines[i]) {
+			t.Errorf("got log line %q; want a match for %s", lines[i], want)
+		}
+	}
+
+	// With an AccessLog, the lines are written there instead, untouched by the log package.
+	accessLog := &syncBuffer{}
+	proxy.AccessLog = accessLog
+	logged := logs.String()
+	resp, err := http.Get(server.URL + "/empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	for deadline := time.Now().Add(5 * time.Second); accessLog.String() == ""; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("nothing was written to the AccessLog")
+		}
+	}
+	want := regexp.MustCompile(`^127\.0\.0\.1 - - \[[^]]+\] "GET /empty HTTP/1\.1" 204 - "-" "[^"]+"\n$`)
+	if got := accessLog.String(); !want.MatchString(got) {
+		t.Errorf("got access log %q; want a match for %s", got, want)
+	}
+	if got := strings.TrimPrefix(logs.String(), logged); got != "" {
+		t.Errorf("with an AccessLog, got log output %q", got)
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package erebus
 
 import (
 	"log"
@@ -8,16 +8,18 @@ import (
 import "strings"
 
 const (
-	colorReset = 0
-	colorRed   = 31
-	colorGreen = 32
-	colorBlue  = 34
+	colorReset  = 0
+	colorRed    = 31
+	colorGreen  = 32
+	colorYellow = 33
+	colorBlue   = 34
 )
 
 var nameToColor = map[string]int{
-	"red":   colorRed,
-	"green": colorGreen,
-	"blue":  colorBlue,
+	"red":    colorRed,
+	"green":  colorGreen,
+	"yellow": colorYellow,
+	"blue":   colorBlue,
 }
 
 func colorize(s string, color int) string {
@@ -0,0 +1,93 @@
+package erebus
+
+import (
+	"io"
+	"time"
+)
+
+// defaultCopyBufferSize is the size of the buffer used for relaying response bodies if the Proxy doesn't set
+// CopyBufferSize. It's the same as io.Copy's.
+const defaultCopyBufferSize = 32 << 10
+
+// copyResponse copies a response body from src to dst using a pooled buffer of p.CopyBufferSize bytes.
+func (p *Proxy) copyResponse(dst io.Writer, src io.Reader) (int64, error) {
+	size := p.CopyBufferSize
+	if size <= 0 {
+		size = defaultCopyBufferSize
+	}
+	buf, _ := p.copyBuffers.Get().(*[]byte)
+	if buf == nil || len(*buf) != size {
+		b := make([]byte, size)
+		buf = &b
+	}
+	defer p.copyBuffers.Put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
+
+// bodyStartSize is how much of a response body readBodyStart reads ahead.
+const bodyStartSize = 512
+
+// bodyStartWait is how long readBodyStart waits for the beginning of a response body.
+var bodyStartWait = 50 * time.Millisecond
+
+// readBodyStart reads the beginning of a backend response body before any of the response is sent, so that a
+// body which is broken from the outset (such as one with malformed chunked encoding) can still be answered
+// with a clean error. The returned reader yields the whole body, including the part already read.
+//
+// A streaming backend (serving server-sent events, say) may not send any of the body for a long time, and its
+// client should get the response headers meanwhile. So readBodyStart only waits for bodyStartWait; if the
+// body hasn't started by then, ready is false and the read carries on in the background.
+func readBodyStart(body io.Reader) (r io.Reader, ready bool, err error) {
+	done := make(chan bodyStart, 1)
+	go func() {
+		head := make([]byte, bodyStartSize)
+		n, err := io.ReadAtLeast(body, head, 1)
+		done <- bodyStart{head[:n], err}
+	}()
+	t := time.NewTimer(bodyStartWait)
+	defer t.Stop()
+	select {
+	case start := <-done:
+		if start.err != nil && start.err != io.EOF {
+			return nil, true, start.err
+		}
+		return &prefixReader{head: start.head, r: body}, true, nil
+	case <-t.C:
+		return &prefixReader{pending: done, r: body}, false, nil
+	}
+}
+
+type bodyStart struct {
+	head []byte
+	err  error // Only set if head is empty
+}
+
+// A prefixReader yields head (once pending, if set, delivers it) followed by the rest of r. It deliberately has
+// no WriteTo method, so that copyResponse's buffer is used for the remainder.
+type prefixReader struct {
+	pending <-chan bodyStart
+	head    []byte
+	r       io.Reader
+}
+
+func (pr *prefixReader) Read(b []byte) (int, error) {
+	if pr.pending != nil {
+		start := <-pr.pending
+		pr.pending = nil
+		if start.err != nil {
+			return 0, start.err
+		}
+		pr.head = start.head
+	}
+	if len(pr.head) == 0 {
+		return pr.r.Read(b)
+	}
+	n := copy(b, pr.head)
+	pr.head = pr.head[n:]
+	if n == len(b) {
+		return n, nil
+	}
+	// Fill the rest of b as well, so the head doesn't cost an extra write to the client.
+	m, err := pr.r.Read(b[n:])
+	return n + m, err
+}
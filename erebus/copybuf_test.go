@@ -0,0 +1,172 @@
+package erebus
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countingResponseWriter counts the writes of the response body.
+type countingResponseWriter struct {
+	header http.Header
+	writes int
+	n      int
+}
+
+func (w *countingResponseWriter) Header() http.Header { return w.header }
+func (w *countingResponseWriter) WriteHeader(int)     {}
+
+func (w *countingResponseWriter) Write(b []byte) (int, error) {
+	w.writes++
+	w.n += len(b)
+	return len(b), nil
+}
+
+func TestCopyBufferSize(t *testing.T) {
+	body := bytes.Repeat([]byte("x"), 100<<10)
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write(body) })
+	proxy, err := NewInMemoryProxy([]byte(`[{"from": {}, "to": {"addr": "backend:80"}}]`),
+		map[string]http.Handler{"backend:80": backend})
+	if err != nil {
+		t.Fatal(err)
+	}
+	captureLog(t)
+	for _, tc := range []struct {
+		size   int
+		writes int
+	}{
+		{0, 4}, // 32KB
+		{10 << 10, 10},
+		{1 << 20, 1},
+	} {
+		proxy.CopyBufferSize = tc.size
+		w := &countingResponseWriter{header: make(http.Header)}
+		proxy.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if w.n != len(body) || w.writes != tc.writes {
+			t.Errorf("buffer size %d: got %d bytes in %d writes; want %d bytes in %d writes", tc.size, w.n, w.writes,
+				len(body), tc.writes)
+		}
+	}
+}
+
+func BenchmarkCopyBufferSize(b *testing.B) {
+	body := bytes.Repeat([]byte("x"), 8<<20)
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write(body) })
+	proxy, err := NewInMemoryProxy([]byte(`[{"from": {}, "to": {"addr": "backend:80"}}]`),
+		map[string]http.Handler{"backend:80": backend})
+	if err != nil {
+		b.Fatal(err)
+	}
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	for _, size := range []int{0, 256 << 10, 1 << 20} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			proxy.CopyBufferSize = size
+			r := httptest.NewRequest("GET", "/", nil)
+			b.SetBytes(int64(len(body)))
+			b.ReportAllocs()
+			var writes int
+			for i := 0; i < b.N; i++ {
+				w := &countingResponseWriter{header: make(http.Header)}
+				proxy.ServeHTTP(w, r)
+				writes += w.writes
+			}
+			b.ReportMetric(float64(writes)/float64(b.N), "writes/op")
+		})
+	}
+}
+
+func TestBrokenChunkedBody(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nX-Backend: yes\r\n\r\n")
+		if r.URL.Path == "/late" {
+			buf.WriteString("5\r\nhello\r\n")
+		}
+		buf.WriteString("zz\r\nnot a chunk\r\n")
+		buf.Flush()
+	}))
+	_, server := startProxy(t, `[{"from": {}, "to": {"addr": "{{backend1}}"}}]`, backend)
+	logs := captureLog(t)
+
+	// If the body is broken from the start, the client gets a clean error.
+	resp, err := http.Get(server.URL + "/early")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("broken body: got status %d; want 502", resp.StatusCode)
+	}
+	if got := resp.Header.Get("X-Backend"); got != "" {
+		t.Errorf("broken body: got X-Backend header %q; want none", got)
+	}
+	if !strings.Contains(string(body), "error reading backend response body") {
+		t.Errorf("broken body: got body %q; want it to describe the error", body)
+	}
+
+	// If part of the body was good, the response must not look complete.
+	resp, err = http.Get(server.URL + "/late")
+	if err == nil {
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err == nil {
+			t.Errorf("body broken partway through: got %q and no error; want the response to be aborted", body)
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		for _, line := range logLines(logs) {
+			if strings.Contains(line, "backend response body error") {
+				return
+			}
+		}
+	}
+	t.Errorf("got log %q; want the broken body to be logged", logs)
+}
+
+func TestSlowBodyStart(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-release
+		io.WriteString(w, "data: hello\n\n")
+	}))
+	defer backend.Close()
+	_, server := startProxy(t, `[{"from": {}, "to": {"addr": "{{backend1}}"}}]`, backend)
+	captureLog(t)
+
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("the headers of a response whose body hasn't started weren't sent: %s", err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("got Content-Type %q; want text/event-stream", got)
+	}
+	release <- struct{}{}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil || string(body) != "data: hello\n\n" {
+		t.Errorf("got body %q (err = %v); want the event", body, err)
+	}
+}
@@ -0,0 +1,40 @@
+package erebus
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// A requestBudget enforces a rule's Deadline: once it passes, it cancels the request to the backend, cutting
+// short any attempt, retry, or backoff in progress. A nil *requestBudget has no deadline.
+type requestBudget struct {
+	timer   *time.Timer
+	expired int32 // Accessed atomically
+}
+
+// startBudget starts the budget for a request matching c, which calls cancel when the budget is exhausted.
+func (c *ToConf) startBudget(cancel func()) *requestBudget {
+	if c.Deadline <= 0 {
+		return nil
+	}
+	b := &requestBudget{}
+	b.timer = time.AfterFunc(time.Duration(c.Deadline)*time.Millisecond, func() {
+		atomic.StoreInt32(&b.expired, 1)
+		cancel()
+	})
+	return b
+}
+
+// stop stops the budget once the backend has responded (so that relaying the body isn't subject to it). It
+// reports whether the budget was stopped in time.
+func (b *requestBudget) stop() bool {
+	if b == nil {
+		return true
+	}
+	b.timer.Stop()
+	return !b.exhausted()
+}
+
+func (b *requestBudget) exhausted() bool {
+	return b != nil && atomic.LoadInt32(&b.expired) == 1
+}
@@ -0,0 +1,65 @@
+package erebus
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// A defaultHeaderWriter is an http.ResponseWriter which, when the response header is written, adds those of
+// the default headers which the response doesn't already have.
+type defaultHeaderWriter struct {
+	http.ResponseWriter
+	defaults http.Header
+	applied  bool
+}
+
+// WithDefaultHeaders returns a ResponseWriter which writes to w, adding those of the defaults which a response
+// doesn't already have when its header is written (as with Proxy.ResponseHeaders). It's for responses which
+// are served alongside a Proxy but not by it, such as administrative ones.
+func WithDefaultHeaders(w http.ResponseWriter, defaults http.Header) http.ResponseWriter {
+	if len(defaults) == 0 {
+		return w
+	}
+	return &defaultHeaderWriter{ResponseWriter: w, defaults: defaults}
+}
+
+func (w *defaultHeaderWriter) apply() {
+	if w.applied {
+		return
+	}
+	w.applied = true
+	h := w.ResponseWriter.Header()
+	for k, vv := range w.defaults {
+		if _, ok := h[k]; !ok {
+			h[k] = append([]string(nil), vv...)
+		}
+	}
+}
+
+func (w *defaultHeaderWriter) WriteHeader(status int) {
+	w.apply()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *defaultHeaderWriter) Write(b []byte) (int, error) {
+	w.apply()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *defaultHeaderWriter) Flush() {
+	w.apply()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack allows connection upgrades to pass through. The backend's 101 response is relayed as is.
+func (w *defaultHeaderWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("connection cannot be hijacked")
+	}
+	return hj.Hijack()
+}
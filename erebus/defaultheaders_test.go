@@ -0,0 +1,57 @@
+package erebus
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResponseHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/framed" {
+			w.Header().Set("X-Frame-Options", "SAMEORIGIN")
+		}
+	}))
+	defer backend.Close()
+	proxy, server := startProxy(t, `[
+		{"from": {"host": "down.com"}, "to": {"addr": "localhost:1"}},
+		{"from": {"host": "static.com"}, "respond": {"status": 204}},
+		{"from": {"host": "app.com"}, "to": {"addr": "{{backend1}}"}}
+	]`, backend)
+	proxy.ResponseHeaders = http.Header{
+		"X-Frame-Options":           {"DENY"},
+		"Strict-Transport-Security": {"max-age=31536000"},
+	}
+
+	for _, tt := range []struct {
+		host, path string
+		wantStatus int
+		wantFrame  string
+	}{
+		{"app.com", "/", http.StatusOK, "DENY"},
+		{"app.com", "/framed", http.StatusOK, "SAMEORIGIN"}, // The backend's own value is kept
+		{"static.com", "/", http.StatusNoContent, "DENY"},
+		{"down.com", "/", http.StatusBadGateway, "DENY"},
+		{"nomatch.com", "/", http.StatusBadGateway, "DENY"},
+	} {
+		req, err := http.NewRequest("GET", server.URL+tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = tt.host
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.wantStatus {
+			t.Errorf("%s%s: got status %d; want %d", tt.host, tt.path, resp.StatusCode, tt.wantStatus)
+		}
+		if got := resp.Header["X-Frame-Options"]; len(got) != 1 || got[0] != tt.wantFrame {
+			t.Errorf("%s%s: got X-Frame-Options %q; want %q", tt.host, tt.path, got, tt.wantFrame)
+		}
+		if got := resp.Header.Get("Strict-Transport-Security"); got != "max-age=31536000" {
+			t.Errorf("%s%s: got Strict-Transport-Security %q; want max-age=31536000", tt.host, tt.path, got)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package erebus
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// A DrainSet holds the addresses of backends which are draining: while another backend is available for a
+// rule, new requests are not sent to a draining one (requests already in flight are unaffected). The zero
+// DrainSet is empty and ready to use. It is safe for concurrent use.
+type DrainSet struct {
+	mu    sync.RWMutex
+	addrs map[string]bool
+}
+
+// Drain marks the backend at addr as draining.
+func (d *DrainSet) Drain(addr string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.addrs == nil {
+		d.addrs = make(map[string]bool)
+	}
+	d.addrs[addr] = true
+}
+
+// Undrain returns the backend at addr to service.
+func (d *DrainSet) Undrain(addr string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.addrs, addr)
+}
+
+// Draining reports whether the backend at addr is draining. A nil DrainSet is empty.
+func (d *DrainSet) Draining(addr string) bool {
+	if d == nil {
+		return false
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.addrs[addr]
+}
+
+// Addrs returns the (sorted) addresses of the draining backends.
+func (d *DrainSet) Addrs() []string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	addrs := make([]string, 0, len(d.addrs))
+	for addr := range d.addrs {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// unavailable reports whether new requests should not be sent to the backend at addr, if there's an
+// alternative: it's draining or down.
+func (p *Proxy) unavailable(addr string) bool {
+	return p.Drains.Draining(addr) || p.Health.Down(addr)
+}
+
+// availableAddr returns the backend address to use for the request r to the rule c which was to be sent to
+// addr: addr itself, unless it is unavailable and another of the rule's backends is not. Requests hashed
+// among Addrs move to the next available backend on the ring; otherwise the alternative is the rule's other
+// backend (its Addr or CanaryAddr).
+func (c *ToConf) availableAddr(r *http.Request, addr string, unavailable func(string) bool) string {
+	if !unavailable(addr) {
+		return addr
+	}
+	if c.ring != nil {
+		if alt := c.hashAddr(r, unavailable); !unavailable(alt) {
+			return alt
+		}
+	}
+	alt := c.CanaryAddr
+	if addr == c.CanaryAddr {
+		alt = c.Addr
+	}
+	if alt == "" || unavailable(alt) {
+		return addr
+	}
+	return alt
+}
@@ -0,0 +1,48 @@
+package erebus
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAvailableAddr(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	to := &ToConf{Addr: "stable:80", CanaryAddr: "canary:80", CanaryPercent: 50}
+	for _, tt := range []struct {
+		addr    string
+		drained []string
+		want    string
+	}{
+		{"stable:80", nil, "stable:80"},
+		{"canary:80", nil, "canary:80"},
+		{"canary:80", []string{"canary:80"}, "stable:80"},
+		{"stable:80", []string{"stable:80"}, "canary:80"},
+		{"stable:80", []string{"canary:80"}, "stable:80"},
+		{"stable:80", []string{"stable:80", "canary:80"}, "stable:80"},
+	} {
+		var drains DrainSet
+		for _, addr := range tt.drained {
+			drains.Drain(addr)
+		}
+		if got := to.availableAddr(r, tt.addr, drains.Draining); got != tt.want {
+			t.Errorf("availableAddr(%q) with %q draining: got %q; want %q", tt.addr, tt.drained, got, tt.want)
+		}
+	}
+
+	// A rule without a canary has nowhere else to send requests.
+	var drains DrainSet
+	drains.Drain("stable:80")
+	to = &ToConf{Addr: "stable:80"}
+	if got := to.availableAddr(r, "stable:80", drains.Draining); got != "stable:80" {
+		t.Errorf("availableAddr without a canary: got %q; want \"stable:80\"", got)
+	}
+	var none *DrainSet
+	if got := to.availableAddr(r, "stable:80", none.Draining); got != "stable:80" {
+		t.Errorf("availableAddr with a nil DrainSet: got %q; want \"stable:80\"", got)
+	}
+
+	drains.Undrain("stable:80")
+	if drains.Draining("stable:80") {
+		t.Error("stable:80 still draining after Undrain")
+	}
+}
@@ -0,0 +1,1715 @@
+// Package erebus implements the erebus HTTP reverse proxy. A Proxy routes each request according to the first
+// of its rules that matches, and may be embedded in other programs as an http.Handler.
+package erebus
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"regexp"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Conf struct {
+	From    *FromConf
+	To      *ToConf
+	Respond *RespondConf // A fixed response to give instead of proxying to a backend (exclusive with To)
+
+	// If non-empty, OPTIONS requests matching the rule are answered by erebus (with a 204 listing these methods
+	// in the Allow header) rather than proxied or given the Respond response.
+	OptionsAllow []string
+
+	// If set to false, the rule is skipped as if it weren't in the configuration (though it must still be
+	// valid). Rules are enabled by default.
+	Enabled *bool
+
+	// transport is the dedicated transport used for this rule if it has its own TLS settings.
+	transportOnce sync.Once
+	transport     http.RoundTripper
+
+	limitOnce sync.Once // See Proxy.shareLimit
+
+	inFlight int64 // Accessed atomically; see InFlight
+}
+
+func (c *Conf) validate(regexes regexCache) error {
+	if err := c.From.validate(regexes); err != nil {
+		return err
+	}
+	for i, m := range c.OptionsAllow {
+		m = strings.ToUpper(strings.TrimSpace(m))
+		if m == "" {
+			return fmt.Errorf("optionsallow may not contain an empty method")
+		}
+		c.OptionsAllow[i] = m
+	}
+	switch {
+	case c.To != nil && c.Respond != nil:
+		return fmt.Errorf("a rule may not have both a 'to' and a 'respond'")
+	case c.Respond != nil:
+		c.Respond.validate()
+		return nil
+	case c.To == nil:
+		return fmt.Errorf("a rule must have a 'to' or a 'respond'")
+	}
+	return c.To.validate()
+}
+
+// IsEnabled reports whether the rule is used to match requests; see Enabled.
+func (c *Conf) IsEnabled() bool {
+	return c.Enabled == nil || *c.Enabled
+}
+
+func (c *Conf) serveOptions(w http.ResponseWriter) {
+	w.Header().Set("Allow", strings.Join(c.OptionsAllow, ", "))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type FromConf struct {
+	Host       string
+	HostSuffix string // Matches a host (ignoring any port) and its subdomains; see matchesHostSuffix
+	Path       string
+	PathPrefix string
+	PathRegex  string
+
+	// By default, PathRegex matches any part of the path; with PathRegexFullMatch it must match the whole path.
+	PathRegexFullMatch bool
+
+	Scheme       string // "http" or "https"; see requestScheme
+	ContentType  string // The media type of the request body, ignoring parameters such as charset
+	ServerName   string // The TLS SNI server name
+	ClientCertCN string // The common name of the TLS client certificate
+	regex        *regexp.Regexp
+
+	// If the request has no Content-Type, match ContentType against the type detected from the start of the
+	// body instead (as with http.DetectContentType).
+	SniffContentType bool
+
+	// The request must not have any of these headers (such as Authorization).
+	HeadersAbsent []string
+
+	// The request must have cookies with these names and values.
+	Cookies map[string]string
+
+	// If non-nil, a claim which must be present in the request's bearer JWT.
+	JWTClaim *JWTClaimConf
+
+	// If non-empty, at least one of these must also match (in addition to all the criteria above).
+	Any []*FromConf
+
+	// Plaintext requests matching the rule get a redirect to HTTPS instead of being handled by it. Whether a
+	// request used TLS is decided as for Scheme, so behind a TLS-terminating proxy, set the Proxy's
+	// TrustForwardedProto; otherwise every request looks like plaintext and is redirected in a loop. It may
+	// only be set in a rule's top-level 'from'.
+	RequireTLS bool
+}
+
+func (c *FromConf) validate(regexes regexCache) error {
+	if c.PathRegex != "" {
+		pattern := c.PathRegex
+		if c.PathRegexFullMatch {
+			pattern = `\A(?:` + pattern + `)\z`
+		}
+		var err error
+		c.regex, err = regexes.compile(pattern)
+		if err != nil {
+			return err
+		}
+	}
+	if c.JWTClaim != nil {
+		if err := c.JWTClaim.validate(); err != nil {
+			return err
+		}
+	}
+	for _, alt := range c.Any {
+		if alt.RequireTLS {
+			return fmt.Errorf("requiretls may only be set in a rule's top-level 'from'")
+		}
+		if err := alt.validate(regexes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A regexCache holds compiled regular expressions by their pattern. A nil regexCache compiles every pattern
+// afresh.
+type regexCache map[string]*regexp.Regexp
+
+func (c regexCache) compile(pattern string) (*regexp.Regexp, error) {
+	if re, ok := c[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if c != nil {
+		c[pattern] = re
+	}
+	return re, nil
+}
+
+// Matches determines whether an HTTP request matches this configuration: it must satisfy every criterion and,
+// if Any is given, match at least one of Any.
+func (c *FromConf) Matches(r *http.Request) bool {
+	return c.mismatch(r) == ""
+}
+
+// MatchReason is like Matches, but if r doesn't match it also returns the (configuration) name of the
+// criterion which r failed, such as "host" or "pathprefix".
+func (c *FromConf) MatchReason(r *http.Request) (bool, string) {
+	reason := c.mismatch(r)
+	return reason == "", reason
+}
+
+// mismatch returns the name of the first criterion which r fails, or "" if r matches.
+func (c *FromConf) mismatch(r *http.Request) string {
+	if reason := c.mismatchExceptJWT(r); reason != "" {
+		return reason
+	}
+	if c.JWTClaim != nil && !c.JWTClaim.matches(r) {
+		return "jwtclaim"
+	}
+	return ""
+}
+
+// TokenRequired reports whether r otherwise matches this configuration but lacks the valid JWT which the
+// JWTClaim requires. Such a request gets a 401 rather than moving on to the next rule.
+func (c *FromConf) TokenRequired(r *http.Request) bool {
+	if c.JWTClaim == nil || !c.JWTClaim.Required {
+		return false
+	}
+	if _, err := c.JWTClaim.claims(r); err == nil {
+		return false
+	}
+	return c.mismatchExceptJWT(r) == ""
+}
+
+func (c *FromConf) mismatchExceptJWT(r *http.Request) string {
+	switch {
+	case c.Host != "" && c.Host != r.Host:
+		return "host"
+	case c.HostSuffix != "" && !matchesHostSuffix(r.Host, c.HostSuffix):
+		return "hostsuffix"
+	case c.Path != "" && c.Path != r.URL.Path:
+		return "path"
+	case c.PathPrefix != "" && !strings.HasPrefix(r.URL.Path, c.PathPrefix):
+		return "pathprefix"
+	case c.regex != nil && !c.regex.MatchString(r.URL.Path):
+		return "pathregex"
+	case c.Scheme != "" && !strings.EqualFold(c.Scheme, requestScheme(r)):
+		return "scheme"
+	case c.ContentType != "" && !strings.EqualFold(c.ContentType, c.mediaType(r)):
+		return "contenttype"
+	case c.ServerName != "" && (r.TLS == nil || c.ServerName != r.TLS.ServerName):
+		return "servername"
+	case c.ClientCertCN != "" && c.ClientCertCN != clientCertCN(r):
+		return "clientcertcn"
+	case len(c.Cookies) > 0 && !matchesCookies(r, c.Cookies):
+		return "cookies"
+	}
+	for _, h := range c.HeadersAbsent {
+		if _, ok := r.Header[http.CanonicalHeaderKey(h)]; ok {
+			return "headersabsent"
+		}
+	}
+	if len(c.Any) == 0 {
+		return ""
+	}
+	for _, alt := range c.Any {
+		if alt.Matches(r) {
+			return ""
+		}
+	}
+	return "any"
+}
+
+// matchesCookies reports whether r has all the given cookies (by name) with the given values.
+func matchesCookies(r *http.Request, cookies map[string]string) bool {
+	for name, value := range cookies {
+		cookie, err := r.Cookie(name)
+		if err != nil || cookie.Value != value {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesHostSuffix reports whether host, with any port removed, is suffix or a subdomain of suffix. If suffix
+// starts with a dot (".example.com") then only subdomains match.
+func matchesHostSuffix(host, suffix string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if !strings.HasSuffix(host, suffix) {
+		return false
+	}
+	if len(host) == len(suffix) || strings.HasPrefix(suffix, ".") {
+		return true
+	}
+	return host[len(host)-len(suffix)-1] == '.'
+}
+
+type forwardedSchemeKey struct{}
+
+// requestScheme returns the scheme ("http" or "https") with which the client made r. This is the scheme
+// given by a trusted X-Forwarded-Proto header, if any (see Proxy.TrustForwardedProto); otherwise it is
+// determined by whether r was made over TLS.
+func requestScheme(r *http.Request) string {
+	if scheme, ok := r.Context().Value(forwardedSchemeKey{}).(string); ok {
+		return scheme
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// RedirectsToHTTPS reports whether r, matching this configuration, is redirected to HTTPS because of
+// RequireTLS.
+func (c *FromConf) RedirectsToHTTPS(r *http.Request) bool {
+	return c.RequireTLS && requestScheme(r) != "https"
+}
+
+// withForwardedScheme returns r annotated with the scheme given by its X-Forwarded-Proto header, if that is
+// "http" or "https". If several proxies are named, the first (the one nearest the client) is used.
+func withForwardedScheme(r *http.Request) *http.Request {
+	proto := strings.Split(r.Header.Get("X-Forwarded-Proto"), ",")[0]
+	switch scheme := strings.ToLower(strings.TrimSpace(proto)); scheme {
+	case "http", "https":
+		return r.WithContext(context.WithValue(r.Context(), forwardedSchemeKey{}, scheme))
+	}
+	return r
+}
+
+// mediaType returns the media type given by the Content-Type of r, or "" if there is none.
+func mediaType(r *http.Request) string {
+	t, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return ""
+	}
+	return t
+}
+
+// mediaType returns the media type of the body of r for matching against ContentType.
+func (c *FromConf) mediaType(r *http.Request) string {
+	t := mediaType(r)
+	if t == "" && c.SniffContentType {
+		t = sniffMediaType(r)
+	}
+	return t
+}
+
+// clientCertCN returns the common name of the client certificate presented with r, if any.
+func clientCertCN(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	return r.TLS.PeerCertificates[0].Subject.CommonName
+}
+
+// RespondConf is a static response.
+type RespondConf struct {
+	Status  int // Defaults to 200
+	Body    string
+	Headers map[string]string
+}
+
+func (c *RespondConf) validate() {
+	if c.Status == 0 {
+		c.Status = http.StatusOK
+	}
+}
+
+func (c *RespondConf) serve(w http.ResponseWriter) {
+	for k, v := range c.Headers {
+		w.Header().Set(k, v)
+	}
+	w.WriteHeader(c.Status)
+	io.WriteString(w, c.Body)
+}
+
+type ToConf struct {
+	Addr   string   // The backend host:port, or a DNS SRV name to resolve ("srv:_http._tcp.example.com")
+	Mirror []string // Shadow backends which are sent a copy of each request; their responses are discarded
+	NoXFF  bool     // Don't send X-Forwarded-For (and strip any the client sent)
+
+	// Instead of a single Addr, several backends among which requests are divided by consistent hashing on
+	// HashBy: "path", "clientip", or "header:<name>" (such as "header:X-Tenant"). Requests with the same key
+	// go to the same backend, and changing the list of backends only moves the keys of the backends added or
+	// removed.
+	Addrs  []string
+	HashBy string
+	ring   *hashRing
+
+	// Whether to trust the X-Forwarded-For sent by clients (the default). If false, the client's header is
+	// discarded and X-Forwarded-For holds just the client's address; use this for rules serving untrusted
+	// clients directly, which could otherwise forge their forwarded addresses.
+	TrustXFF *bool
+
+	// If nonzero, the maximum number of entries sent in X-Forwarded-For. Longer chains are truncated to the
+	// most recent (rightmost) entries.
+	MaxXFFHops int
+
+	// CanaryPercent percent of requests are sent to CanaryAddr rather than Addr, for gradual rollouts. If
+	// CanarySlowStart (in milliseconds) is set, the canary's share instead ramps up linearly from 0 to
+	// CanaryPercent over that long after the canary first appears in the configuration, so that a new canary
+	// isn't flooded. Likewise, any of the rule's backends which recovers from errors or a failed health check
+	// gets a share of its usual requests ramping up from 0 over that long; the rest go to the backend which
+	// would be used were it down. (Only a Proxy with SlowStarts keeps track of this; without one, the canary's
+	// ramp starts when the configuration is loaded and recovering backends get their usual share at once.)
+	CanaryAddr      string
+	CanaryPercent   float64
+	CanarySlowStart int
+	loaded          time.Time
+	now             func() time.Time // For testing CanarySlowStart; defaults to time.Now
+
+	// If non-nil, the User-Agent sent to the backend. An empty string means that no User-Agent is sent.
+	UserAgent *string
+
+	// If non-nil, how to respond when the backend cannot be reached (instead of a 502).
+	OnAllDown *OnAllDownConf
+
+	// If non-nil, the rule's backends are health checked; see HealthCheckConf.
+	HealthCheck *HealthCheckConf
+
+	// If non-nil, an external program consulted about each request; see HookConf.
+	Hook *HookConf
+
+	// Send HEAD requests to the backend as GETs (discarding the response body), for backends which don't
+	// support HEAD.
+	SynthesizeHead bool
+
+	// Fallback backends, by the status code of the response from the backend. If the backend responds with one
+	// of these statuses, the request is sent to the fallback instead (once; the fallback's response is used
+	// whatever its status).
+	OnStatus map[int]string
+
+	// Headers set on requests to the backend. The values may include the placeholders {host}, {path},
+	// {method}, and {clientip}, which are replaced by the corresponding attributes of the client's request.
+	SetHeaders map[string]string
+
+	// Send a W3C traceparent header to the backend, continuing the client's trace (with a new span ID) or, if
+	// the client didn't send one, starting a new trace.
+	TraceParent bool
+
+	// Request headers which, if the client sent several values, are sent to the backend as a single
+	// comma-separated value (or, for Cookie, separated by "; "), for backends which mishandle repeated headers.
+	FoldHeaders []string
+
+	// If non-nil, only the cookies with these names are sent to the backend.
+	ForwardCookies []string
+
+	// How to treat the Referer header: "" to pass it on unchanged, "drop" to remove it, or "rewrite" to
+	// replace the scheme and host of referers to the client's host with those of the backend.
+	Referer string
+
+	// A prefix added to the path of requests sent to the backend, such as "/service-a".
+	AddPrefix string
+
+	// Send the path to the backend exactly as the client encoded it (after any AddPrefix), rather than
+	// re-encoding the decoded path, for backends which distinguish, say, "%2F" from "/".
+	RawPath bool
+
+	// Query parameters added to the request if the client didn't send them (even with an empty value).
+	DefaultQuery map[string]string
+
+	// If non-empty, only these headers of the backend's response are passed on to the client, along with
+	// Content-Type, Content-Length, and Content-Encoding. Those may be dropped by listing them prefixed by "-"
+	// (as in "-Content-Type").
+	ResponseHeaderAllowlist []string
+
+	// Compress textual responses with gzip for clients which accept it, at GzipLevel (1 for the fastest to 9 for
+	// the smallest; 0 means a balanced default).
+	Gzip      bool
+	GzipLevel int
+
+	// Search/replace rewrites applied, in order, to uncompressed text responses from the backend.
+	BodyReplace []*ReplaceConf
+
+	// Rewrites applied, in order, to uncompressed JSON responses from the backend. Such a response is rewritten
+	// as it's relayed. Only an array which the rewrites need whole (one from which an element is deleted before
+	// another rewrite picks an element by index) is buffered; a response for which more than
+	// JSONRewriteMaxBytes (default 10MB) would have to be buffered, or which turns out partway through not to be
+	// valid JSON, is cut off. (A response which isn't JSON at all is relayed unchanged.)
+	JSONRewrite         []*JSONRewriteConf
+	JSONRewriteMaxBytes int
+
+	// If the backend can't be reached, the request is retried up to MaxRetries times. Other errors are only
+	// retried for idempotent requests (GET, HEAD, OPTIONS, PUT, and DELETE, or any with an Idempotency-Key
+	// header), since the backend may have acted on the request. Before each retry there is a (jittered) pause
+	// which starts at RetryBackoff and doubles each time up to RetryBackoffMax (both in milliseconds; by
+	// default there's no pause). Retries stop once the client goes away.
+	MaxRetries      int
+	RetryBackoff    int
+	RetryBackoffMax int
+
+	// If positive, the total time (in milliseconds) allowed for getting a response from the backend, including
+	// all retries and the pauses between them. A request which runs out of time gets a 504.
+	Deadline int
+
+	// Cache responses to GET requests for as long as their Cache-Control (max-age or s-maxage) permits. Once
+	// stale, a response may still be served for the time given by stale-while-revalidate while it is refreshed
+	// in the background. At most CacheEntries (default 1000) responses are kept. Responses to requests which
+	// could be cached have a CacheStatusHeader (default X-Cache; "-" for none) saying whether they were served
+	// from the cache: HIT or MISS.
+	Cache             bool
+	CacheEntries      int
+	CacheStatusHeader string
+	cache             *responseCache
+
+	// If MaxConcurrent is positive, at most that many requests matching the rule are proxied at once. Others
+	// wait up to QueueTimeout (in milliseconds) for a slot before getting a 503. See also Proxy.Limits.
+	MaxConcurrent int
+	QueueTimeout  int
+	sem           chan struct{}
+
+	// TLS settings for connecting to the backend. Setting any of these implies TLS.
+	TLS                bool   // Connect using TLS (with the system's root CAs, unless CAFile is given)
+	CAFile             string // A file of CA certificates used to verify the backend
+	CertFile           string // A client certificate to present to the backend
+	KeyFile            string // The key corresponding to CertFile
+	InsecureSkipVerify bool   // Don't verify the backend's certificate
+	TLSServerName      string // The name used for SNI and to verify the backend's certificate (if not the addr)
+	tlsConfig          *tls.Config
+}
+
+func (c *ToConf) validate() error {
+	if c.CanaryPercent < 0 || c.CanaryPercent > 100 {
+		return fmt.Errorf("canarypercent must be between 0 and 100")
+	}
+	if c.CanaryPercent > 0 && c.CanaryAddr == "" {
+		return fmt.Errorf("canarypercent requires a canaryaddr")
+	}
+	if c.CanarySlowStart < 0 {
+		return fmt.Errorf("canaryslowstart must not be negative")
+	}
+	if len(c.Addrs) > 0 {
+		if c.Addr != "" {
+			return fmt.Errorf("a 'to' may not have both an addr and addrs")
+		}
+		if err := validateHashBy(c.HashBy); err != nil {
+			return err
+		}
+		c.ring = newHashRing(c.Addrs)
+	} else if c.HashBy != "" {
+		return fmt.Errorf("hashby requires addrs")
+	}
+	if c.now == nil {
+		c.now = time.Now
+	}
+	c.loaded = c.now()
+	if err := validateReplacements(c.BodyReplace); err != nil {
+		return err
+	}
+	if err := validateJSONRewrites(c.JSONRewrite); err != nil {
+		return err
+	}
+	switch {
+	case c.JSONRewriteMaxBytes < 0:
+		return fmt.Errorf("jsonrewritemaxbytes must not be negative")
+	case c.JSONRewriteMaxBytes == 0:
+		c.JSONRewriteMaxBytes = defaultJSONRewriteMaxBytes
+	}
+	for status := range c.OnStatus {
+		if status < 100 || status > 599 {
+			return fmt.Errorf("invalid onstatus status code %d", status)
+		}
+	}
+	if c.AddPrefix != "" && !strings.HasPrefix(c.AddPrefix, "/") {
+		return fmt.Errorf("addprefix must start with /")
+	}
+	if c.MaxXFFHops < 0 {
+		return fmt.Errorf("maxxffhops must not be negative")
+	}
+	switch c.Referer {
+	case "", "drop", "rewrite":
+	default:
+		return fmt.Errorf("unknown referer mode: %q", c.Referer)
+	}
+	if c.MaxRetries < 0 || c.RetryBackoff < 0 || c.RetryBackoffMax < 0 {
+		return fmt.Errorf("maxretries, retrybackoff, and retrybackoffmax must not be negative")
+	}
+	if c.GzipLevel < 0 || c.GzipLevel > gzip.BestCompression {
+		return fmt.Errorf("gziplevel must be between 1 and 9 (or 0 for the default)")
+	}
+	if c.CacheEntries < 0 {
+		return fmt.Errorf("cacheentries must not be negative")
+	}
+	if c.Cache {
+		entries := c.CacheEntries
+		if entries == 0 {
+			entries = 1000
+		}
+		c.cache = newResponseCache(entries)
+		switch c.CacheStatusHeader {
+		case "":
+			c.CacheStatusHeader = "X-Cache"
+		case "-":
+			c.CacheStatusHeader = ""
+		}
+	}
+	if c.Deadline < 0 {
+		return fmt.Errorf("deadline must not be negative")
+	}
+	if c.QueueTimeout < 0 {
+		return fmt.Errorf("queuetimeout must not be negative")
+	}
+	if c.MaxConcurrent > 0 {
+		c.sem = make(chan struct{}, c.MaxConcurrent)
+	}
+	if c.OnAllDown != nil {
+		if err := c.OnAllDown.validate(); err != nil {
+			return err
+		}
+		if c.OnAllDown.Mode == "stale" {
+			if c.cache == nil {
+				return fmt.Errorf(`onalldown mode "stale" requires cache`)
+			}
+			c.OnAllDown.to = c
+			c.cache.keepStale = true
+		}
+	}
+	if c.HealthCheck != nil {
+		if err := c.HealthCheck.validate(); err != nil {
+			return err
+		}
+	}
+	if c.Hook != nil {
+		if err := c.Hook.validate(); err != nil {
+			return err
+		}
+	}
+	return c.validateTLS()
+}
+
+func (c *ToConf) validateTLS() error {
+	if !c.TLS && c.CAFile == "" && c.CertFile == "" && c.KeyFile == "" && !c.InsecureSkipVerify &&
+		c.TLSServerName == "" {
+		return nil
+	}
+	config := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify, ServerName: c.TLSServerName}
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", c.CAFile)
+		}
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	c.tlsConfig = config
+	return nil
+}
+
+// OnAllDownConf describes the response given when a rule's backend is down. The Mode is one of:
+//
+//   - "unavailable": respond with a 503, and a Retry-After header if RetryAfter is set
+//   - "page": respond with the HTML file Page, using Status (default 503)
+//   - "stale": serve the rule's cached response to the request, however long ago it stopped being fresh; if
+//     there is none, respond as for "unavailable". This requires Cache, and cached responses are then kept
+//     past their lifetime (until evicted to make room) for this purpose.
+type OnAllDownConf struct {
+	Mode       string
+	RetryAfter int // In seconds
+	Page       string
+	Status     int
+	page       []byte
+	to         *ToConf // For the "stale" mode's cache
+}
+
+func (c *OnAllDownConf) validate() error {
+	switch c.Mode {
+	case "unavailable", "stale":
+	case "page":
+		if c.Page == "" {
+			return fmt.Errorf(`onalldown mode "page" requires a page`)
+		}
+		var err error
+		if c.page, err = ioutil.ReadFile(c.Page); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown onalldown mode: %q", c.Mode)
+	}
+	if c.Status == 0 {
+		c.Status = http.StatusServiceUnavailable
+	}
+	return nil
+}
+
+func (c *OnAllDownConf) serve(w http.ResponseWriter, r *http.Request) {
+	if c.Mode == "stale" {
+		if key := cacheKey(r); key != "" {
+			if e := c.to.cache.getStale(key); e != nil {
+				e.serve(w, c.to.cache.now(), c.to.CacheStatusHeader)
+				return
+			}
+		}
+	}
+	if c.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(c.RetryAfter))
+	}
+	if c.Mode == "page" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(c.Status)
+		w.Write(c.page)
+		return
+	}
+	http.Error(w, "Service unavailable.", http.StatusServiceUnavailable)
+}
+
+func copyHeader(dst, src http.Header) {
+	for k, vv := range src {
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+}
+
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te", // canonicalized version of "TE"
+	"Trailers",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders removes the hop-by-hop headers from a backend's response headers h: those in hopHeaders and
+// any others named by its Connection header. They describe the backend connection, not the client's (an
+// HTTP/1.0 client told "Connection: keep-alive" would wait for more after its response, say).
+func removeHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// pickAddr chooses the backend address for r: CanaryAddr for CanaryPercent percent of requests, otherwise Addr
+// (or one of Addrs).
+func (c *ToConf) pickAddr(r *http.Request, rampStart time.Time) string {
+	if pct := c.canaryPercent(rampStart); pct > 0 && rand.Float64()*100 < pct {
+		return c.CanaryAddr
+	}
+	if c.ring != nil {
+		return c.hashAddr(r, nil)
+	}
+	return c.Addr
+}
+
+// canaryPercent returns the current percentage of requests to send to the canary, taking into account
+// CanarySlowStart (with the ramp starting at rampStart).
+func (c *ToConf) canaryPercent(rampStart time.Time) float64 {
+	if c.CanarySlowStart == 0 || c.CanaryPercent == 0 {
+		return c.CanaryPercent
+	}
+	window := time.Duration(c.CanarySlowStart) * time.Millisecond
+	if elapsed := c.now().Sub(rampStart); elapsed < window {
+		return c.CanaryPercent * float64(elapsed) / float64(window)
+	}
+	return c.CanaryPercent
+}
+
+// missingQuery returns the parameters of DefaultQuery which are absent from the query of u.
+func (c *ToConf) missingQuery(u *url.URL) url.Values {
+	if len(c.DefaultQuery) == 0 {
+		return nil
+	}
+	query := u.Query()
+	add := make(url.Values)
+	for k, v := range c.DefaultQuery {
+		if _, ok := query[k]; !ok {
+			add.Set(k, v)
+		}
+	}
+	return add
+}
+
+// CreateRequest synthesizes a new http.Request by applying this ToConf's configuration to an inbound request.
+// NOTE: Most of this logic was copied from net/http/httputil.ReverseProxy.
+func (c *ToConf) CreateRequest(r *http.Request) *http.Request {
+	return c.createRequest(r, c.loaded)
+}
+
+// createRequest is CreateRequest with any canary slow start ramp beginning at rampStart.
+func (c *ToConf) createRequest(r *http.Request, rampStart time.Time) *http.Request {
+	out := &http.Request{}
+	*out = *r // Note this shallow copies maps
+	u := *r.URL
+	out.URL = &u
+
+	// Apply configuration
+	if addr := c.pickAddr(r, rampStart); addr != "" {
+		out.URL.Host = addr
+	}
+
+	if requestScheme(r) == "http" && c.tlsConfig == nil {
+		out.URL.Scheme = "http"
+	} else {
+		out.URL.Scheme = "https"
+	}
+
+	if add := c.missingQuery(r.URL); len(add) > 0 {
+		if out.URL.RawQuery != "" {
+			out.URL.RawQuery += "&"
+		}
+		out.URL.RawQuery += add.Encode()
+	}
+	if c.AddPrefix != "" {
+		prefix := strings.TrimSuffix(c.AddPrefix, "/")
+		out.URL.Path = prefix + out.URL.Path
+		if out.URL.RawPath != "" {
+			out.URL.RawPath = prefix + out.URL.RawPath
+		}
+	}
+
+	if c.RawPath {
+		if raw := rawRequestPath(r); raw != "" {
+			raw = strings.TrimSuffix(c.AddPrefix, "/") + raw
+			if strings.HasPrefix(raw, "//") {
+				// An Opaque starting with // would be taken for an absolute URL.
+				out.URL.RawPath = raw
+			} else {
+				out.URL.Opaque = raw
+			}
+		}
+	}
+
+	if c.SynthesizeHead && r.Method == "HEAD" {
+		out.Method = "GET"
+	}
+
+	// Change other settings suitable for reverse proxies
+	out.Proto = "HTTP/1.1"
+	out.ProtoMajor = 1
+	out.ProtoMinor = 1
+	out.Close = false
+
+	// Remove hop-by-hop headers to the backend. Especially important is "Connection" because we want a
+	// persistent connection, regardless of what the client sent to us. This is modifying the same underlying
+	// map from r (shallow copied above) so we only copy it if necessary.
+	copiedHeaders := false
+	cloneHeader := func() {
+		if !copiedHeaders {
+			out.Header = make(http.Header)
+			copyHeader(out.Header, r.Header)
+			copiedHeaders = true
+		}
+	}
+	for _, h := range hopHeaders {
+		if out.Header.Get(h) != "" {
+			cloneHeader()
+			out.Header.Del(h)
+		}
+	}
+	// Hop-by-hop headers are removed above, but a request to switch protocols is passed on to the backend.
+	if reqType := upgradeType(r.Header); reqType != "" {
+		cloneHeader()
+		out.Header.Set("Connection", "Upgrade")
+		out.Header.Set("Upgrade", reqType)
+	}
+
+	if c.UserAgent != nil {
+		cloneHeader()
+		// The transport omits the User-Agent if the header is present but empty.
+		out.Header.Set("User-Agent", *c.UserAgent)
+	}
+
+	if c.TraceParent {
+		cloneHeader()
+		out.Header.Set("Traceparent", outgoingTraceParent(r.Header))
+	}
+
+	if c.ForwardCookies != nil && out.Header.Get("Cookie") != "" {
+		cloneHeader()
+		out.Header.Del("Cookie")
+		if cookie := c.forwardedCookies(r); cookie != "" {
+			out.Header.Set("Cookie", cookie)
+		}
+	}
+
+	if ref := out.Header.Get("Referer"); ref != "" && c.Referer != "" {
+		cloneHeader()
+		if c.Referer == "drop" {
+			out.Header.Del("Referer")
+		} else {
+			out.Header.Set("Referer", rewriteReferer(ref, r.Host, out.URL))
+		}
+	}
+
+	for _, name := range c.FoldHeaders {
+		name = http.CanonicalHeaderKey(name)
+		if vv := out.Header[name]; len(vv) > 1 {
+			cloneHeader()
+			sep := ", "
+			if name == "Cookie" {
+				sep = "; "
+			}
+			out.Header[name] = []string{strings.Join(vv, sep)}
+		}
+	}
+
+	if len(c.SetHeaders) > 0 {
+		cloneHeader()
+		expand := headerTemplateReplacer(r)
+		for k, v := range c.SetHeaders {
+			out.Header.Set(k, expand.Replace(v))
+		}
+	}
+
+	if c.NoXFF {
+		if _, ok := out.Header["X-Forwarded-For"]; ok {
+			cloneHeader()
+			out.Header.Del("X-Forwarded-For")
+		}
+	} else if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		// If we aren't the first proxy retain prior X-Forwarded-For information as a comma+space separated list
+		// and fold multiple headers into one. (SplitHostPort removes the brackets from IPv6 addresses.) If the
+		// client is already the last entry, don't record it twice.
+		forwardedFor := clientIP
+		if prior, ok := out.Header["X-Forwarded-For"]; ok && (c.TrustXFF == nil || *c.TrustXFF) {
+			forwardedFor = strings.Join(prior, ", ")
+			entries := strings.Split(forwardedFor, ",")
+			last := strings.Trim(strings.TrimSpace(entries[len(entries)-1]), "[]")
+			if last != clientIP {
+				forwardedFor += ", " + clientIP
+			}
+		}
+		if c.MaxXFFHops > 0 {
+			forwardedFor = truncateXFF(forwardedFor, c.MaxXFFHops)
+		}
+		cloneHeader()
+		out.Header.Set("X-Forwarded-For", forwardedFor)
+	}
+
+	return out
+}
+
+// rawRequestPath returns the path of r as it appeared in the request line, or "" if it has none.
+func rawRequestPath(r *http.Request) string {
+	uri := r.RequestURI
+	if i := strings.Index(uri, "://"); i >= 0 && !strings.HasPrefix(uri, "/") {
+		// An absolute URI, as sent to proxies
+		uri = uri[i+len("://"):]
+		i = strings.IndexByte(uri, '/')
+		if i < 0 {
+			return ""
+		}
+		uri = uri[i:]
+	}
+	if !strings.HasPrefix(uri, "/") {
+		return ""
+	}
+	if i := strings.IndexByte(uri, '?'); i >= 0 {
+		uri = uri[:i]
+	}
+	return uri
+}
+
+// headerTemplateReplacer expands the SetHeaders placeholders for r.
+func headerTemplateReplacer(r *http.Request) *strings.Replacer {
+	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		clientIP = ""
+	}
+	return strings.NewReplacer(
+		"{host}", r.Host,
+		"{path}", r.URL.Path,
+		"{method}", r.Method,
+		"{clientip}", clientIP,
+	)
+}
+
+// truncateXFF keeps the last n entries of the X-Forwarded-For list xff.
+func truncateXFF(xff string, n int) string {
+	entries := strings.Split(xff, ",")
+	if len(entries) <= n {
+		return xff
+	}
+	entries = entries[len(entries)-n:]
+	for i, entry := range entries {
+		entries[i] = strings.TrimSpace(entry)
+	}
+	return strings.Join(entries, ", ")
+}
+
+// TransportConf describes how erebus makes connections to backends.
+type TransportConf struct {
+	LocalAddr              string        // The local IP address from which backend connections originate
+	MaxResponseHeaderBytes int64         // If nonzero, the limit on the size of backend response headers
+	MaxConnsPerHost        int           // If nonzero, the limit on the number of connections to each backend
+	MaxConnAge             time.Duration // If nonzero, connections older than this are not reused; see maxAgeConn
+	DialTimeout            time.Duration // The limit on connecting to a backend; if zero, 30 seconds
+	ResponseHeaderTimeout  time.Duration // If nonzero, the limit on waiting for a backend's response headers
+
+	now func() time.Time // For testing MaxConnAge; defaults to time.Now
+}
+
+// dialer constructs the net.Dialer used for backend connections. The default timeouts match those of
+// http.DefaultTransport. The dial timeout only bounds making the connection, so that unreachable backends fail
+// fast; slow responses are unaffected.
+func (c *TransportConf) dialer() (*net.Dialer, error) {
+	d := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if c.DialTimeout > 0 {
+		d.Timeout = c.DialTimeout
+	}
+	if c.LocalAddr != "" {
+		ip := net.ParseIP(c.LocalAddr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid local address: %q", c.LocalAddr)
+		}
+		d.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	return d, nil
+}
+
+// NewTransport creates an http.Transport, based on http.DefaultTransport, which applies this configuration.
+func (c *TransportConf) NewTransport() (*http.Transport, error) {
+	d, err := c.dialer()
+	if err != nil {
+		return nil, err
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = d.DialContext
+	if c.MaxConnAge > 0 {
+		now := c.now
+		if now == nil {
+			now = time.Now
+		}
+		t.DialContext = maxAgeDial(d.DialContext, c.MaxConnAge, now)
+	}
+	t.MaxResponseHeaderBytes = c.MaxResponseHeaderBytes
+	t.MaxConnsPerHost = c.MaxConnsPerHost
+	t.ResponseHeaderTimeout = c.ResponseHeaderTimeout
+	return t, nil
+}
+
+type Proxy struct {
+	Rules     []*Conf
+	Transport http.RoundTripper
+
+	// If nonzero, requests whose backend takes longer than this to respond are logged with a warning.
+	SlowThreshold time.Duration
+
+	// Whether to believe the X-Forwarded-Proto header sent by clients about the scheme of their requests. This
+	// should only be set when erebus is behind a proxy (such as a TLS terminator) which sets the header.
+	TrustForwardedProto bool
+
+	// If nonzero, a response is aborted if the backend stalls, sending no body data for this long.
+	BodyReadTimeout time.Duration
+
+	// The format of the access log: "" for the default (colored) format or LogFormatCLF.
+	LogFormat string
+
+	// Where CLF access log lines are written, as they are (without any prefix added by the log package's
+	// output). If nil, the log package's output is used.
+	AccessLog io.Writer
+
+	// Log, for each request, the rules which were tried and why each failed to match, for debugging the
+	// configuration.
+	DebugMatch bool
+
+	// If non-empty, the only request methods permitted; requests using other methods get a 405.
+	AllowMethods []string
+
+	// If nonzero, the largest response body relayed from a backend. A response which is known to be larger
+	// (from its Content-Length) gets a 502; otherwise the response is aborted when it exceeds the limit.
+	MaxResponseBytes int64
+
+	// Backends which should not be sent new requests when there is an alternative. The DrainSet may be shared
+	// between Proxies (such as the old and new Proxy across a configuration reload).
+	Drains *DrainSet
+
+	// The health checker whose results decide which backends are down, if any; see HealthCheckConf. Like the
+	// DrainSet, it may be shared between Proxies.
+	Health *HealthChecker
+
+	// When the slow start ramps of canaries and recovered backends began, if tracked; see
+	// ToConf.CanarySlowStart. Like the DrainSet, it may be shared between Proxies.
+	SlowStarts *SlowStartSet
+
+	// The concurrency slots of rules with MaxConcurrent, if they're shared. Like the DrainSet, they may be shared
+	// between Proxies; otherwise each Proxy has its own slots, and a reload resets the rules' limits.
+	Limits *ConcurrencyLimits
+
+	// Clean request paths (see CleanRequestPath) before matching them against the rules, and send the cleaned
+	// paths to the backends. Without this, a path with dot segments may match a rule which it shouldn't.
+	CleanPath bool
+
+	// The size of the buffer used to relay each response body to the client; if zero, 32KB. Larger buffers
+	// mean fewer (larger) reads and writes when proxying large responses.
+	CopyBufferSize int
+
+	// If nonzero, requests whose URL is longer than this get a 414 (URI Too Long).
+	MaxURLLength int
+
+	// The status and body of the response to a request which matches no rule. If zero, they are 502 and
+	// "No matching rule.".
+	NoMatchStatus int
+	NoMatchBody   string
+
+	// If non-nil, the host patterns to which requests may be sent, as a defense against a compromised
+	// configuration or hook being used to reach internal services. Patterns are matched as by path.Match, so
+	// "*.internal" allows any host in that domain; a pattern with a port, such as "10.0.0.1:8080", must match
+	// both the host and the port. Every request is checked against the final backend address (as given by a
+	// hook, for instance, or an SRV lookup); SRV names in the rules must be allowed as well. See also
+	// CheckBackends.
+	BackendAllowlist []string
+
+	// Headers added to every response (including erebus's own error responses) which doesn't already have
+	// them, such as security headers. The keys must be in canonical form.
+	ResponseHeaders http.Header
+
+	// The most background requests (mirrored requests and cache refreshes) in flight at once; any more are
+	// dropped (with a warning) so that a slow mirror or backend can't pile them up. If zero, 100. Each is
+	// abandoned after BackgroundTimeout (if zero, 30s).
+	MaxBackground     int
+	BackgroundTimeout time.Duration
+
+	srv              *srvResolver
+	backendErrors    backendErrors
+	backendsInFlight backendsInFlight
+	background       int64     // The background requests in flight; see goBackground
+	copyBuffers      sync.Pool // Of *[]byte; see copyResponse
+}
+
+// NewProxyFromReader reads a JSON configuration from r and constructs a Proxy from it, as with
+// NewProxyFromRules.
+func NewProxyFromReader(r io.Reader) (*Proxy, error) {
+	contents, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return NewProxyFromRules(contents)
+}
+
+// NewProxyFromRules takes a raw JSON configuration and constructs a Proxy from it. It may return an error if
+// the rules are malformed or invalid.
+func NewProxyFromRules(jsonText []byte) (*Proxy, error) {
+	rules := []*Conf{}
+	if err := json.Unmarshal(jsonText, &rules); err != nil {
+		return nil, err
+	}
+	if len(rules) < 1 {
+		return nil, fmt.Errorf("configuration must include at least one rule.")
+	}
+	// Identical patterns (common in large configurations) share a compiled regexp.
+	regexes := make(regexCache)
+	for _, conf := range rules {
+		if err := conf.validate(regexes); err != nil {
+			return nil, fmt.Errorf("error with configuration: %s", err)
+		}
+	}
+	proxy := &Proxy{
+		Rules:     rules,
+		Transport: http.DefaultTransport,
+		srv:       newSRVResolver(),
+	}
+	return proxy, nil
+}
+
+// transportFor returns the RoundTripper used for requests matching rule. Rules with their own TLS settings get a
+// dedicated transport cloned from p.Transport; this is done lazily because p.Transport may be replaced after
+// the Proxy is constructed.
+func (p *Proxy) transportFor(rule *Conf) http.RoundTripper {
+	if rule.To.tlsConfig == nil {
+		return p.Transport
+	}
+	rule.transportOnce.Do(func() {
+		base, ok := p.Transport.(*http.Transport)
+		if !ok {
+			base = http.DefaultTransport.(*http.Transport)
+		}
+		t := base.Clone()
+		t.TLSClientConfig = rule.To.tlsConfig
+		rule.transport = t
+	})
+	return rule.transport
+}
+
+// roundTrip sends out to its backend, first resolving the backend's SRV name if it has one.
+func (p *Proxy) roundTrip(rule *Conf, out *http.Request) (*http.Response, error) {
+	if name, ok := srvName(out.URL.Host); ok {
+		addr, err := p.srv.resolve(out.Context(), name)
+		if err != nil {
+			return nil, err
+		}
+		out.URL.Host = addr
+	}
+	if err := p.checkBackend(out.URL.Host); err != nil {
+		return nil, err
+	}
+	out = out.WithContext(httptrace.WithClientTrace(out.Context(), trackConnAge()))
+	return p.transportFor(rule).RoundTrip(out)
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p.TrustForwardedProto {
+		r = withForwardedScheme(r)
+	}
+	if p.CleanPath {
+		r = CleanRequestPath(r)
+	}
+	if len(p.ResponseHeaders) > 0 {
+		w = &defaultHeaderWriter{ResponseWriter: w, defaults: p.ResponseHeaders}
+	}
+	var rec *statusRecorder
+	if p.LogFormat == LogFormatCLF {
+		rec = &statusRecorder{ResponseWriter: w}
+		w = rec
+	}
+	start := time.Now()
+	fromLog := Csprintf("#blue{%s} %s", r.Method, inboundURL(r))
+	delay := time.Duration(0)
+	toLog := ""
+	defer func() {
+		if rec != nil {
+			if logEnabled(LogLevelInfo) {
+				accessLog := p.AccessLog
+				if accessLog == nil {
+					accessLog = log.Writer()
+				}
+				fmt.Fprintln(accessLog, clfLine(r, start, rec))
+			}
+		} else {
+			LogInfof("%s #blue{→}  %s", fromLog, toLog)
+		}
+		if p.SlowThreshold > 0 && delay > p.SlowThreshold {
+			LogWarnf("#yellow{Slow request (%.3fs):} %s", delay.Seconds(), fromLog)
+		}
+	}()
+	// Recover from panics so that they are logged along with the request and the client gets a 500 (rather than
+	// having its connection closed). This runs before the logging above.
+	defer func() {
+		e := recover()
+		if e == nil {
+			return
+		}
+		if e == http.ErrAbortHandler {
+			panic(e)
+		}
+		toLog = Csprintf("#red{panic: %v}", e)
+		LogErrorf("#red{Panic serving request} %s: %v\n%s", fromLog, e, debug.Stack())
+		http.Error(w, "Internal server error.", http.StatusInternalServerError)
+	}()
+
+	if !p.methodAllowed(r.Method) {
+		toLog = Csprintf("#red{method not allowed}")
+		w.Header().Set("Allow", strings.Join(p.AllowMethods, ", "))
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	if p.MaxURLLength > 0 && len(r.URL.String()) > p.MaxURLLength {
+		toLog = Csprintf("#red{URL too long}")
+		http.Error(w, "URI too long.", http.StatusRequestURITooLong)
+		return
+	}
+	for i, rule := range p.Rules {
+		if !rule.IsEnabled() {
+			continue
+		}
+		if rule.From.TokenRequired(r) {
+			toLog = Csprintf("#red{missing or invalid bearer token}")
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+			return
+		}
+		matched, reason := rule.From.MatchReason(r)
+		if p.DebugMatch {
+			if matched {
+				LogInfof("#yellow{[debugmatch]} %s: rule %d matched", fromLog, i+1)
+			} else {
+				LogInfof("#yellow{[debugmatch]} %s: rule %d did not match (%s)", fromLog, i+1, reason)
+			}
+		}
+		if matched {
+			if rule.From.RedirectsToHTTPS(r) {
+				RedirectToHTTPS(w, r, "")
+				toLog = Csprintf("#blue{redirect to HTTPS}")
+				return
+			}
+			if len(rule.OptionsAllow) > 0 && r.Method == "OPTIONS" {
+				rule.serveOptions(w)
+				toLog = Csprintf("#blue{OPTIONS response} %d", http.StatusNoContent)
+				return
+			}
+			if rule.Respond != nil {
+				rule.Respond.serve(w)
+				toLog = Csprintf("#blue{static response} %d", rule.Respond.Status)
+				return
+			}
+			var key string
+			if rule.To.cache != nil {
+				key = cacheKey(r)
+			}
+			if key != "" {
+				if e, refresh := rule.To.cache.get(key); e != nil {
+					toLog = Csprintf("#blue{cache hit} %d", e.status)
+					if refresh {
+						toLog = Csprintf("#blue{stale cache hit} %d", e.status)
+						out := rule.To.createRequest(r, p.rampStart(rule.To))
+						out = cloneRequest(out, out.URL.Host, nil)
+						refresh := func(ctx context.Context) { p.refresh(rule, out.WithContext(ctx), key) }
+						if !p.goBackground(refresh) {
+							LogWarnf("#red{cache refresh dropped} (%s): too many background requests", out.URL)
+							rule.To.cache.refreshFailed(key)
+						}
+					}
+					e.serve(w, rule.To.cache.now(), rule.To.CacheStatusHeader)
+					return
+				}
+			}
+			p.shareLimit(rule)
+			if !rule.To.acquire(r.Context()) {
+				toLog = Csprintf("#red{backend at capacity (%d concurrent requests)}", rule.To.MaxConcurrent)
+				http.Error(w, "Service unavailable.", http.StatusServiceUnavailable)
+				return
+			}
+			defer rule.To.release()
+			var reqBody []byte
+			// The body is needed again for mirrors, retries, and fallbacks.
+			if len(rule.To.Mirror) > 0 || rule.To.MaxRetries > 0 || len(rule.To.OnStatus) > 0 {
+				var err error
+				if reqBody, err = bufferBody(r); err != nil {
+					toLog = Csprintf("#red{error reading request body: %s}", err)
+					http.Error(w, "error reading request body", http.StatusBadRequest)
+					return
+				}
+			}
+			reqCounter := countBody(r)
+			out := rule.To.createRequest(r, p.rampStart(rule.To))
+			out.URL.Host = rule.To.availableAddr(r, out.URL.Host, p.unavailableFor(rule.To, r))
+			if p.Health.Down(out.URL.Host) && rule.To.OnAllDown != nil {
+				// Every backend for the rule is down, so there's no point in trying them.
+				toLog = Csprintf("%s #red{backend down}", backendLog(rule, out))
+				rule.To.OnAllDown.serve(w, r)
+				return
+			}
+			if rule.To.Hook != nil {
+				if err := rule.To.Hook.apply(r.Context(), r, out); err != nil {
+					toLog = Csprintf("%s #red{%s}", backendLog(rule, out), err)
+					LogErrorf("%s for %s", err, fromLog)
+					// The error may include the hook's stderr, which isn't for the client's eyes.
+					http.Error(w, "Bad gateway.", http.StatusBadGateway)
+					return
+				}
+			}
+			for _, addr := range rule.To.Mirror {
+				req := cloneRequest(out, addr, reqBody)
+				if !p.goBackground(func(ctx context.Context) { p.mirror(rule, req.WithContext(ctx)) }) {
+					LogWarnf("#red{mirror dropped} (%s): too many background requests", addr)
+				}
+			}
+
+			// Cancelling the backend request aborts reading a stalled response body.
+			ctx, cancel := context.WithCancel(r.Context())
+			defer cancel()
+			ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{Got1xxResponse: relayInformational(w)})
+			out = out.WithContext(ctx)
+			budget := rule.To.startBudget(cancel)
+			defer budget.stop()
+
+			atomic.AddInt64(&rule.inFlight, 1)
+			defer atomic.AddInt64(&rule.inFlight, -1)
+			p.backendsInFlight.add(out.URL.Host, 1)
+			defer func() { p.backendsInFlight.add(out.URL.Host, -1) }()
+
+			before := time.Now()
+			resp, err := p.roundTrip(rule, out)
+			for attempt := 0; err != nil && attempt < rule.To.MaxRetries && retryable(out, err); attempt++ {
+				if !sleepContext(ctx, rule.To.retryBackoff(attempt)) {
+					break
+				}
+				LogDebugf("#yellow{Retrying} %s (retry %d) after backend error: %s", fromLog, attempt+1, err)
+				out = cloneRequest(out, out.URL.Host, reqBody).WithContext(ctx)
+				resp, err = p.roundTrip(rule, out)
+			}
+			if addr, ok := rule.To.OnStatus[statusOf(resp)]; ok {
+				LogDebugf("#yellow{Falling back} %s to %s after status %d", fromLog, addr, resp.StatusCode)
+				resp.Body.Close()
+				p.backendsInFlight.add(out.URL.Host, -1)
+				out = cloneRequest(out, addr, reqBody).WithContext(ctx)
+				p.backendsInFlight.add(out.URL.Host, 1)
+				resp, err = p.roundTrip(rule, out)
+			}
+			delay = time.Since(before)
+			if !budget.stop() && err == nil {
+				// The budget ran out just as the response arrived; its body can't be read.
+				resp.Body.Close()
+				err = context.Canceled
+			}
+
+			if err != nil && budget.exhausted() {
+				toLog = Csprintf("%s #red{deadline of %dms exceeded}", backendLog(rule, out), rule.To.Deadline)
+				LogErrorf("Deadline of %dms exceeded for %s", rule.To.Deadline, fromLog)
+				http.Error(w, "Gateway timeout.", http.StatusGatewayTimeout)
+				return
+			}
+			if err != nil {
+				consecutive, total := p.backendErrors.failure(out.URL.Host)
+				msg := fmt.Sprintf("backend error: %s", err)
+				toLog = Csprintf("%s #red{%s} (%d consecutive, %d total)", backendLog(rule, out), msg, consecutive,
+					total)
+				LogErrorf("%s (%s: %d consecutive, %d total)", msg, out.URL.Host, consecutive, total)
+				if rule.To.OnAllDown != nil {
+					rule.To.OnAllDown.serve(w, r)
+					return
+				}
+				http.Error(w, msg, http.StatusBadGateway)
+				return
+			}
+			defer resp.Body.Close()
+			if p.backendErrors.success(out.URL.Host) {
+				p.SlowStarts.restart(out.URL.Host, rule.To.now())
+			}
+
+			if resp.StatusCode == http.StatusSwitchingProtocols {
+				if err := serveUpgrade(w, upgradeType(out.Header), resp); err != nil {
+					toLog = Csprintf("%s #red{protocol switch error: %s}", backendLog(rule, out), err)
+					http.Error(w, fmt.Sprintf("protocol switch error: %s", err), http.StatusBadGateway)
+					return
+				}
+				toLog = Csprintf("%s #green{%d} #blue{%.3fs}", backendLog(rule, out), resp.StatusCode,
+					delay.Seconds())
+				return
+			}
+
+			if p.MaxResponseBytes > 0 && resp.ContentLength > p.MaxResponseBytes {
+				msg := fmt.Sprintf("backend response too large (%d bytes)", resp.ContentLength)
+				toLog = Csprintf("%s #red{%s}", backendLog(rule, out), msg)
+				http.Error(w, msg, http.StatusBadGateway)
+				return
+			}
+			var body io.Reader = resp.Body
+			if p.BodyReadTimeout > 0 {
+				stall := newStallReader(body, p.BodyReadTimeout, cancel)
+				defer stall.stop()
+				body = stall
+			}
+			bodyReady := true
+			if r.Method != "HEAD" {
+				// Nothing has been sent to the client yet, so a body that fails straight away can still get a
+				// proper error response rather than a truncated one.
+				body, bodyReady, err = readBodyStart(body)
+				if err != nil {
+					msg := fmt.Sprintf("error reading backend response body: %s", err)
+					toLog = Csprintf("%s #red{%s}", backendLog(rule, out), msg)
+					LogErrorf("%s from %s for %s", msg, out.URL.Host, fromLog)
+					http.Error(w, msg, http.StatusBadGateway)
+					return
+				}
+			}
+			rule.To.copyResponseHeader(w.Header(), resp.Header)
+			removeHopHeaders(w.Header())
+			if key != "" && rule.To.CacheStatusHeader != "" {
+				w.Header().Set(rule.To.CacheStatusHeader, "MISS")
+			}
+			if rule.To.shouldRewriteJSON(r, resp) {
+				w.Header().Del("Content-Length")
+				body = newJSONRewriteReader(body, rule.To.JSONRewrite, rule.To.JSONRewriteMaxBytes)
+			}
+			if rule.To.shouldReplaceBody(r, resp) {
+				// The rewritten length isn't known in advance, so the response is chunked.
+				w.Header().Del("Content-Length")
+				body = newReplaceReader(body, rule.To.BodyReplace)
+			}
+			if p.MaxResponseBytes > 0 {
+				body = &maxBytesReader{r: body, n: p.MaxResponseBytes}
+			}
+			gzipped := rule.To.shouldGzip(r, resp)
+			if gzipped {
+				w.Header().Del("Content-Length")
+				w.Header().Set("Content-Encoding", "gzip")
+				w.Header().Add("Vary", "Accept-Encoding")
+			}
+			var cached *cappedBuffer
+			// Compressed responses aren't cached, since not every client accepts them.
+			if _, _, ok := cacheLifetime(resp.StatusCode, w.Header()); ok && key != "" && !gzipped {
+				cached = &cappedBuffer{}
+				body = io.TeeReader(body, cached)
+			}
+			w.WriteHeader(resp.StatusCode)
+			if f, ok := w.(http.Flusher); ok && !bodyReady {
+				// The body is slow to start (as with server-sent events), so send the headers right away.
+				f.Flush()
+			}
+			status := Csprintf("#red{%d}", resp.StatusCode)
+			if resp.StatusCode == http.StatusOK {
+				status = Csprintf("#green{%d}", resp.StatusCode)
+			}
+			// TODO: There might be scenarios in which we should implement periodic flushing here
+			// Responses to HEAD requests have no body (and any sent by the backend to a synthesized HEAD is
+			// discarded).
+			var n int64
+			var copyErr error
+			client := &clientWriter{w: w}
+			if r.Method != "HEAD" {
+				if gzipped {
+					n, copyErr = gzipCopy(client, body, rule.To.gzipLevel())
+				} else {
+					n, copyErr = p.copyResponse(client, body)
+				}
+			}
+			toLog = Csprintf("%s %s #blue{%.3fs} (%d bytes in, %d bytes out)", backendLog(rule, out), status,
+				delay.Seconds(), reqCounter.count(), n)
+			if client.err != nil {
+				// The client went away; this is not a problem with the backend.
+				toLog += Csprintf(" #yellow{client disconnected: %s}", client.err)
+				return
+			}
+			if copyErr == errResponseTooLarge {
+				// As with a stall, the client can only be told by aborting the response.
+				toLog += Csprintf(" #red{response body exceeded %d bytes}", p.MaxResponseBytes)
+				panic(http.ErrAbortHandler)
+			}
+			if copyErr != nil && r.Context().Err() == nil && ctx.Err() != nil {
+				// The backend stalled. The status has already been sent, so the only way to tell the client
+				// that the response is incomplete is to abort it.
+				toLog += Csprintf(" #red{response body timed out}")
+				panic(http.ErrAbortHandler)
+			}
+			if copyErr != nil && r.Context().Err() == nil {
+				// The backend sent a broken body (for instance, malformed chunked encoding) partway through.
+				// Finishing the response normally would pass off a truncated body as complete.
+				toLog += Csprintf(" #red{backend response body error: %s}", copyErr)
+				LogErrorf("Backend response body error from %s for %s: %s", out.URL.Host, fromLog, copyErr)
+				panic(http.ErrAbortHandler)
+			}
+			if cached != nil && copyErr == nil && !cached.overflow {
+				rule.To.cache.store(key, resp.StatusCode, w.Header(), cached.buf.Bytes())
+			}
+			return
+		}
+	}
+	toLog = Csprintf("#red{No matching rule.}")
+	status, body := p.NoMatchStatus, p.NoMatchBody
+	if status == 0 {
+		status = http.StatusBadGateway
+	}
+	if body == "" {
+		body = "No matching rule."
+	}
+	http.Error(w, body, status)
+}
+
+// essentialResponseHeaders are passed on to the client by a ResponseHeaderAllowlist unless it excludes them.
+var essentialResponseHeaders = []string{"Content-Type", "Content-Length", "Content-Encoding"}
+
+// copyResponseHeader copies the headers of the backend's response, src, which are permitted by
+// ResponseHeaderAllowlist to dst.
+func (c *ToConf) copyResponseHeader(dst, src http.Header) {
+	if len(c.ResponseHeaderAllowlist) == 0 {
+		copyHeader(dst, src)
+		return
+	}
+	allowed := make(map[string]bool)
+	for _, h := range essentialResponseHeaders {
+		allowed[h] = true
+	}
+	for _, h := range c.ResponseHeaderAllowlist {
+		if strings.HasPrefix(h, "-") {
+			allowed[http.CanonicalHeaderKey(h[1:])] = false
+		} else {
+			allowed[http.CanonicalHeaderKey(h)] = true
+		}
+	}
+	for k, vv := range src {
+		if allowed[k] {
+			for _, v := range vv {
+				dst.Add(k, v)
+			}
+		}
+	}
+	for k, ok := range allowed {
+		if !ok {
+			dst[k] = nil // Stop net/http from adding its own (such as a sniffed Content-Type).
+		}
+	}
+}
+
+// forwardedCookies returns the Cookie header value holding those cookies of r named in ForwardCookies.
+func (c *ToConf) forwardedCookies(r *http.Request) string {
+	var kept []string
+	for _, cookie := range r.Cookies() {
+		for _, name := range c.ForwardCookies {
+			if cookie.Name == name {
+				kept = append(kept, cookie.String())
+				break
+			}
+		}
+	}
+	return strings.Join(kept, "; ")
+}
+
+// rewriteReferer returns ref with its scheme and host changed to those of backend if it refers to the public
+// host; other referers are returned unchanged.
+func rewriteReferer(ref, host string, backend *url.URL) string {
+	u, err := url.Parse(ref)
+	if err != nil || !strings.EqualFold(u.Host, host) {
+		return ref
+	}
+	u.Scheme = backend.Scheme
+	u.Host = backend.Host
+	return u.String()
+}
+
+// methodAllowed reports whether AllowMethods permits method.
+func (p *Proxy) methodAllowed(method string) bool {
+	if len(p.AllowMethods) == 0 {
+		return true
+	}
+	for _, m := range p.AllowMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// statusOf returns the status code of resp, or 0 if resp is nil.
+func statusOf(resp *http.Response) int {
+	if resp == nil {
+		return 0
+	}
+	return resp.StatusCode
+}
+
+// inboundURL reconstructs the URL requested by the client, including the scheme and host.
+func inboundURL(r *http.Request) string {
+	return requestScheme(r) + "://" + r.Host + r.URL.RequestURI()
+}
+
+// backendLog describes the backend to which out was sent for logging. If the backend address isn't the
+// configured Addr (it was resolved from an SRV name, or is the canary), both are shown.
+func backendLog(rule *Conf, out *http.Request) string {
+	if out.URL.Host == rule.To.Addr || rule.To.Addr == "" {
+		return out.URL.Host
+	}
+	return fmt.Sprintf("%s (%s)", rule.To.Addr, out.URL.Host)
+}
+
+// A clientWriter records the error (if any) from writing the response to the client, so that it can be
+// distinguished from an error reading the response from the backend.
+type clientWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (cw *clientWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	if err != nil {
+		cw.err = err
+	}
+	return n, err
+}
+
+// A countingReader counts the bytes read from an io.ReadCloser. The transport may still be reading a request
+// body after the response arrives, so the count is accessed atomically.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	atomic.AddInt64(&r.n, int64(n))
+	return n, err
+}
+
+func (r *countingReader) count() int64 { return atomic.LoadInt64(&r.n) }
+
+// countBody replaces the body of r, if it has one, with a countingReader. The returned countingReader may be
+// used to find the size of the body that was read even if r has none.
+func countBody(r *http.Request) *countingReader {
+	if r.Body == nil || r.Body == http.NoBody {
+		// Leave r.Body alone: the transport treats a request with http.NoBody specially.
+		return &countingReader{ReadCloser: http.NoBody}
+	}
+	c := &countingReader{ReadCloser: r.Body}
+	r.Body = c
+	return c
+}
+
+// bufferBody reads the body of r into memory and replaces r.Body so that it may be read again.
+func bufferBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	r.Body = newBody(body)
+	return body, nil
+}
+
+func newBody(body []byte) io.ReadCloser {
+	if len(body) == 0 {
+		return http.NoBody
+	}
+	return ioutil.NopCloser(bytes.NewReader(body))
+}
+
+// cloneRequest makes a deep copy of the outbound request out, directed at addr and with the given (buffered)
+// body. The clone is not tied to the context of the inbound request.
+func cloneRequest(out *http.Request, addr string, body []byte) *http.Request {
+	clone := out.Clone(context.Background())
+	clone.URL.Host = addr
+	clone.Body = newBody(body)
+	return clone
+}
+
+// mirror sends a shadow request to a mirror backend, discarding the response.
+func (p *Proxy) mirror(rule *Conf, req *http.Request) {
+	if err := p.checkBackend(req.URL.Host); err != nil {
+		LogWarnf("#red{mirror error} (%s): %s", req.URL.Host, err)
+		return
+	}
+	resp, err := p.transportFor(rule).RoundTrip(req)
+	if err != nil {
+		LogWarnf("#red{mirror error} (%s): %s", req.URL.Host, err)
+		return
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+}
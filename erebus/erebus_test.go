@@ -0,0 +1,2007 @@
+package erebus
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+var (
+	mut sync.Mutex // protects id
+	id  = 0
+)
+
+func nextId() string {
+	mut.Lock()
+	defer mut.Unlock()
+	id++
+	return strconv.Itoa(id)
+}
+
+type TestBackend struct {
+	*httptest.Server
+	LastReceivedRequests string
+}
+
+func (b *TestBackend) handle(w http.ResponseWriter, r *http.Request) {
+	id := r.FormValue("_id")
+	b.LastReceivedRequests = id
+}
+
+func NewTestBackend() *TestBackend {
+	backend := &TestBackend{}
+	backend.Server = httptest.NewServer(http.HandlerFunc(backend.handle))
+	return backend
+}
+
+// A RecordingBackend is a backend which passes each request it receives (with a buffered body) to Received.
+type RecordingBackend struct {
+	*httptest.Server
+	Received chan *http.Request
+}
+
+func NewRecordingBackend() *RecordingBackend {
+	backend := &RecordingBackend{Received: make(chan *http.Request, 100)}
+	backend.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		clone := r.Clone(context.Background())
+		clone.Body = ioutil.NopCloser(bytes.NewReader(body))
+		backend.Received <- clone
+	}))
+	return backend
+}
+
+// Next returns the next request received by the backend.
+func (b *RecordingBackend) Next(t *testing.T) *http.Request {
+	select {
+	case r := <-b.Received:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("backend did not receive a request")
+		return nil
+	}
+}
+
+// startProxy constructs a Proxy from rules, replacing {{backendN}} with the address of the Nth server, and
+// starts serving it. Everything is shut down at the end of the test.
+func startProxy(t *testing.T, rules string, backends ...*httptest.Server) (*Proxy, *httptest.Server) {
+	for i, backend := range backends {
+		url := strings.TrimPrefix(strings.TrimPrefix(backend.URL, "http://"), "https://")
+		rules = strings.Replace(rules, fmt.Sprintf("{{backend%d}}", i+1), url, -1)
+		t.Cleanup(backend.Close)
+	}
+	proxy, err := NewProxyFromRules([]byte(rules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(proxy)
+	t.Cleanup(server.Close)
+	return proxy, server
+}
+
+// A syncBuffer is a bytes.Buffer which is safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLog redirects the standard logger to a buffer for the remainder of the test.
+func captureLog(t *testing.T) *syncBuffer {
+	buf := &syncBuffer{}
+	log.SetOutput(buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return buf
+}
+
+type TestRequest struct {
+	// This describes what the request is testing
+	Description string
+
+	// These may be set in TestCases
+	Method      string
+	Path        string
+	QueryParams map[string]string
+	Host        string
+	Headers     map[string]string
+
+	// If Status is 0, then it's expected to be a 200 and the appropriate Backend should have received the
+	// request. Otherwise, the response should have error code Status. Backends are indexed from 1.
+	Status  int
+	Backend int
+}
+
+type TestCase struct {
+	Rules    string
+	Requests []*TestRequest
+}
+
+var testCases = []TestCase{
+	{`[{"from": {"host": "foo.com"},
+	    "to":   {"addr": "{{backend1}}"}},
+	   {"from": {"host": "bar.com"},
+	    "to":   {"addr": "{{backend2}}"}}]`,
+		[]*TestRequest{
+			{
+				Description: "a simple request should be sent to the correct backend for its HOST (1 of 2)",
+				Host:        "foo.com",
+				Backend:     1,
+			},
+			{
+				Description: "a simple request should be sent to the correct backend for its HOST (2 of 2)",
+				Host:        "bar.com",
+				Backend:     2,
+			},
+			{
+				Description: "a simple request should get an HTTP 502 if there is no matching backend",
+				Host:        "baz.com",
+				Status:      http.StatusBadGateway,
+			},
+		},
+	},
+
+	{`[{"from": {"path": "/foo/bar"},
+	    "to":   {"addr": "{{backend1}}"}},
+	   {"from": {"pathprefix": "/foo/"},
+	    "to":   {"addr": "{{backend2}}"}},
+	   {"from": {"pathregex": "foo"},
+	    "to":   {"addr": "{{backend3}}"}}]`,
+		[]*TestRequest{
+			{
+				Description: "a path rule must match exactly",
+				Path:        "/foo/bar",
+				Backend:     1,
+			},
+			{
+				Description: "a pathprefix will match if the request path is a prefix of the rule",
+				Path:        "/foo/baz",
+				Backend:     2,
+			},
+			{
+				Description: "a pathregex is interpreted as a regular expression to match the path",
+				Path:        "/a/b/foo/c",
+				Backend:     3,
+			},
+		},
+	},
+
+	{`[{"from": {"hostsuffix": ".example.com"},
+	    "to":   {"addr": "{{backend1}}"}},
+	   {"from": {"hostsuffix": "example.org"},
+	    "to":   {"addr": "{{backend2}}"}}]`,
+		[]*TestRequest{
+			{
+				Description: "a hostsuffix rule matches a subdomain",
+				Host:        "foo.example.com",
+				Backend:     1,
+			},
+			{
+				Description: "a hostsuffix rule ignores the port",
+				Host:        "a.b.example.com:8080",
+				Backend:     1,
+			},
+			{
+				Description: "a hostsuffix with a leading dot does not match the apex",
+				Host:        "example.com",
+				Status:      http.StatusBadGateway,
+			},
+			{
+				Description: "a hostsuffix without a leading dot matches the apex",
+				Host:        "example.org",
+				Backend:     2,
+			},
+			{
+				Description: "a hostsuffix without a leading dot matches a subdomain",
+				Host:        "www.example.org:80",
+				Backend:     2,
+			},
+			{
+				Description: "a hostsuffix does not match a host which merely ends with the same characters",
+				Host:        "badexample.org",
+				Status:      http.StatusBadGateway,
+			},
+		},
+	},
+
+	{`[{"from": {"contenttype": "application/json"},
+	    "to":   {"addr": "{{backend1}}"}},
+	   {"from": {"contenttype": "application/x-www-form-urlencoded"},
+	    "to":   {"addr": "{{backend2}}"}}]`,
+		[]*TestRequest{
+			{
+				Description: "a contenttype rule matches the request's media type",
+				Method:      "POST",
+				Headers:     map[string]string{"Content-Type": "application/json"},
+				Backend:     1,
+			},
+			{
+				Description: "a contenttype rule ignores media type parameters",
+				Method:      "POST",
+				Headers:     map[string]string{"Content-Type": "application/json; charset=utf-8"},
+				Backend:     1,
+			},
+			{
+				Description: "a contenttype rule distinguishes form submissions",
+				Method:      "POST",
+				Headers:     map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
+				Backend:     2,
+			},
+			{
+				Description: "a contenttype rule does not match a request without a Content-Type",
+				Status:      http.StatusBadGateway,
+			},
+		},
+	},
+
+	{`[{"from": {"pathregex": "/foo/[0-9]+", "pathregexfullmatch": true},
+	    "to":   {"addr": "{{backend1}}"}},
+	   {"from": {"pathregex": "/foo/[0-9]+"},
+	    "to":   {"addr": "{{backend2}}"}}]`,
+		[]*TestRequest{
+			{
+				Description: "an anchored pathregex matches the whole path",
+				Path:        "/foo/123",
+				Backend:     1,
+			},
+			{
+				Description: "an anchored pathregex does not match a path with a trailing suffix",
+				Path:        "/foo/123/bar",
+				Backend:     2,
+			},
+			{
+				Description: "an anchored pathregex does not match a path with a leading prefix",
+				Path:        "/bar/foo/123",
+				Backend:     2,
+			},
+		},
+	},
+
+	{`[{"from": {"any": [{"host": "a.com"}, {"pathprefix": "/b/"}]},
+	    "to":   {"addr": "{{backend1}}"}},
+	   {"from": {"host": "c.com", "any": [{"path": "/x"}, {"pathregex": "^/y"}]},
+	    "to":   {"addr": "{{backend2}}"}}]`,
+		[]*TestRequest{
+			{
+				Description: "an any rule matches if its first alternative matches",
+				Host:        "a.com",
+				Path:        "/z",
+				Backend:     1,
+			},
+			{
+				Description: "an any rule matches if its second alternative matches",
+				Host:        "other.com",
+				Path:        "/b/z",
+				Backend:     1,
+			},
+			{
+				Description: "an any rule combines with the other criteria of the rule (1 of 2)",
+				Host:        "c.com",
+				Path:        "/y/z",
+				Backend:     2,
+			},
+			{
+				Description: "an any rule combines with the other criteria of the rule (2 of 2)",
+				Host:        "d.com",
+				Path:        "/x",
+				Status:      http.StatusBadGateway,
+			},
+			{
+				Description: "an any rule does not match if none of its alternatives match",
+				Host:        "c.com",
+				Path:        "/z",
+				Status:      http.StatusBadGateway,
+			},
+		},
+	},
+
+	{`[{"from": {"pathprefix": "/app/", "headersabsent": ["authorization", "X-Api-Key"]},
+	    "to":   {"addr": "{{backend1}}"}},
+	   {"from": {"pathprefix": "/app/"},
+	    "to":   {"addr": "{{backend2}}"}}]`,
+		[]*TestRequest{
+			{
+				Description: "a headersabsent rule matches a request without the headers",
+				Path:        "/app/home",
+				Backend:     1,
+			},
+			{
+				Description: "a headersabsent rule does not match a request with one of the headers (1 of 2)",
+				Path:        "/app/home",
+				Headers:     map[string]string{"Authorization": "Bearer xyz"},
+				Backend:     2,
+			},
+			{
+				Description: "a headersabsent rule does not match a request with one of the headers (2 of 2)",
+				Path:        "/app/home",
+				Headers:     map[string]string{"X-API-Key": ""},
+				Backend:     2,
+			},
+		},
+	},
+
+	{`[{"from": {"cookies": {"bucket": "b"}},
+	    "to":   {"addr": "{{backend1}}"}},
+	   {"from": {},
+	    "to":   {"addr": "{{backend2}}"}}]`,
+		[]*TestRequest{
+			{
+				Description: "a cookies rule matches a request with the cookie value",
+				Path:        "/",
+				Headers:     map[string]string{"Cookie": "session=abc; bucket=b"},
+				Backend:     1,
+			},
+			{
+				Description: "a cookies rule does not match a request with a different cookie value",
+				Path:        "/",
+				Headers:     map[string]string{"Cookie": "bucket=a"},
+				Backend:     2,
+			},
+			{
+				Description: "a cookies rule does not match a request without the cookie",
+				Path:        "/",
+				Headers:     map[string]string{"Cookie": "session=abc"},
+				Backend:     2,
+			},
+		},
+	},
+}
+
+func TestCases(t *testing.T) {
+	for _, testCase := range testCases {
+		maxBackend := 0
+		for _, req := range testCase.Requests {
+			if req.Backend > maxBackend {
+				maxBackend = req.Backend
+			}
+		}
+
+		config := testCase.Rules
+		backends := make([]*TestBackend, maxBackend)
+		for i := range backends {
+			backends[i] = NewTestBackend()
+			defer backends[i].Close()
+			url := strings.TrimPrefix(backends[i].URL, "http://")
+			config = strings.NewReplacer(fmt.Sprintf("{{backend%d}}", i+1), url).Replace(config)
+		}
+		proxy, err := NewProxyFromRules([]byte(config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := httptest.NewServer(proxy)
+		defer server.Close()
+
+		for _, req := range testCase.Requests {
+			method := req.Method
+			if method == "" {
+				method = "GET"
+			}
+			id := nextId()
+			url := fmt.Sprintf("%s%s?_id=%s", server.URL, req.Path, id)
+			for k, v := range req.QueryParams {
+				url += fmt.Sprintf("&%s=%s", k, v)
+			}
+			request, err := http.NewRequest(method, url, nil)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if req.Host != "" {
+				request.Host = req.Host
+			}
+			for k, v := range req.Headers {
+				request.Header.Set(k, v)
+			}
+			resp, err := http.DefaultClient.Do(request)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if req.Status == 0 {
+				if backends[req.Backend-1].LastReceivedRequests != id {
+					log.Fatalf("Error for test request '%s': appropriate backend did not receive request.",
+						req.Description)
+				}
+			} else {
+				if resp.StatusCode != req.Status {
+					log.Fatalf("Error for test request '%s': expected status %d but got %d", req.Description,
+						req.Status, resp.StatusCode)
+				}
+			}
+		}
+
+		req, err := http.NewRequest("GET", fmt.Sprintf("%s?_id=%s", server.URL, nextId()), nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		req.Host = "example2.com"
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer resp.Body.Close()
+	}
+}
+
+func TestTLSMatching(t *testing.T) {
+	withCN := func(cn string) *tls.ConnectionState {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: cn}}
+		return &tls.ConnectionState{ServerName: "foo.com", PeerCertificates: []*x509.Certificate{cert}}
+	}
+	for _, tc := range []struct {
+		description string
+		from        *FromConf
+		state       *tls.ConnectionState
+		want        bool
+	}{
+		{"a client cert CN rule matches a request with that CN", &FromConf{ClientCertCN: "alice"},
+			withCN("alice"), true},
+		{"a client cert CN rule rejects a request with a different CN", &FromConf{ClientCertCN: "alice"},
+			withCN("bob"), false},
+		{"a client cert CN rule rejects a TLS request without a client cert", &FromConf{ClientCertCN: "alice"},
+			&tls.ConnectionState{}, false},
+		{"a client cert CN rule rejects a plaintext request", &FromConf{ClientCertCN: "alice"}, nil, false},
+		{"a server name rule matches the SNI server name", &FromConf{ServerName: "foo.com"}, withCN("alice"),
+			true},
+		{"a server name rule rejects a different SNI server name", &FromConf{ServerName: "bar.com"},
+			withCN("alice"), false},
+		{"a server name rule rejects a plaintext request", &FromConf{ServerName: "foo.com"}, nil, false},
+	} {
+		r, err := http.NewRequest("GET", "https://foo.com/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.TLS = tc.state
+		if got := tc.from.Matches(r); got != tc.want {
+			t.Errorf("%s: got match=%t; want %t", tc.description, got, tc.want)
+		}
+	}
+}
+
+func TestTransportLocalAddr(t *testing.T) {
+	conf := &TransportConf{LocalAddr: "127.0.0.1"}
+	d, err := conf.dialer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, ok := d.LocalAddr.(*net.TCPAddr)
+	if !ok || !addr.IP.Equal(net.ParseIP("127.0.0.1")) {
+		t.Fatalf("got dialer local address %v; want 127.0.0.1", d.LocalAddr)
+	}
+
+	d, err = (&TransportConf{}).dialer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.LocalAddr != nil {
+		t.Fatalf("got dialer local address %v; want none", d.LocalAddr)
+	}
+
+	if _, err := (&TransportConf{LocalAddr: "localhost"}).NewTransport(); err == nil {
+		t.Fatal("expected an error for a non-IP local address")
+	}
+}
+
+func TestBackendCustomCA(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello over TLS")
+	}))
+	defer backend.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, caPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	addr := strings.TrimPrefix(backend.URL, "https://")
+
+	for _, tc := range []struct {
+		description string
+		to          string
+		status      int
+	}{
+		{"a backend with a cert signed by the configured CA is trusted",
+			fmt.Sprintf(`{"addr": %q, "cafile": %q}`, addr, caFile), http.StatusOK},
+		{"a backend with a self-signed cert is not trusted by default",
+			fmt.Sprintf(`{"addr": %q, "tls": true}`, addr), http.StatusBadGateway},
+		{"a backend cert need not be trusted with insecureskipverify",
+			fmt.Sprintf(`{"addr": %q, "insecureskipverify": true}`, addr), http.StatusOK},
+	} {
+		proxy, err := NewProxyFromRules([]byte(fmt.Sprintf(`[{"from": {}, "to": %s}]`, tc.to)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := httptest.NewServer(proxy)
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		server.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: got status %d; want %d", tc.description, resp.StatusCode, tc.status)
+		}
+		if tc.status == http.StatusOK && string(body) != "hello over TLS" {
+			t.Errorf("%s: got body %q", tc.description, body)
+		}
+	}
+}
+
+func TestBackendTLSServerName(t *testing.T) {
+	serverNames := make(chan string, 1)
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serverNames <- r.TLS.ServerName
+	}))
+	defer backend.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, caPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The backend is dialed by IP, but its certificate is for example.com.
+	addr := strings.TrimPrefix(backend.URL, "https://")
+
+	for _, tc := range []struct {
+		serverName string
+		status     int
+	}{
+		{"example.com", http.StatusOK},
+		{"other.example.org", http.StatusBadGateway},
+	} {
+		rules := fmt.Sprintf(`[{"from": {}, "to": {"addr": %q, "cafile": %q, "tlsservername": %q}}]`,
+			addr, caFile, tc.serverName)
+		proxy, err := NewProxyFromRules([]byte(rules))
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := httptest.NewServer(proxy)
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		server.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("tlsservername %s: got status %d; want %d", tc.serverName, resp.StatusCode, tc.status)
+			continue
+		}
+		if tc.status == http.StatusOK {
+			if got := <-serverNames; got != tc.serverName {
+				t.Errorf("backend got SNI server name %q; want %q", got, tc.serverName)
+			}
+		}
+	}
+}
+
+func TestMirror(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "primary")
+	}))
+	defer primary.Close()
+	mirrored := make(chan string, 1)
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mirrored <- r.URL.Path + " " + string(body)
+		fmt.Fprint(w, "mirror")
+	}))
+	defer mirror.Close()
+
+	config := fmt.Sprintf(`[{"from": {}, "to": {"addr": %q, "mirror": [%q]}}]`,
+		strings.TrimPrefix(primary.URL, "http://"), strings.TrimPrefix(mirror.URL, "http://"))
+	proxy, err := NewProxyFromRules([]byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/mirrored", "text/plain", strings.NewReader("request body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "primary" {
+		t.Fatalf("client got body %q; want the primary's response", body)
+	}
+	select {
+	case got := <-mirrored:
+		if want := "/mirrored request body"; got != want {
+			t.Fatalf("mirror got %q; want %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("mirror backend did not receive the request")
+	}
+}
+
+func TestMirrorLimits(t *testing.T) {
+	arrived := make(chan struct{}, 2)
+	abandoned := make(chan struct{}, 2)
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-r.Context().Done()
+		abandoned <- struct{}{}
+	}))
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	proxy, server := startProxy(t, `[{"from": {}, "to": {"addr": "{{backend1}}", "mirror": ["{{backend2}}"]}}]`,
+		primary, mirror)
+	proxy.MaxBackground = 1
+	proxy.BackgroundTimeout = 100 * time.Millisecond
+	logs := captureLog(t)
+	get := func() {
+		t.Helper()
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	get()
+	select {
+	case <-arrived:
+	case <-time.After(5 * time.Second):
+		t.Fatal("mirror backend did not receive the request")
+	}
+	// The first mirrored request is still in flight, so the second is dropped.
+	get()
+	if !strings.Contains(logs.String(), "mirror dropped") {
+		t.Errorf("no warning about a dropped mirror request in the log:\n%s", logs)
+	}
+	select {
+	case <-abandoned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the mirrored request was not abandoned after the timeout")
+	}
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt64(&proxy.background) > 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("the timed-out mirrored request is still counted as in flight")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if len(arrived) > 0 {
+		t.Error("the mirror backend received the dropped request")
+	}
+}
+
+func TestNoXFF(t *testing.T) {
+	backend := NewRecordingBackend()
+	_, server := startProxy(t, `[{"from": {"path": "/xff"}, "to": {"addr": "{{backend1}}"}},
+	                             {"from": {}, "to": {"addr": "{{backend1}}", "noxff": true}}]`, backend.Server)
+
+	for _, tc := range []struct {
+		path string
+		want []string
+	}{
+		{"/xff", []string{"192.0.2.1, 127.0.0.1"}},
+		{"/noxff", nil},
+	} {
+		req, err := http.NewRequest("GET", server.URL+tc.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Forwarded-For", "192.0.2.1")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := backend.Next(t).Header["X-Forwarded-For"]; !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: backend got X-Forwarded-For %q; want %q", tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestTrustXFF(t *testing.T) {
+	backend := NewRecordingBackend()
+	_, server := startProxy(t, `[{"from": {"host": "internal.example.com"}, "to": {"addr": "{{backend1}}"}},
+	                             {"from": {"host": "edge.example.com"},
+	                              "to": {"addr": "{{backend1}}", "trustxff": false}}]`, backend.Server)
+
+	for _, tc := range []struct {
+		host string
+		want string
+	}{
+		{"internal.example.com", "192.0.2.1, 127.0.0.1"},
+		{"edge.example.com", "127.0.0.1"},
+	} {
+		req, err := http.NewRequest("GET", server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = tc.host
+		req.Header.Set("X-Forwarded-For", "192.0.2.1")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := backend.Next(t).Header.Get("X-Forwarded-For"); got != tc.want {
+			t.Errorf("%s: backend got X-Forwarded-For %q; want %q", tc.host, got, tc.want)
+		}
+	}
+}
+
+func TestMaxResponseHeaderBytes(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/big" {
+			w.Header().Set("X-Big", strings.Repeat("x", 10000))
+		}
+	}))
+	proxy, server := startProxy(t, `[{"from": {}, "to": {"addr": "{{backend1}}"}}]`, backend)
+	transport, err := (&TransportConf{MaxResponseHeaderBytes: 4096}).NewTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.Transport = transport
+
+	for _, tc := range []struct {
+		path   string
+		status int
+	}{
+		{"/small", http.StatusOK},
+		{"/big", http.StatusBadGateway},
+	} {
+		resp, err := http.Get(server.URL + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: got status %d; want %d", tc.path, resp.StatusCode, tc.status)
+		}
+	}
+}
+
+func TestXFFFolding(t *testing.T) {
+	for _, tc := range []struct {
+		remoteAddr string
+		prior      []string
+		want       string
+	}{
+		{"192.0.2.1:1234", nil, "192.0.2.1"},
+		{"[2001:db8::1]:1234", nil, "2001:db8::1"},
+		{"[2001:db8::1]:1234", []string{"198.51.100.1"}, "198.51.100.1, 2001:db8::1"},
+		{"[2001:db8::1]:1234", []string{"198.51.100.1", "203.0.113.1"}, "198.51.100.1, 203.0.113.1, 2001:db8::1"},
+		{"[2001:db8::1]:1234", []string{"198.51.100.1, 2001:db8::1"}, "198.51.100.1, 2001:db8::1"},
+		{"[2001:db8::1]:1234", []string{"198.51.100.1, [2001:db8::1]"}, "198.51.100.1, [2001:db8::1]"},
+		{"192.0.2.1:1234", []string{"192.0.2.1"}, "192.0.2.1"},
+		{"192.0.2.1:1234", []string{"192.0.2.1, 198.51.100.1"}, "192.0.2.1, 198.51.100.1, 192.0.2.1"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tc.remoteAddr
+		for _, v := range tc.prior {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		out := (&ToConf{Addr: "localhost:1"}).CreateRequest(r)
+		if got := out.Header["X-Forwarded-For"]; len(got) != 1 || got[0] != tc.want {
+			t.Errorf("RemoteAddr %s with prior X-Forwarded-For %q: got %q; want %q",
+				tc.remoteAddr, tc.prior, got, tc.want)
+		}
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+	backend := NewRecordingBackend()
+	rules := `[{"from": {"path": "/override"}, "to": {"addr": "{{backend1}}", "useragent": "erebus"}},
+	           {"from": {"path": "/clear"}, "to": {"addr": "{{backend1}}", "useragent": ""}},
+	           {"from": {}, "to": {"addr": "{{backend1}}"}}]`
+	_, server := startProxy(t, rules, backend.Server)
+
+	for _, tc := range []struct {
+		path string
+		want []string
+	}{
+		{"/override", []string{"erebus"}},
+		{"/clear", nil},
+		{"/", []string{"client/1.0"}},
+	} {
+		req, err := http.NewRequest("GET", server.URL+tc.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("User-Agent", "client/1.0")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := backend.Next(t).Header["User-Agent"]; !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: backend got User-Agent %q; want %q", tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestOnAllDown(t *testing.T) {
+	// A server which has been shut down provides an address with no backend behind it.
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	addr := strings.TrimPrefix(down.URL, "http://")
+	page := filepath.Join(t.TempDir(), "maintenance.html")
+	if err := ioutil.WriteFile(page, []byte("<h1>Down for maintenance</h1>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		description string
+		onAllDown   string
+		status      int
+		retryAfter  string
+		body        string
+	}{
+		{"without onalldown, a down backend gives a 502", `null`, http.StatusBadGateway, "", ""},
+		{"unavailable mode gives a 503 with Retry-After", `{"mode": "unavailable", "retryafter": 30}`,
+			http.StatusServiceUnavailable, "30", "Service unavailable.\n"},
+		{"page mode serves the maintenance page", fmt.Sprintf(`{"mode": "page", "page": %q}`, page),
+			http.StatusServiceUnavailable, "", "<h1>Down for maintenance</h1>"},
+		{"page mode uses the configured status", fmt.Sprintf(`{"mode": "page", "page": %q, "status": 500}`, page),
+			http.StatusInternalServerError, "", "<h1>Down for maintenance</h1>"},
+	} {
+		rules := fmt.Sprintf(`[{"from": {}, "to": {"addr": %q, "onalldown": %s}}]`, addr, tc.onAllDown)
+		_, server := startProxy(t, rules)
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: got status %d; want %d", tc.description, resp.StatusCode, tc.status)
+		}
+		if got := resp.Header.Get("Retry-After"); got != tc.retryAfter {
+			t.Errorf("%s: got Retry-After %q; want %q", tc.description, got, tc.retryAfter)
+		}
+		if tc.body != "" && string(body) != tc.body {
+			t.Errorf("%s: got body %q; want %q", tc.description, body, tc.body)
+		}
+	}
+
+	for _, onAllDown := range []string{`{"mode": "stale"}`, `{"mode": "page"}`} {
+		rules := fmt.Sprintf(`[{"from": {}, "to": {"addr": %q, "onalldown": %s}}]`, addr, onAllDown)
+		if _, err := NewProxyFromRules([]byte(rules)); err == nil {
+			t.Errorf("expected an error for onalldown config %s", onAllDown)
+		}
+	}
+}
+
+func TestSlowThreshold(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}))
+	proxy, server := startProxy(t, `[{"from": {}, "to": {"addr": "{{backend1}}"}}]`, backend)
+	proxy.SlowThreshold = 50 * time.Millisecond
+	logs := captureLog(t)
+
+	for _, path := range []string{"/fast", "/slow"} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	var slowLines []string
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(line, "Slow request") {
+			slowLines = append(slowLines, line)
+		}
+	}
+	if len(slowLines) != 1 || !strings.Contains(slowLines[0], "/slow") {
+		t.Fatalf("got slow request log lines %q; want one line for /slow", slowLines)
+	}
+}
+
+func TestRespond(t *testing.T) {
+	rules := `[{"from": {"path": "/stub"},
+	            "respond": {"body": "stubbed", "headers": {"Content-Type": "text/plain"}}},
+	           {"from": {},
+	            "respond": {"status": 503, "body": "down for maintenance", "headers": {"Retry-After": "60"}}}]`
+	_, server := startProxy(t, rules)
+
+	for _, tc := range []struct {
+		path    string
+		status  int
+		body    string
+		headers map[string]string
+	}{
+		{"/stub", http.StatusOK, "stubbed", map[string]string{"Content-Type": "text/plain"}},
+		{"/other", http.StatusServiceUnavailable, "down for maintenance", map[string]string{"Retry-After": "60"}},
+	} {
+		resp, err := http.Get(server.URL + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: got status %d; want %d", tc.path, resp.StatusCode, tc.status)
+		}
+		if string(body) != tc.body {
+			t.Errorf("%s: got body %q; want %q", tc.path, body, tc.body)
+		}
+		for k, v := range tc.headers {
+			if got := resp.Header.Get(k); got != v {
+				t.Errorf("%s: got %s header %q; want %q", tc.path, k, got, v)
+			}
+		}
+	}
+
+	for _, rules := range []string{
+		`[{"from": {}, "to": {"addr": "localhost:1"}, "respond": {"body": "x"}}]`,
+		`[{"from": {}}]`,
+	} {
+		if _, err := NewProxyFromRules([]byte(rules)); err == nil {
+			t.Errorf("expected an error for rules %s", rules)
+		}
+	}
+}
+
+func TestTrustForwardedProto(t *testing.T) {
+	proxy, err := NewProxyFromRules([]byte(`[{"from": {"scheme": "https"}, "to": {"addr": "localhost:1"}},
+	                                         {"from": {}, "respond": {"body": "plain"}}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		trust  bool
+		proto  string
+		scheme string
+	}{
+		{false, "", "http"},
+		{false, "https", "http"},
+		{true, "", "http"},
+		{true, "https", "https"},
+		{true, "HTTPS, http", "https"},
+		{true, "http", "http"},
+		{true, "gopher", "http"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		if tc.proto != "" {
+			r.Header.Set("X-Forwarded-Proto", tc.proto)
+		}
+		if tc.trust {
+			r = withForwardedScheme(r)
+		}
+		if got := requestScheme(r); got != tc.scheme {
+			t.Errorf("trust=%t, X-Forwarded-Proto %q: got scheme %q; want %q", tc.trust, tc.proto, got, tc.scheme)
+		}
+		if got := proxy.Rules[0].From.Matches(r); got != (tc.scheme == "https") {
+			t.Errorf("trust=%t, X-Forwarded-Proto %q: got https rule match=%t", tc.trust, tc.proto, got)
+		}
+		if got := proxy.Rules[0].To.CreateRequest(r).URL.Scheme; got != tc.scheme {
+			t.Errorf("trust=%t, X-Forwarded-Proto %q: got backend scheme %q; want %q", tc.trust, tc.proto, got,
+				tc.scheme)
+		}
+	}
+
+	// Without trust, the header doesn't affect which rule is used.
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Forwarded-Proto", "https")
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	if w.Body.String() != "plain" {
+		t.Fatalf("untrusted X-Forwarded-Proto: got body %q; want the plain response", w.Body)
+	}
+	proxy.TrustForwardedProto = true
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("trusted X-Forwarded-Proto: got status %d; want 502 from the https rule's backend", w.Code)
+	}
+}
+
+var colorCodes = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+// logLines returns the lines of the captured log with the color codes removed.
+func logLines(logs *syncBuffer) []string {
+	return strings.Split(colorCodes.ReplaceAllString(logs.String(), ""), "\n")
+}
+
+func TestAccessLog(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	_, server := startProxy(t, `[{"from": {}, "to": {"addr": "{{backend1}}"}}]`, backend)
+	logs := captureLog(t)
+
+	req, err := http.NewRequest("GET", server.URL+"/a/b?c=d", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "foo.com"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	want := fmt.Sprintf("GET http://foo.com/a/b?c=d →  %s 200 ", strings.TrimPrefix(backend.URL, "http://"))
+	for _, line := range logLines(logs) {
+		if strings.Contains(line, want) {
+			return
+		}
+	}
+	t.Fatalf("got log %q; want a line containing %q", logs, want)
+}
+
+// panicTransport is a RoundTripper which panics.
+type panicTransport struct{}
+
+func (panicTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	var m map[string]int
+	m["boom"]++
+	return nil, nil
+}
+
+func TestPanicRecovery(t *testing.T) {
+	proxy, server := startProxy(t, `[{"from": {}, "to": {"addr": "localhost:1"}}]`)
+	proxy.Transport = panicTransport{}
+	logs := captureLog(t)
+
+	resp, err := http.Get(server.URL + "/explode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("got status %d; want 500", resp.StatusCode)
+	}
+	var panicLogged, requestLogged bool
+	for _, line := range logLines(logs) {
+		if strings.Contains(line, "Panic serving request GET") && strings.Contains(line, "/explode") &&
+			strings.Contains(line, "nil map") {
+			panicLogged = true
+		}
+		if strings.Contains(line, "/explode →  panic: ") {
+			requestLogged = true
+		}
+	}
+	if !panicLogged || !requestLogged {
+		t.Fatalf("got log %q; want the panic and the request to be logged", logs)
+	}
+}
+
+func TestNewProxyFromReader(t *testing.T) {
+	proxy, err := NewProxyFromReader(strings.NewReader(`[{"from": {"host": "a.com"}, "to": {"addr": "localhost:1"}},
+	                                                      {"from": {}, "respond": {"body": "ok"}}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(proxy.Rules); n != 2 {
+		t.Fatalf("got %d rules; want 2", n)
+	}
+
+	if _, err := NewProxyFromReader(strings.NewReader(`[]`)); err == nil {
+		t.Error("expected an error for a configuration without rules")
+	}
+	if _, err := NewProxyFromReader(iotest.ErrReader(io.ErrUnexpectedEOF)); err != io.ErrUnexpectedEOF {
+		t.Errorf("reading from a failing reader: got error %v; want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	d, err := (&TransportConf{}).dialer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Timeout != 30*time.Second {
+		t.Fatalf("got default dial timeout %s; want 30s", d.Timeout)
+	}
+
+	transport, err := (&TransportConf{DialTimeout: 200 * time.Millisecond}).NewTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The request itself may take much longer than the dial timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	// 192.0.2.0/24 is reserved for documentation, so connections to it don't succeed.
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://192.0.2.1:81/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := transport.RoundTrip(req); err == nil {
+		t.Fatal("expected an error connecting to an unreachable backend")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("connecting to an unreachable backend took %s; want it to fail within the dial timeout", elapsed)
+	}
+}
+
+func TestByteCounts(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		fmt.Fprint(w, "hello world")
+	}))
+	_, server := startProxy(t, `[{"from": {}, "to": {"addr": "{{backend1}}"}}]`, backend)
+	logs := captureLog(t)
+
+	resp, err := http.Post(server.URL+"/post", "text/plain", strings.NewReader("request body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	resp, err = http.Get(server.URL + "/get")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	for path, want := range map[string]string{
+		"/post": "(12 bytes in, 11 bytes out)",
+		"/get":  "(0 bytes in, 11 bytes out)",
+	} {
+		found := false
+		for _, line := range logLines(logs) {
+			if strings.Contains(line, path+" →  ") && strings.HasSuffix(line, want) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("got log %q; want the line for %s to end with %q", logs, path, want)
+		}
+	}
+}
+
+func TestCanary(t *testing.T) {
+	to := &ToConf{Addr: "stable:80", CanaryAddr: "canary:80", CanaryPercent: 20}
+	if err := to.validate(); err != nil {
+		t.Fatal(err)
+	}
+	const n = 10000
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		counts[to.CreateRequest(httptest.NewRequest("GET", "/", nil)).URL.Host]++
+	}
+	if counts["stable:80"]+counts["canary:80"] != n {
+		t.Fatalf("got backend counts %v; want only stable:80 and canary:80", counts)
+	}
+	// The standard deviation of the canary count is 40.
+	if c := counts["canary:80"]; c < 1800 || c > 2200 {
+		t.Errorf("got %d of %d requests sent to the canary; want about 2000", c, n)
+	}
+
+	for _, to := range []*ToConf{
+		{Addr: "stable:80", CanaryPercent: 10},
+		{Addr: "stable:80", CanaryAddr: "canary:80", CanaryPercent: 101},
+		{Addr: "stable:80", CanaryAddr: "canary:80", CanaryPercent: -1},
+	} {
+		if err := to.validate(); err == nil {
+			t.Errorf("expected an error for canary config %+v", to)
+		}
+	}
+}
+
+func TestCanarySlowStart(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := &ToConf{
+		Addr:            "stable:80",
+		CanaryAddr:      "canary:80",
+		CanaryPercent:   40,
+		CanarySlowStart: 10000,
+		now:             func() time.Time { return now },
+	}
+	if err := to.validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		elapsed time.Duration
+		want    float64
+	}{
+		{0, 0},
+		{2500 * time.Millisecond, 10},
+		{5 * time.Second, 20},
+		{10 * time.Second, 40},
+		{time.Hour, 40},
+	} {
+		now = to.loaded.Add(tc.elapsed)
+		if got := to.canaryPercent(to.loaded); got != tc.want {
+			t.Errorf("after %s: got canary share %v%%; want %v%%", tc.elapsed, got, tc.want)
+		}
+	}
+
+	// At the start of the ramp, no requests go to the canary.
+	now = to.loaded
+	for i := 0; i < 100; i++ {
+		if host := to.CreateRequest(httptest.NewRequest("GET", "/", nil)).URL.Host; host != "stable:80" {
+			t.Fatalf("at the start of the slow start, a request was sent to %s", host)
+		}
+	}
+}
+
+func TestDefaultQuery(t *testing.T) {
+	to := &ToConf{Addr: "localhost:1", DefaultQuery: map[string]string{"format": "json", "q": "a b&c"}}
+	for _, tc := range []struct {
+		query string
+		want  string
+	}{
+		{"", "format=json&q=a+b%26c"},
+		{"x=1", "x=1&format=json&q=a+b%26c"},
+		{"format=xml", "format=xml&q=a+b%26c"},
+		{"q=&format=csv", "q=&format=csv"},
+	} {
+		r := httptest.NewRequest("GET", "/path?"+tc.query, nil)
+		out := to.CreateRequest(r)
+		if out.URL.RawQuery != tc.want {
+			t.Errorf("query %q: got backend query %q; want %q", tc.query, out.URL.RawQuery, tc.want)
+		}
+		if r.URL.RawQuery != tc.query {
+			t.Errorf("query %q: inbound request query was changed to %q", tc.query, r.URL.RawQuery)
+		}
+	}
+}
+
+func TestMaxXFFHops(t *testing.T) {
+	var chain []string
+	for i := 1; i <= 50; i++ {
+		chain = append(chain, fmt.Sprintf("10.0.0.%d", i))
+	}
+	for _, tc := range []struct {
+		max   int
+		prior string
+		want  string
+	}{
+		{0, strings.Join(chain, ", "), strings.Join(chain, ", ") + ", 192.0.2.1"},
+		{3, strings.Join(chain, ", "), "10.0.0.49, 10.0.0.50, 192.0.2.1"},
+		{3, strings.Join(chain, ","), "10.0.0.49, 10.0.0.50, 192.0.2.1"},
+		{3, "10.0.0.1", "10.0.0.1, 192.0.2.1"},
+		{1, "10.0.0.1, 10.0.0.2", "192.0.2.1"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		r.Header.Set("X-Forwarded-For", tc.prior)
+		out := (&ToConf{Addr: "localhost:1", MaxXFFHops: tc.max}).CreateRequest(r)
+		if got := out.Header.Get("X-Forwarded-For"); got != tc.want {
+			t.Errorf("max %d, prior X-Forwarded-For %q: got %q; want %q", tc.max, tc.prior, got, tc.want)
+		}
+	}
+}
+
+func TestHead(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Method", r.Method)
+		w.Header().Set("Content-Length", "11")
+		fmt.Fprint(w, "hello world")
+	}))
+	rules := `[{"from": {"path": "/synthesized"}, "to": {"addr": "{{backend1}}", "synthesizehead": true}},
+	           {"from": {}, "to": {"addr": "{{backend1}}"}}]`
+	_, server := startProxy(t, rules, backend)
+
+	for _, tc := range []struct {
+		path   string
+		method string
+	}{
+		{"/direct", "HEAD"},
+		{"/synthesized", "GET"},
+	} {
+		resp, err := http.Head(server.URL + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if got := resp.Header.Get("X-Method"); got != tc.method {
+			t.Errorf("%s: backend got a %s; want %s", tc.path, got, tc.method)
+		}
+		if len(body) != 0 {
+			t.Errorf("%s: got body %q for a HEAD request", tc.path, body)
+		}
+		if resp.ContentLength != 11 {
+			t.Errorf("%s: got Content-Length %d; want the backend's 11", tc.path, resp.ContentLength)
+		}
+	}
+}
+
+func TestOnStatus(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/unavailable" {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "primary")
+	}))
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "fallback got %q", body)
+	}))
+	rules := `[{"from": {}, "to": {"addr": "{{backend1}}", "onstatus": {"503": "{{backend2}}"}}}]`
+	_, server := startProxy(t, rules, primary, fallback)
+
+	for _, tc := range []struct {
+		path string
+		want string
+	}{
+		{"/ok", "primary"},
+		{"/unavailable", `fallback got "request body"`},
+	} {
+		resp, err := http.Post(server.URL+tc.path, "text/plain", strings.NewReader("request body"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != tc.want {
+			t.Errorf("%s: got status %d and body %q; want 200 and %q", tc.path, resp.StatusCode, body, tc.want)
+		}
+	}
+
+	if _, err := NewProxyFromRules([]byte(`[{"from": {}, "to": {"addr": "localhost:1",
+	    "onstatus": {"0": "localhost:2"}}}]`)); err == nil {
+		t.Error("expected an error for an invalid onstatus status code")
+	}
+}
+
+func TestAddPrefix(t *testing.T) {
+	backend := NewRecordingBackend()
+	rules := `[{"from": {"pathprefix": "/slash/"}, "to": {"addr": "{{backend1}}", "addprefix": "/service-b/"}},
+	           {"from": {}, "to": {"addr": "{{backend1}}", "addprefix": "/service-a"}}]`
+	_, server := startProxy(t, rules, backend.Server)
+
+	for _, tc := range []struct {
+		path string
+		want string
+	}{
+		{"/", "/service-a/"},
+		{"/users/1?x=y", "/service-a/users/1?x=y"},
+		{"/a%2Fb", "/service-a/a%2Fb"},
+		{"/slash/x", "/service-b/slash/x"},
+	} {
+		resp, err := http.Get(server.URL + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := backend.Next(t).URL.RequestURI(); got != tc.want {
+			t.Errorf("%s: backend got %q; want %q", tc.path, got, tc.want)
+		}
+	}
+
+	if err := (&ToConf{Addr: "localhost:1", AddPrefix: "service"}).validate(); err == nil {
+		t.Error("expected an error for an addprefix without a leading slash")
+	}
+}
+
+func TestSetHeaders(t *testing.T) {
+	to := &ToConf{Addr: "localhost:1", SetHeaders: map[string]string{
+		"X-Tenant":        "{host}",
+		"X-Original-Path": "{path}",
+		"X-Method":        "{method}",
+		"X-Client":        "client={clientip}",
+		"X-Literal":       "plain value {unknown}",
+	}}
+	r := httptest.NewRequest("POST", "/a/b?c=d", nil)
+	r.Host = "tenant.example.com"
+	r.RemoteAddr = "[2001:db8::1]:1234"
+	out := to.CreateRequest(r)
+	for k, want := range map[string]string{
+		"X-Tenant":        "tenant.example.com",
+		"X-Original-Path": "/a/b",
+		"X-Method":        "POST",
+		"X-Client":        "client=2001:db8::1",
+		"X-Literal":       "plain value {unknown}",
+	} {
+		if got := out.Header.Get(k); got != want {
+			t.Errorf("got %s %q; want %q", k, got, want)
+		}
+	}
+	if len(r.Header) != 0 {
+		t.Errorf("the inbound request's headers were modified: %v", r.Header)
+	}
+}
+
+func TestReferer(t *testing.T) {
+	for _, tc := range []struct {
+		mode    string
+		referer string
+		want    string
+	}{
+		{"", "https://public.example.com/page", "https://public.example.com/page"},
+		{"drop", "https://public.example.com/page", ""},
+		{"rewrite", "https://public.example.com/page?q=1", "http://10.0.0.1:8080/page?q=1"},
+		{"rewrite", "https://PUBLIC.example.com/", "http://10.0.0.1:8080/"},
+		{"rewrite", "https://elsewhere.example.org/page", "https://elsewhere.example.org/page"},
+	} {
+		to := &ToConf{Addr: "10.0.0.1:8080", Referer: tc.mode}
+		if err := to.validate(); err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Host = "public.example.com"
+		r.Header.Set("Referer", tc.referer)
+		out := to.CreateRequest(r)
+		if got := out.Header.Get("Referer"); got != tc.want {
+			t.Errorf("referer mode %q with %q: got Referer %q; want %q", tc.mode, tc.referer, got, tc.want)
+		}
+		if got := r.Header.Get("Referer"); got != tc.referer {
+			t.Errorf("referer mode %q: the inbound request's Referer was changed to %q", tc.mode, got)
+		}
+	}
+
+	if err := (&ToConf{Addr: "localhost:1", Referer: "strip"}).validate(); err == nil {
+		t.Error("expected an error for an unknown referer mode")
+	}
+}
+
+func TestNoMatch(t *testing.T) {
+	for _, tc := range []struct {
+		status     int
+		body       string
+		wantStatus int
+		wantBody   string
+	}{
+		{0, "", http.StatusBadGateway, "No matching rule.\n"},
+		{http.StatusNotFound, "Not found.", http.StatusNotFound, "Not found.\n"},
+	} {
+		proxy, err := NewProxyFromRules([]byte(`[{"from": {"host": "known.example.com"}, "respond": {}}]`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxy.NoMatchStatus = tc.status
+		proxy.NoMatchBody = tc.body
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, httptest.NewRequest("GET", "http://unknown.example.com/", nil))
+		if w.Code != tc.wantStatus || w.Body.String() != tc.wantBody {
+			t.Errorf("got status %d and body %q; want %d and %q", w.Code, w.Body, tc.wantStatus, tc.wantBody)
+		}
+	}
+}
+
+func TestSharedRegexes(t *testing.T) {
+	proxy, err := NewProxyFromRules([]byte(`[
+		{"from": {"host": "a.example.com", "pathregex": "^/api/v[0-9]+/"}, "respond": {}},
+		{"from": {"host": "b.example.com", "pathregex": "^/api/v[0-9]+/"}, "respond": {}},
+		{"from": {"any": [{"pathregex": "^/api/v[0-9]+/"}]}, "respond": {}},
+		{"from": {"pathregex": "^/api/v[0-9]+/", "pathregexfullmatch": true}, "respond": {}},
+		{"from": {"pathregex": "^/other/"}, "respond": {}}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := proxy.Rules[0].From.regex
+	for i, re := range []*regexp.Regexp{proxy.Rules[1].From.regex, proxy.Rules[2].From.Any[0].regex} {
+		if re != shared {
+			t.Errorf("regex %d: got a separately compiled copy of an identical pattern", i)
+		}
+	}
+	for i, re := range []*regexp.Regexp{proxy.Rules[3].From.regex, proxy.Rules[4].From.regex} {
+		if re == shared {
+			t.Errorf("regex %d: a different pattern shares the same compiled regexp", i)
+		}
+	}
+}
+
+func TestForwardCookies(t *testing.T) {
+	for _, tc := range []struct {
+		forward []string
+		cookie  string
+		want    string
+	}{
+		{nil, "session=abc; tracking=xyz", "session=abc; tracking=xyz"},
+		{[]string{"session", "lang"}, "session=abc; tracking=xyz; lang=en", "session=abc; lang=en"},
+		{[]string{"session"}, "tracking=xyz", ""},
+		{[]string{}, "session=abc", ""},
+	} {
+		to := &ToConf{Addr: "localhost:1", ForwardCookies: tc.forward}
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Cookie", tc.cookie)
+		out := to.CreateRequest(r)
+		if got := out.Header.Get("Cookie"); got != tc.want {
+			t.Errorf("forwardcookies %q: got Cookie %q; want %q", tc.forward, got, tc.want)
+		}
+		if got := r.Header.Get("Cookie"); got != tc.cookie {
+			t.Errorf("forwardcookies %q: the inbound request's Cookie was changed to %q", tc.forward, got)
+		}
+	}
+}
+
+func TestClientDisconnect(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chunk := bytes.Repeat([]byte("x"), 1<<20)
+		for i := 0; i < 1000; i++ {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	}))
+	_, server := startProxy(t, `[{"from": {}, "to": {"addr": "{{backend1}}"}}]`, backend)
+	logs := captureLog(t)
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	if _, err := conn.Read(make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		for _, line := range logLines(logs) {
+			if strings.Contains(line, "client disconnected") {
+				if strings.Contains(line, "backend error") {
+					t.Errorf("client disconnect logged as a backend error: %q", line)
+				}
+				return
+			}
+		}
+	}
+	t.Errorf("got log %q; want the client disconnect to be logged", logs)
+}
+
+func TestMaxURLLength(t *testing.T) {
+	proxy, err := NewProxyFromRules([]byte(`[{"from": {}, "respond": {}}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.MaxURLLength = 100
+	for _, tc := range []struct {
+		path   string
+		status int
+	}{
+		{"/short?q=1", http.StatusOK},
+		{"/" + strings.Repeat("a", 99), http.StatusOK},
+		{"/" + strings.Repeat("a", 100), http.StatusRequestURITooLong},
+		{"/?q=" + strings.Repeat("a", 200), http.StatusRequestURITooLong},
+	} {
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, httptest.NewRequest("GET", tc.path, nil))
+		if w.Code != tc.status {
+			t.Errorf("URL of length %d: got status %d; want %d", len(tc.path), w.Code, tc.status)
+		}
+	}
+}
+
+func TestResponseHeaderAllowlist(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Internal-Host", "app-17")
+		w.Header().Set("Server", "backend/1.2")
+		fmt.Fprint(w, "hello")
+	}))
+	rules := `[{"from": {"path": "/allow"}, "to": {"addr": "{{backend1}}", "responseheaderallowlist": ["cache-control"]}},
+	           {"from": {"path": "/exclude"},
+	            "to": {"addr": "{{backend1}}", "responseheaderallowlist": ["Cache-Control", "-Content-Type"]}},
+	           {"from": {}, "to": {"addr": "{{backend1}}"}}]`
+	_, server := startProxy(t, rules, backend)
+
+	for _, tc := range []struct {
+		path    string
+		present []string
+		absent  []string
+	}{
+		{"/allow", []string{"Content-Type", "Content-Length", "Cache-Control"}, []string{"X-Internal-Host", "Server"}},
+		{"/exclude", []string{"Cache-Control"}, []string{"Content-Type", "X-Internal-Host", "Server"}},
+		{"/all", []string{"Content-Type", "Cache-Control", "X-Internal-Host", "Server"}, nil},
+	} {
+		resp, err := http.Get(server.URL + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		for _, h := range tc.present {
+			if _, ok := resp.Header[h]; !ok {
+				t.Errorf("%s: response is missing %s", tc.path, h)
+			}
+		}
+		for _, h := range tc.absent {
+			if v, ok := resp.Header[h]; ok {
+				t.Errorf("%s: got %s %q; want it removed", tc.path, h, v)
+			}
+		}
+	}
+}
+
+func TestMatchReason(t *testing.T) {
+	r := httptest.NewRequest("GET", "http://a.com/web/x", nil)
+	r.Header.Set("Authorization", "Bearer xyz")
+	for _, tc := range []struct {
+		from string
+		want string
+	}{
+		{`{"host": "a.com", "pathprefix": "/web/"}`, ""},
+		{`{"host": "b.com"}`, "host"},
+		{`{"host": "a.com", "path": "/web/y"}`, "path"},
+		{`{"pathprefix": "/api/"}`, "pathprefix"},
+		{`{"pathregex": "^/web/[0-9]+$"}`, "pathregex"},
+		{`{"scheme": "https"}`, "scheme"},
+		{`{"headersabsent": ["authorization"]}`, "headersabsent"},
+		{`{"any": [{"host": "b.com"}, {"path": "/"}]}`, "any"},
+		{`{"jwtclaim": {"name": "role", "value": "admin"}}`, "jwtclaim"},
+	} {
+		var from FromConf
+		if err := json.Unmarshal([]byte(tc.from), &from); err != nil {
+			t.Fatal(err)
+		}
+		if err := from.validate(nil); err != nil {
+			t.Fatal(err)
+		}
+		matched, reason := from.MatchReason(r)
+		if matched != (tc.want == "") || reason != tc.want {
+			t.Errorf("%s: got (%t, %q); want (%t, %q)", tc.from, matched, reason, tc.want == "", tc.want)
+		}
+	}
+}
+
+func TestDebugMatch(t *testing.T) {
+	proxy, err := NewProxyFromRules([]byte(`[{"from": {"host": "b.com"}, "respond": {}},
+	                                         {"from": {"pathprefix": "/api/"}, "respond": {}},
+	                                         {"from": {}, "respond": {}}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.DebugMatch = true
+	logs := captureLog(t)
+	proxy.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://a.com/web/x", nil))
+	var got []string
+	for _, line := range logLines(logs) {
+		if i := strings.Index(line, "rule "); i >= 0 && strings.Contains(line, "[debugmatch]") {
+			got = append(got, line[i:])
+		}
+	}
+	want := []string{
+		"rule 1 did not match (host)",
+		"rule 2 did not match (pathprefix)",
+		"rule 3 matched",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got debugmatch logs %q; want %q", got, want)
+	}
+}
+
+func TestAllowMethods(t *testing.T) {
+	proxy, err := NewProxyFromRules([]byte(`[{"from": {}, "respond": {}}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, method := range []string{"GET", "TRACE", "PROPFIND"} {
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, httptest.NewRequest(method, "/", nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s with no allowmethods: got status %d; want 200", method, w.Code)
+		}
+	}
+
+	proxy.AllowMethods = []string{"GET", "HEAD", "POST"}
+	for _, tc := range []struct {
+		method string
+		status int
+	}{
+		{"GET", http.StatusOK},
+		{"POST", http.StatusOK},
+		{"TRACE", http.StatusMethodNotAllowed},
+		{"TRACK", http.StatusMethodNotAllowed},
+		{"DEBUG", http.StatusMethodNotAllowed},
+	} {
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, httptest.NewRequest(tc.method, "/", nil))
+		if w.Code != tc.status {
+			t.Errorf("%s: got status %d; want %d", tc.method, w.Code, tc.status)
+		}
+		if tc.status == http.StatusMethodNotAllowed {
+			if got, want := w.Header().Get("Allow"), "GET, HEAD, POST"; got != want {
+				t.Errorf("%s: got Allow %q; want %q", tc.method, got, want)
+			}
+		}
+	}
+}
+
+func TestFoldHeaders(t *testing.T) {
+	to := &ToConf{Addr: "localhost:1", FoldHeaders: []string{"accept", "X-Single", "Cookie"}}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header["Accept"] = []string{"text/html", "application/json"}
+	r.Header["X-Single"] = []string{"one"}
+	r.Header["Cookie"] = []string{"a=1", "b=2"}
+	r.Header["X-Other"] = []string{"x", "y"}
+	out := to.CreateRequest(r)
+	for name, want := range map[string][]string{
+		"Accept":   {"text/html, application/json"},
+		"X-Single": {"one"},
+		"Cookie":   {"a=1; b=2"},
+		"X-Other":  {"x", "y"},
+	} {
+		if got := out.Header[name]; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %s %q; want %q", name, got, want)
+		}
+	}
+	if got := r.Header["Accept"]; len(got) != 2 {
+		t.Errorf("the inbound request's Accept was changed to %q", got)
+	}
+}
+
+func TestRequireTLS(t *testing.T) {
+	proxy, err := NewProxyFromRules([]byte(`[
+		{"from": {"host": "secure.example.com", "requiretls": true}, "respond": {"body": "secure"}},
+		{"from": {}, "respond": {"body": "other"}}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	captureLog(t)
+	for _, tc := range []struct {
+		method   string
+		host     string
+		tls      bool
+		proto    string
+		trust    bool
+		wantCode int
+		wantLoc  string
+		wantBody string
+	}{
+		{host: "secure.example.com", wantCode: 301, wantLoc: "https://secure.example.com/a?b=c"},
+		{host: "secure.example.com", tls: true, wantCode: 200, wantBody: "secure"},
+		{host: "other.example.com", wantCode: 200, wantBody: "other"},
+		// Behind a TLS terminator, the forwarded scheme prevents a redirect loop only if it's trusted.
+		{host: "secure.example.com", proto: "https", trust: true, wantCode: 200, wantBody: "secure"},
+		{host: "secure.example.com", proto: "https", wantCode: 301, wantLoc: "https://secure.example.com/a?b=c"},
+		{host: "secure.example.com", proto: "http", trust: true, wantCode: 301,
+			wantLoc: "https://secure.example.com/a?b=c"},
+		// Other methods get a 308, which preserves the method and body.
+		{method: "POST", host: "secure.example.com", wantCode: 308, wantLoc: "https://secure.example.com/a?b=c"},
+	} {
+		method := tc.method
+		if method == "" {
+			method = "GET"
+		}
+		r := httptest.NewRequest(method, "/a?b=c", nil)
+		r.Host = tc.host
+		if tc.tls {
+			r.TLS = &tls.ConnectionState{}
+		}
+		if tc.proto != "" {
+			r.Header.Set("X-Forwarded-Proto", tc.proto)
+		}
+		proxy.TrustForwardedProto = tc.trust
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+		loc := w.Header().Get("Location")
+		if w.Code != tc.wantCode || loc != tc.wantLoc || (tc.wantBody != "" && w.Body.String() != tc.wantBody) {
+			t.Errorf("%s (TLS: %t, X-Forwarded-Proto %q, trusted: %t): got %d %q (Location %q); want %d %q "+
+				"(Location %q)", tc.host, tc.tls, tc.proto, tc.trust, w.Code, w.Body, loc, tc.wantCode, tc.wantBody,
+				tc.wantLoc)
+		}
+	}
+
+	_, err = NewProxyFromRules([]byte(`[{"from": {"any": [{"requiretls": true}]}, "respond": {}}]`))
+	if err == nil {
+		t.Error("requiretls in an 'any' alternative: expected a validation error")
+	}
+}
+
+func TestRawPath(t *testing.T) {
+	backend := NewRecordingBackend()
+	_, server := startProxy(t, `[
+		{"from": {"pathprefix": "/raw/"}, "to": {"addr": "{{backend1}}", "rawpath": true}},
+		{"from": {"pathprefix": "/prefixed/"}, "to": {"addr": "{{backend1}}", "rawpath": true, "addprefix": "/svc"}},
+		{"from": {}, "to": {"addr": "{{backend1}}"}}
+	]`, backend.Server)
+	captureLog(t)
+	for _, tc := range []struct {
+		uri  string
+		want string
+	}{
+		{"/raw/a%2Fb/c%3bd?q=%2F", "/raw/a%2Fb/c%3bd?q=%2F"},
+		{"/raw/a%2Fb|c", "/raw/a%2Fb|c"},
+		{"/prefixed/a%2Fb", "/svc/prefixed/a%2Fb"},
+		// Without rawpath, a path which Go considers improperly encoded is re-encoded from its decoded form.
+		{"/other/a%2Fb|c", "/other/a/b%7Cc"},
+	} {
+		req, err := http.NewRequest("GET", server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.URL.Opaque, req.URL.RawQuery, _ = strings.Cut(tc.uri, "?")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := backend.Next(t).RequestURI; got != tc.want {
+			t.Errorf("%s: backend got %q; want %q", tc.uri, got, tc.want)
+		}
+	}
+}
+
+func TestRawRequestPath(t *testing.T) {
+	for _, tc := range []struct {
+		uri  string
+		want string
+	}{
+		{"/a%2Fb?c", "/a%2Fb"},
+		{"http://example.com/a%2Fb?c", "/a%2Fb"},
+		{"http://example.com", ""},
+		{"*", ""},
+		{"", ""},
+	} {
+		r := &http.Request{RequestURI: tc.uri}
+		if got := rawRequestPath(r); got != tc.want {
+			t.Errorf("rawRequestPath(%q): got %q; want %q", tc.uri, got, tc.want)
+		}
+	}
+}
+
+func TestOptionsAllow(t *testing.T) {
+	backend := NewRecordingBackend()
+	_, server := startProxy(t, `[
+		{"from": {"pathprefix": "/api/"}, "to": {"addr": "{{backend1}}"}, "optionsallow": ["GET", "post", "OPTIONS"]},
+		{"from": {}, "to": {"addr": "{{backend1}}"}}
+	]`, backend.Server)
+	captureLog(t)
+	do := func(method, path string) *http.Response {
+		req, err := http.NewRequest(method, server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := do("OPTIONS", "/api/users")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("OPTIONS: got status %d; want 204", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Allow"); got != "GET, POST, OPTIONS" {
+		t.Errorf("OPTIONS: got Allow %q; want \"GET, POST, OPTIONS\"", got)
+	}
+	select {
+	case r := <-backend.Received:
+		t.Errorf("OPTIONS request reached the backend: %s %s", r.Method, r.URL)
+	default:
+	}
+
+	// Other methods, and OPTIONS requests for other rules, are proxied.
+	do("GET", "/api/users")
+	if r := backend.Next(t); r.Method != "GET" {
+		t.Errorf("backend got method %s; want GET", r.Method)
+	}
+	do("OPTIONS", "/other")
+	if r := backend.Next(t); r.Method != "OPTIONS" {
+		t.Errorf("backend got method %s; want OPTIONS", r.Method)
+	}
+
+	if _, err := NewProxyFromRules([]byte(`[{"from": {}, "respond": {}, "optionsallow": [" "]}]`)); err == nil {
+		t.Error("an empty optionsallow method: expected a validation error")
+	}
+}
+
+func TestDisabledRule(t *testing.T) {
+	canary := NewRecordingBackend()
+	stable := NewRecordingBackend()
+	_, server := startProxy(t, `[
+		{"from": {"pathprefix": "/api/"}, "to": {"addr": "{{backend1}}"}, "enabled": false},
+		{"from": {"pathprefix": "/api/"}, "to": {"addr": "{{backend2}}"}, "enabled": true},
+		{"from": {}, "to": {"addr": "{{backend1}}"}}
+	]`, canary.Server, stable.Server)
+	captureLog(t)
+
+	resp, err := http.Get(server.URL + "/api/users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if r := stable.Next(t); r.URL.Path != "/api/users" {
+		t.Errorf("stable backend got path %s; want /api/users", r.URL.Path)
+	}
+	select {
+	case r := <-canary.Received:
+		t.Errorf("request for a disabled rule reached its backend: %s %s", r.Method, r.URL)
+	default:
+	}
+
+	// A disabled rule must still be valid.
+	if _, err := NewProxyFromRules([]byte(`[{"from": {}, "enabled": false}]`)); err == nil {
+		t.Error("an invalid disabled rule: expected a validation error")
+	}
+}
+
+func TestHTTP10Client(t *testing.T) {
+	big := strings.Repeat("x", 100<<10)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "keep-alive, X-Hop")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("X-Hop", "backend only")
+		w.Header().Set("X-End-To-End", "kept")
+		if r.URL.Path == "/small" {
+			w.Header().Set("Content-Length", "5")
+			io.WriteString(w, "small")
+			return
+		}
+		// Flushing makes the length unknown, so a 1.1 response is chunked.
+		w.(http.Flusher).Flush()
+		io.WriteString(w, big)
+	}))
+	_, server := startProxy(t, `[{"from": {}, "to": {"addr": "{{backend1}}"}}]`, backend)
+	captureLog(t)
+
+	for _, tc := range []struct {
+		path     string
+		reqConn  string
+		wantBody string
+		wantConn string // The response's Connection header
+	}{
+		// Without a length, the body is delimited by closing the connection (or else reading it times out).
+		{"/big", "", big, ""},
+		{"/big", "keep-alive", big, ""},
+		{"/small", "", "small", ""},
+		{"/small", "keep-alive", "small", "keep-alive"}, // Go's server can keep this connection open
+	} {
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		req := "GET " + tc.path + " HTTP/1.0\r\nHost: example.com\r\n"
+		if tc.reqConn != "" {
+			req += "Connection: " + tc.reqConn + "\r\n"
+		}
+		if _, err := io.WriteString(conn, req+"\r\n"); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("%s (Connection %q): error reading the body: %s", tc.path, tc.reqConn, err)
+		}
+		desc := fmt.Sprintf("%s (Connection %q)", tc.path, tc.reqConn)
+		if resp.ProtoMajor != 1 || resp.ProtoMinor != 0 {
+			t.Errorf("%s: got a %s response; want HTTP/1.0", desc, resp.Proto)
+		}
+		if len(resp.TransferEncoding) > 0 {
+			t.Errorf("%s: got Transfer-Encoding %q; want none", desc, resp.TransferEncoding)
+		}
+		if string(body) != tc.wantBody {
+			t.Errorf("%s: got a %d-byte body; want %d bytes", desc, len(body), len(tc.wantBody))
+		}
+		if got := resp.Header.Get("Connection"); got != tc.wantConn {
+			t.Errorf("%s: got Connection %q; want %q", desc, got, tc.wantConn)
+		}
+		for name, want := range map[string]string{"Keep-Alive": "", "X-Hop": "", "X-End-To-End": "kept"} {
+			if got := resp.Header.Get(name); got != want {
+				t.Errorf("%s: got %s %q; want %q", desc, name, got, want)
+			}
+		}
+	}
+}
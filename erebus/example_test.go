@@ -0,0 +1,43 @@
+package erebus_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+
+	"github.com/cespare/erebus/erebus"
+)
+
+func ExampleNewProxyFromRules() {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "backend got %s", r.URL.Path)
+	}))
+	defer backend.Close()
+
+	rules := fmt.Sprintf(`[{"from": {"pathprefix": "/api/"}, "to": {"addr": %q}},
+	                       {"from": {}, "respond": {"status": 404, "body": "not found"}}]`, backend.Listener.Addr())
+	proxy, err := erebus.NewProxyFromRules([]byte(rules))
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.SetOutput(ioutil.Discard) // Don't print the access log in this example
+	defer log.SetOutput(os.Stderr)
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	for _, path := range []string{"/api/users", "/other"} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		fmt.Printf("%s: %d %s\n", path, resp.StatusCode, body)
+	}
+	// Output:
+	// /api/users: 200 backend got /api/users
+	// /other: 404 not found
+}
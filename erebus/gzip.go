@@ -0,0 +1,80 @@
+package erebus
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// defaultGzipLevel is the compression level used if a rule doesn't give one: a balance of speed and size.
+const defaultGzipLevel = gzip.DefaultCompression
+
+// gzipPools holds reusable gzip.Writers for each compression level (indexed by level+1, so that
+// gzip.DefaultCompression is at 0).
+var gzipPools [gzip.BestCompression + 2]sync.Pool
+
+// gzipCopy copies from src to dst, compressing with gzip at the given level. It returns the number of
+// (uncompressed) bytes copied.
+func gzipCopy(dst io.Writer, src io.Reader, level int) (int64, error) {
+	pool := &gzipPools[level+1]
+	gw, ok := pool.Get().(*gzip.Writer)
+	if ok {
+		gw.Reset(dst)
+	} else {
+		gw, _ = gzip.NewWriterLevel(dst, level) // The level was checked by validate.
+	}
+	defer func() {
+		// Don't keep dst alive while the writer sits in the pool.
+		gw.Reset(ioutil.Discard)
+		pool.Put(gw)
+	}()
+	n, err := io.Copy(gw, src)
+	if err != nil {
+		return n, err
+	}
+	return n, gw.Close()
+}
+
+// gzipLevel returns the compression level for the rule's responses.
+func (c *ToConf) gzipLevel() int {
+	if c.GzipLevel == 0 {
+		return defaultGzipLevel
+	}
+	return c.GzipLevel
+}
+
+// shouldGzip reports whether the response resp to r should be compressed: Gzip must be set, the client must
+// accept gzip, and the response must have a textual content type and not be compressed already.
+func (c *ToConf) shouldGzip(r *http.Request, resp *http.Response) bool {
+	if !c.Gzip || r.Method == "HEAD" || !acceptsGzip(r) {
+		return false
+	}
+	switch resp.StatusCode {
+	case http.StatusNoContent, http.StatusNotModified, http.StatusPartialContent:
+		return false
+	}
+	if enc := resp.Header.Get("Content-Encoding"); enc != "" && !strings.EqualFold(enc, "identity") {
+		return false
+	}
+	t, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return err == nil && isTextMediaType(t)
+}
+
+// acceptsGzip reports whether the Accept-Encoding of r permits a gzipped response.
+func acceptsGzip(r *http.Request) bool {
+	for _, v := range r.Header.Values("Accept-Encoding") {
+		for _, enc := range strings.Split(v, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(enc), ";")
+			if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+				continue
+			}
+			q := strings.ReplaceAll(params, " ", "")
+			return q != "q=0" && q != "q=0.0" && q != "q=0.00" && q != "q=0.000"
+		}
+	}
+	return false
+}
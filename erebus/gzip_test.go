@@ -0,0 +1,176 @@
+package erebus
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGzip(t *testing.T) {
+	// Text which compresses differently at different levels.
+	var page bytes.Buffer
+	rng := rand.New(rand.NewSource(1))
+	words := []string{"alpha", "beta", "gamma", "delta", "epsilon", "zeta", "eta", "theta", "iota", "kappa"}
+	for page.Len() < 200000 {
+		fmt.Fprintf(&page, "%s %d ", words[rng.Intn(len(words))], rng.Intn(1000))
+	}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/image" {
+			w.Header().Set("Content-Type", "image/png")
+		} else {
+			w.Header().Set("Content-Type", "text/plain")
+		}
+		w.Write(page.Bytes())
+	}))
+	rules := `[{"from": {"path": "/fast"}, "to": {"addr": "{{backend1}}", "gzip": true, "gziplevel": 1}},
+	           {"from": {"path": "/small"}, "to": {"addr": "{{backend1}}", "gzip": true, "gziplevel": 9}},
+	           {"from": {}, "to": {"addr": "{{backend1}}", "gzip": true}}]`
+	_, server := startProxy(t, rules, backend)
+
+	get := func(path string, acceptGzip bool) (*http.Response, []byte) {
+		t.Helper()
+		req, err := http.NewRequest("GET", server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if acceptGzip {
+			// Setting this explicitly stops the client from transparently decompressing the response.
+			req.Header.Set("Accept-Encoding", "gzip")
+		}
+		resp, err := (&http.Transport{DisableCompression: true}).RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, body
+	}
+
+	sizes := make(map[string]int)
+	for _, path := range []string{"/fast", "/small", "/default"} {
+		resp, body := get(path, true)
+		if got := resp.Header.Get("Content-Encoding"); got != "gzip" {
+			t.Fatalf("%s: got Content-Encoding %q; want gzip", path, got)
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(plain, page.Bytes()) {
+			t.Errorf("%s: the decompressed response differs from the backend's", path)
+		}
+		sizes[path] = len(body)
+	}
+	if sizes["/small"] >= sizes["/fast"] {
+		t.Errorf("got %d bytes at level 9 and %d bytes at level 1; want level 9 to be smaller", sizes["/small"],
+			sizes["/fast"])
+	}
+
+	for _, tc := range []struct {
+		path       string
+		acceptGzip bool
+	}{
+		{"/default", false},
+		{"/image", true},
+	} {
+		resp, body := get(tc.path, tc.acceptGzip)
+		if enc := resp.Header.Get("Content-Encoding"); enc != "" || !bytes.Equal(body, page.Bytes()) {
+			t.Errorf("%s (accept gzip: %t): got Content-Encoding %q; want an uncompressed response", tc.path,
+				tc.acceptGzip, enc)
+		}
+	}
+
+	if err := (&ToConf{Addr: "localhost:1", Gzip: true, GzipLevel: 10}).validate(); err == nil {
+		t.Error("expected an error for gziplevel 10")
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	for _, tc := range []struct {
+		accept string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip;q=0.5", true},
+		{"GZIP", true},
+		{"br", false},
+		{"gzip;q=0", false},
+		{"gzip; q=0.0, br", false},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		if tc.accept != "" {
+			r.Header.Set("Accept-Encoding", tc.accept)
+		}
+		if got := acceptsGzip(r); got != tc.want {
+			t.Errorf("Accept-Encoding %q: got %t; want %t", tc.accept, got, tc.want)
+		}
+	}
+}
+
+func TestGzipCopyError(t *testing.T) {
+	// A writer which fails is not left referenced by the pooled gzip.Writer, which is then reused correctly.
+	if _, err := gzipCopy(failingWriter{}, bytes.NewReader(bytes.Repeat([]byte("x"), 100000)), 1); err == nil {
+		t.Fatal("expected an error copying to a failing writer")
+	}
+	var buf bytes.Buffer
+	if _, err := gzipCopy(&buf, bytes.NewReader([]byte("hello")), 1); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := ioutil.ReadAll(zr); err != nil || string(plain) != "hello" {
+		t.Errorf("got %q (err = %v); want \"hello\"", plain, err)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("write failed") }
+
+func benchmarkGzip(b *testing.B, compress func(io.Writer, io.Reader) error) {
+	page := bytes.Repeat([]byte("a moderately compressible line of text, number 12345\n"), 200)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(page)))
+	for i := 0; i < b.N; i++ {
+		if err := compress(ioutil.Discard, bytes.NewReader(page)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGzipCopyPooled(b *testing.B) {
+	benchmarkGzip(b, func(w io.Writer, r io.Reader) error {
+		_, err := gzipCopy(w, r, defaultGzipLevel)
+		return err
+	})
+}
+
+func BenchmarkGzipCopyUnpooled(b *testing.B) {
+	benchmarkGzip(b, func(w io.Writer, r io.Reader) error {
+		gw, err := gzip.NewWriterLevel(w, defaultGzipLevel)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(gw, r); err != nil {
+			return err
+		}
+		return gw.Close()
+	})
+}
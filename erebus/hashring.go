@@ -0,0 +1,123 @@
+package erebus
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// hashRingReplicas is the number of points each backend has on a hashRing. More points spread the keys more
+// evenly between the backends.
+const hashRingReplicas = 160
+
+// A hashRing consistently maps keys to backend addresses: each backend owns the keys hashing to the arcs of
+// the ring just before its points. Adding or removing a backend only moves the keys on that backend's arcs.
+type hashRing struct {
+	points []uint64 // Sorted
+	addrs  []string // addrs[i] owns points[i]
+}
+
+func newHashRing(addrs []string) *hashRing {
+	type point struct {
+		hash uint64
+		addr string
+	}
+	var points []point
+	for _, addr := range addrs {
+		for i := 0; i < hashRingReplicas; i++ {
+			points = append(points, point{hashKey(addr + "#" + strconv.Itoa(i)), addr})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+	ring := &hashRing{}
+	for _, p := range points {
+		ring.points = append(ring.points, p.hash)
+		ring.addrs = append(ring.addrs, p.addr)
+	}
+	return ring
+}
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	// FNV's low bits are poorly mixed for similar short strings, so finish with a 64-bit mixer.
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// lookup returns the backend address owning key. If that backend is unavailable (when unavailable is
+// non-nil), it walks on around the ring to the next available one, so only the unavailable backend's keys
+// move; if none is available, it returns the owner anyway.
+func (ring *hashRing) lookup(key string, unavailable func(string) bool) string {
+	h := hashKey(key)
+	i := sort.Search(len(ring.points), func(i int) bool { return ring.points[i] >= h })
+	if i == len(ring.points) {
+		i = 0
+	}
+	if unavailable == nil {
+		return ring.addrs[i]
+	}
+	for j := 0; j < len(ring.points); j++ {
+		if addr := ring.addrs[(i+j)%len(ring.addrs)]; !unavailable(addr) {
+			return addr
+		}
+	}
+	return ring.addrs[i]
+}
+
+// validateHashBy checks a ToConf's HashBy setting.
+func validateHashBy(hashBy string) error {
+	switch {
+	case hashBy == "path", hashBy == "clientip":
+	case strings.HasPrefix(hashBy, "header:") && len(hashBy) > len("header:"):
+	default:
+		return fmt.Errorf(`hashby must be "path", "clientip", or "header:<name>"; got %q`, hashBy)
+	}
+	return nil
+}
+
+// hashAttr returns the attribute of r given by c.HashBy, or "" if r hasn't got one (such as a missing header).
+func (c *ToConf) hashAttr(r *http.Request) string {
+	switch {
+	case c.HashBy == "path":
+		return r.URL.Path
+	case c.HashBy == "clientip":
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		return host
+	default:
+		return r.Header.Get(strings.TrimPrefix(c.HashBy, "header:"))
+	}
+}
+
+// hashAddr chooses the backend among c.Addrs for r by hashing the attribute of r given by c.HashBy, skipping
+// those that are unavailable (if unavailable is non-nil). A request without that attribute (such as a missing
+// header) goes to a random backend.
+func (c *ToConf) hashAddr(r *http.Request, unavailable func(string) bool) string {
+	key := c.hashAttr(r)
+	if key == "" {
+		addrs := c.Addrs
+		if unavailable != nil {
+			var available []string
+			for _, addr := range addrs {
+				if !unavailable(addr) {
+					available = append(available, addr)
+				}
+			}
+			if len(available) > 0 {
+				addrs = available
+			}
+		}
+		return addrs[rand.Intn(len(addrs))]
+	}
+	return c.ring.lookup(key, unavailable)
+}
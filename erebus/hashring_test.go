@@ -0,0 +1,103 @@
+package erebus
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHashRingConsistency(t *testing.T) {
+	addrs := []string{"a:80", "b:80", "c:80", "d:80"}
+	ring := newHashRing(addrs)
+	counts := make(map[string]int)
+	const keys = 10000
+	before := make([]string, keys)
+	for i := range before {
+		key := fmt.Sprintf("/item/%d", i)
+		before[i] = ring.lookup(key, nil)
+		if again := ring.lookup(key, nil); again != before[i] {
+			t.Fatalf("key %q mapped to %s and then %s", key, before[i], again)
+		}
+		counts[before[i]]++
+	}
+	for _, addr := range addrs {
+		if n := counts[addr]; n < keys/len(addrs)/2 {
+			t.Errorf("%s got %d of %d keys; want a roughly even share", addr, n, keys)
+		}
+	}
+
+	// Adding a backend only moves keys to it, and only about its share of them.
+	ring = newHashRing(append(addrs, "e:80"))
+	moved := 0
+	for i, old := range before {
+		addr := ring.lookup(fmt.Sprintf("/item/%d", i), nil)
+		if addr == old {
+			continue
+		}
+		moved++
+		if addr != "e:80" {
+			t.Fatalf("key moved from %s to %s when adding e:80", old, addr)
+		}
+	}
+	if moved > keys*2/5 {
+		t.Errorf("adding a fifth backend moved %d of %d keys; want about a fifth", moved, keys)
+	}
+
+	// Removing a backend only moves its own keys.
+	withoutA := newHashRing(addrs[1:])
+	for i, old := range before {
+		if addr := withoutA.lookup(fmt.Sprintf("/item/%d", i), nil); addr != old && old != "a:80" {
+			t.Fatalf("key moved from %s to %s when removing a:80", old, addr)
+		}
+	}
+
+	// Skipping an unavailable backend moves its keys just as removing it would.
+	ring = newHashRing(addrs)
+	unavailable := func(addr string) bool { return addr == "a:80" }
+	for i := range before {
+		key := fmt.Sprintf("/item/%d", i)
+		if got, want := ring.lookup(key, unavailable), withoutA.lookup(key, nil); got != want {
+			t.Fatalf("with a:80 unavailable, key %q mapped to %s; want %s", key, got, want)
+		}
+	}
+}
+
+func TestHashBy(t *testing.T) {
+	for _, hashBy := range []string{"path", "clientip", "header:X-Tenant"} {
+		to := &ToConf{Addrs: []string{"a:80", "b:80", "c:80"}, HashBy: hashBy}
+		if err := to.validate(); err != nil {
+			t.Fatal(err)
+		}
+		seen := make(map[string]bool)
+		for i := 0; i < 50; i++ {
+			key := fmt.Sprintf("key%d", i)
+			var addr string
+			for j := 0; j < 3; j++ {
+				r := httptest.NewRequest("GET", "/"+key, nil)
+				r.RemoteAddr = fmt.Sprintf("10.0.0.%d:%d", i, 1000+j)
+				r.Header.Set("X-Tenant", key)
+				got := to.CreateRequest(r).URL.Host
+				if j > 0 && got != addr {
+					t.Fatalf("hashby %s: key %s went to %s and then %s", hashBy, key, addr, got)
+				}
+				addr = got
+			}
+			seen[addr] = true
+		}
+		if len(seen) != 3 {
+			t.Errorf("hashby %s: 50 keys went to only %d backends", hashBy, len(seen))
+		}
+	}
+
+	for _, to := range []*ToConf{
+		{Addrs: []string{"a:80"}},
+		{Addrs: []string{"a:80"}, HashBy: "cookie"},
+		{Addrs: []string{"a:80"}, HashBy: "header:"},
+		{Addrs: []string{"a:80"}, HashBy: "path", Addr: "b:80"},
+		{Addr: "b:80", HashBy: "path"},
+	} {
+		if err := to.validate(); err == nil {
+			t.Errorf("addrs %q, hashby %q, addr %q: expected a validation error", to.Addrs, to.HashBy, to.Addr)
+		}
+	}
+}
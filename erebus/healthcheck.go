@@ -0,0 +1,229 @@
+package erebus
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A HealthCheckConf enables active health checks of a rule's backends (its Addr, CanaryAddr, and Addrs, but
+// not SRV names). Every Interval milliseconds (default 5000) each backend is sent a GET for Path (default
+// "/"), and it's down until a probe gets a 2xx or 3xx response within Timeout milliseconds (default 2000).
+//
+// While a backend is down, requests which would go to it are sent to one of the rule's other backends if any
+// is up (as with draining). If none is and the rule has an OnAllDown, that response is given straight away.
+type HealthCheckConf struct {
+	Path     string
+	Interval int
+	Timeout  int
+}
+
+func (c *HealthCheckConf) validate() error {
+	if c.Path == "" {
+		c.Path = "/"
+	}
+	if !strings.HasPrefix(c.Path, "/") {
+		return fmt.Errorf("healthcheck path must begin with /")
+	}
+	if c.Interval < 0 || c.Timeout < 0 {
+		return fmt.Errorf("healthcheck interval and timeout must not be negative")
+	}
+	if c.Interval == 0 {
+		c.Interval = 5000
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 2000
+	}
+	return nil
+}
+
+// defaultHealthCheckConcurrency is the number of simultaneous probes a HealthChecker makes by default.
+const defaultHealthCheckConcurrency = 10
+
+// A HealthChecker runs the health checks configured for the rules of a Proxy and records which backends are
+// down. Like a DrainSet, it may be shared between Proxies (such as the old and new Proxy across a
+// configuration reload). The zero value is ready to use. It is safe for concurrent use.
+type HealthChecker struct {
+	// The maximum number of probes in progress at once; if zero, 10. With many backends, probes wait their
+	// turn rather than all being sent together.
+	Concurrency int
+
+	mu   sync.RWMutex
+	down map[string]map[string]bool // The URLs of the failing checks by backend address
+}
+
+// Down reports whether the backend at addr failed its latest health check. (If rules check the same backend
+// differently, such as with different paths, it's down while any of those checks is failing.) A nil
+// HealthChecker has no backends down.
+func (h *HealthChecker) Down(addr string) bool {
+	if h == nil {
+		return false
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.down[addr]) > 0
+}
+
+// setDown records the result of checking t, reporting whether that changes whether its backend is down.
+func (h *HealthChecker) setDown(t healthTarget, down bool, reason string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	failing := h.down[t.addr]
+	if failing[t.url] == down {
+		return false
+	}
+	if down {
+		if failing == nil {
+			if h.down == nil {
+				h.down = make(map[string]map[string]bool)
+			}
+			failing = make(map[string]bool)
+			h.down[t.addr] = failing
+		}
+		failing[t.url] = true
+		LogWarnf("#red{Backend down:} %s (%s: %s)", t.addr, t.url, reason)
+		return len(failing) == 1
+	}
+	delete(failing, t.url)
+	if len(failing) > 0 {
+		return false
+	}
+	delete(h.down, t.addr)
+	LogInfof("#green{Backend up:} %s", t.addr)
+	return true
+}
+
+// forget drops the results of the checks (by URL) which are no longer made.
+func (h *HealthChecker) forget(checked map[string]bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for addr, failing := range h.down {
+		for url := range failing {
+			if !checked[url] {
+				delete(failing, url)
+			}
+		}
+		if len(failing) == 0 {
+			delete(h.down, addr)
+		}
+	}
+}
+
+// A healthTarget is a backend to be checked with the health check of one of the rules using it.
+type healthTarget struct {
+	rule *Conf
+	addr string
+	url  string
+}
+
+func healthTargets(p *Proxy) []healthTarget {
+	var targets []healthTarget
+	for _, rule := range p.Rules {
+		if rule.To == nil || rule.To.HealthCheck == nil {
+			continue
+		}
+		scheme := "http"
+		if rule.To.tlsConfig != nil {
+			scheme = "https"
+		}
+		for _, addr := range append([]string{rule.To.Addr, rule.To.CanaryAddr}, rule.To.Addrs...) {
+			if _, ok := srvName(addr); ok || addr == "" {
+				continue
+			}
+			url := scheme + "://" + addr + rule.To.HealthCheck.Path
+			targets = append(targets, healthTarget{rule: rule, addr: addr, url: url})
+		}
+	}
+	return targets
+}
+
+// Run runs health checks until ctx is done. The rules to check are those of the Proxy returned by current,
+// which is called often enough to follow configuration reloads.
+func (h *HealthChecker) Run(ctx context.Context, current func() *Proxy) {
+	n := h.Concurrency
+	if n <= 0 {
+		n = defaultHealthCheckConcurrency
+	}
+	// A fixed pool of workers makes the probes; the scheduler waits when they're all busy.
+	probes := make(chan func())
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for probe := range probes {
+				probe()
+			}
+		}()
+	}
+	defer func() {
+		close(probes)
+		wg.Wait()
+	}()
+
+	next := make(map[string]time.Time) // The next probe time by target URL
+	for {
+		p := current()
+		now := time.Now()
+		wake := now.Add(time.Second)
+		checked := make(map[string]bool)
+		for _, t := range healthTargets(p) {
+			t := t
+			checked[t.url] = true
+			due, ok := next[t.url]
+			if !ok || !now.Before(due) {
+				due = now.Add(time.Duration(t.rule.To.HealthCheck.Interval) * time.Millisecond)
+				next[t.url] = due
+				select {
+				case probes <- func() { h.probe(ctx, p, t) }:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if due.Before(wake) {
+				wake = due
+			}
+		}
+		for url := range next {
+			if !checked[url] {
+				delete(next, url)
+			}
+		}
+		h.forget(checked)
+		if !sleepContext(ctx, time.Until(wake)) {
+			return
+		}
+	}
+}
+
+func (h *HealthChecker) probe(ctx context.Context, p *Proxy, t healthTarget) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(t.rule.To.HealthCheck.Timeout)*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", t.url, nil)
+	if err != nil {
+		h.setDown(t, true, err.Error())
+		return
+	}
+	resp, err := p.transportFor(t.rule).RoundTrip(req)
+	if err != nil {
+		if ctx.Err() != nil && ctx.Err() != context.DeadlineExceeded {
+			return // Shutting down
+		}
+		h.setDown(t, true, err.Error())
+		return
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		h.setDown(t, true, fmt.Sprintf("status %d", resp.StatusCode))
+		return
+	}
+	if h.setDown(t, false, "") {
+		p.SlowStarts.restart(t.addr, t.rule.To.now())
+	}
+}
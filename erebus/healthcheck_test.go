@@ -0,0 +1,243 @@
+package erebus
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthCheckConcurrency(t *testing.T) {
+	const backends, concurrency = 12, 3
+	var (
+		active, maxActive int32
+		mu                sync.Mutex
+		probed            = make(map[string]bool)
+	)
+	var rules []string
+	for i := 0; i < backends; i++ {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := atomic.AddInt32(&active, 1)
+			defer atomic.AddInt32(&active, -1)
+			for {
+				max := atomic.LoadInt32(&maxActive)
+				if n <= max || atomic.CompareAndSwapInt32(&maxActive, max, n) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+			mu.Lock()
+			probed[r.Host] = true
+			mu.Unlock()
+		}))
+		defer backend.Close()
+		rules = append(rules, fmt.Sprintf(`{"from": {}, "to": {"addr": %q, "healthcheck": {"interval": 60000}}}`,
+			strings.TrimPrefix(backend.URL, "http://")))
+	}
+	proxy, err := NewProxyFromRules([]byte("[" + strings.Join(rules, ", ") + "]"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	captureLog(t)
+	h := &HealthChecker{Concurrency: concurrency}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		h.Run(ctx, func() *Proxy { return proxy })
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		mu.Lock()
+		n := len(probed)
+		mu.Unlock()
+		if n == backends {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d of %d backends were probed", n, backends)
+		}
+	}
+	if max := atomic.LoadInt32(&maxActive); max > concurrency {
+		t.Errorf("got up to %d simultaneous probes; want at most %d", max, concurrency)
+	}
+}
+
+func TestHealthCheckDown(t *testing.T) {
+	var canaryHealthy int32 = 1
+	backend := func(name string, healthy *int32) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/health" && atomic.LoadInt32(healthy) == 0 {
+				http.Error(w, "unhealthy", http.StatusServiceUnavailable)
+				return
+			}
+			io.WriteString(w, name)
+		}))
+	}
+	alwaysHealthy := int32(1)
+	stable := backend("stable", &alwaysHealthy)
+	defer stable.Close()
+	canary := backend("canary", &canaryHealthy)
+	defer canary.Close()
+	canaryAddr := strings.TrimPrefix(canary.URL, "http://")
+	proxy, server := startProxy(t, `[{"from": {}, "to": {"addr": "{{backend1}}", "canaryaddr": "{{backend2}}",
+	  "canarypercent": 100, "healthcheck": {"path": "/health", "interval": 10}}}]`, stable, canary)
+	captureLog(t)
+	proxy.Health = &HealthChecker{}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		proxy.Health.Run(ctx, func() *Proxy { return proxy })
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	get := func() string {
+		t.Helper()
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	waitFor := func(down bool) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); proxy.Health.Down(canaryAddr) != down; {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for the canary to be down = %t", down)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	if got := get(); got != "canary" {
+		t.Fatalf("with the canary healthy: got %q; want \"canary\"", got)
+	}
+	atomic.StoreInt32(&canaryHealthy, 0)
+	waitFor(true)
+	if got := get(); got != "stable" {
+		t.Errorf("with the canary down: got %q; want \"stable\"", got)
+	}
+	atomic.StoreInt32(&canaryHealthy, 1)
+	waitFor(false)
+	if got := get(); got != "canary" {
+		t.Errorf("with the canary up again: got %q; want \"canary\"", got)
+	}
+}
+
+func TestHealthCheckSharedBackend(t *testing.T) {
+	// Two rules check the same backend with different paths, only one of which passes.
+	var probes int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&probes, 1)
+		if r.URL.Path == "/bad" {
+			http.Error(w, "unhealthy", http.StatusServiceUnavailable)
+		}
+	}))
+	defer backend.Close()
+	addr := strings.TrimPrefix(backend.URL, "http://")
+	proxy, err := NewProxyFromRules([]byte(fmt.Sprintf(`[
+	  {"from": {"path": "/a"}, "to": {"addr": %[1]q, "healthcheck": {"path": "/good", "interval": 10}}},
+	  {"from": {"path": "/b"}, "to": {"addr": %[1]q, "healthcheck": {"path": "/bad", "interval": 10}}}
+	]`, addr)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs := captureLog(t)
+	h := &HealthChecker{}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		h.Run(ctx, func() *Proxy { return proxy })
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt32(&probes) < 20; {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for probes")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !h.Down(addr) {
+		t.Error("backend isn't down with one of its checks failing")
+	}
+	var downs, ups int
+	for _, line := range logLines(logs) {
+		if strings.Contains(line, "Backend down:") {
+			downs++
+		}
+		if strings.Contains(line, "Backend up:") {
+			ups++
+		}
+	}
+	if downs != 1 || ups != 0 {
+		t.Errorf("got %d down and %d up messages; want 1 and 0", downs, ups)
+	}
+}
+
+func TestHealthCheckOnAllDown(t *testing.T) {
+	var received int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			http.Error(w, "unhealthy", http.StatusServiceUnavailable)
+			return
+		}
+		atomic.AddInt32(&received, 1)
+	}))
+	defer backend.Close()
+	proxy, server := startProxy(t, `[{"from": {}, "to": {"addr": "{{backend1}}",
+	  "healthcheck": {"path": "/health", "interval": 10}, "onalldown": {"mode": "unavailable"}}}]`, backend)
+	captureLog(t)
+	proxy.Health = &HealthChecker{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go proxy.Health.Run(ctx, func() *Proxy { return proxy })
+	for deadline := time.Now().Add(5 * time.Second); !proxy.Health.Down(strings.TrimPrefix(backend.URL, "http://")); {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the backend to be down")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("with the only backend down: got status %d; want 503", resp.StatusCode)
+	}
+	if n := atomic.LoadInt32(&received); n != 0 {
+		t.Errorf("backend got %d requests while down; want 0", n)
+	}
+
+	for _, rules := range []string{
+		`[{"from": {}, "to": {"addr": "a:1", "healthcheck": {"path": "health"}}}]`,
+		`[{"from": {}, "to": {"addr": "a:1", "healthcheck": {"interval": -1}}}]`,
+	} {
+		if _, err := NewProxyFromRules([]byte(rules)); err == nil {
+			t.Errorf("%s: expected a validation error", rules)
+		}
+	}
+}
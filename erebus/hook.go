@@ -0,0 +1,111 @@
+package erebus
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// A HookConf names an external program which is run for each request proxied by a rule (but not for
+// responses served from the cache), to decide how the request is sent to the backend. The program receives a
+// JSON description of the request (a hookRequest) on stdin and writes its decisions (a hookResponse) to
+// stdout; if it exits unsuccessfully, writes anything other than a JSON object, or takes longer than Timeout
+// (in milliseconds; default 1000), the client gets a 502.
+//
+// The program runs with erebus's own privileges and environment, and is started afresh for every request;
+// it is suited to low-traffic rules and trusted scripts.
+type HookConf struct {
+	Command []string // The program and its arguments
+	Timeout int
+}
+
+func (c *HookConf) validate() error {
+	if len(c.Command) == 0 || c.Command[0] == "" {
+		return fmt.Errorf("a hook requires a command")
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("hook timeout must not be negative")
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 1000
+	}
+	return nil
+}
+
+// hookRequest is the description of a request given to a hook. Addr is the backend the request would be
+// sent to.
+type hookRequest struct {
+	Method     string      `json:"method"`
+	Host       string      `json:"host"`
+	Path       string      `json:"path"`
+	Query      string      `json:"query"`
+	RemoteAddr string      `json:"remoteaddr"`
+	Header     http.Header `json:"header"`
+	Addr       string      `json:"addr"`
+}
+
+// hookResponse holds a hook's decisions about a request. All the fields are optional.
+type hookResponse struct {
+	Addr          string            `json:"addr"`          // Send the request to this backend instead
+	SetHeaders    map[string]string `json:"setheaders"`    // Headers to set on the request to the backend
+	DeleteHeaders []string          `json:"deleteheaders"` // Headers to remove from the request to the backend
+}
+
+// apply runs the hook for out, the request to the backend made from the client request r, and modifies out
+// according to the hook's response.
+func (c *HookConf) apply(ctx context.Context, r, out *http.Request) error {
+	input, err := json.Marshal(&hookRequest{
+		Method:     r.Method,
+		Host:       r.Host,
+		Path:       r.URL.Path,
+		Query:      r.URL.RawQuery,
+		RemoteAddr: r.RemoteAddr,
+		Header:     out.Header,
+		Addr:       out.URL.Host,
+	})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(c.Timeout)*time.Millisecond)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, c.Command[0], c.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	// Don't wait on any children the program started, which may hold its output open after it's killed.
+	cmd.WaitDelay = 100 * time.Millisecond
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("hook timed out after %dms", c.Timeout)
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("hook failed: %s (%s)", err, msg)
+		}
+		return fmt.Errorf("hook failed: %s", err)
+	}
+	var resp hookResponse
+	if err := json.Unmarshal(output, &resp); err != nil {
+		return fmt.Errorf("bad hook output: %s", err)
+	}
+
+	// The headers may be shared with r (see CreateRequest).
+	header := make(http.Header, len(out.Header))
+	copyHeader(header, out.Header)
+	out.Header = header
+	for _, name := range resp.DeleteHeaders {
+		out.Header.Del(name)
+	}
+	for name, value := range resp.SetHeaders {
+		out.Header.Set(name, value)
+	}
+	if resp.Addr != "" {
+		out.URL.Host = resp.Addr
+	}
+	return nil
+}
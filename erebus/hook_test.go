@@ -0,0 +1,119 @@
+package erebus
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeHook writes a shell script to a temporary directory, returning its path.
+func writeHook(t *testing.T, script string) string {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh available for the hook script")
+	}
+	path := filepath.Join(t.TempDir(), "hook.sh")
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestHook(t *testing.T) {
+	input := filepath.Join(t.TempDir(), "input.json")
+	hook := writeHook(t, fmt.Sprintf(`cat > %s
+echo '{"setheaders": {"X-Hook": "added"}, "deleteheaders": ["X-Remove"]}'
+`, input))
+	backend := NewRecordingBackend()
+	rules := fmt.Sprintf(`[{"from": {}, "to": {"addr": "{{backend1}}", "hook": {"command": [%q]}}}]`, hook)
+	_, server := startProxy(t, rules, backend.Server)
+	captureLog(t)
+
+	req, err := http.NewRequest("GET", server.URL+"/a/b?c=d", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Remove", "secret")
+	req.Header.Set("X-Keep", "kept")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d; want 200", resp.StatusCode)
+	}
+	got := backend.Next(t)
+	for name, want := range map[string]string{"X-Hook": "added", "X-Remove": "", "X-Keep": "kept"} {
+		if v := got.Header.Get(name); v != want {
+			t.Errorf("backend got %s %q; want %q", name, v, want)
+		}
+	}
+
+	contents, err := ioutil.ReadFile(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hr hookRequest
+	if err := json.Unmarshal(contents, &hr); err != nil {
+		t.Fatalf("hook got bad input %q: %s", contents, err)
+	}
+	if hr.Method != "GET" || hr.Path != "/a/b" || hr.Query != "c=d" || hr.Header.Get("X-Remove") != "secret" ||
+		hr.Addr != strings.TrimPrefix(backend.URL, "http://") {
+		t.Errorf("hook got input %+v", hr)
+	}
+}
+
+func TestHookFailure(t *testing.T) {
+	for _, tt := range []struct {
+		script  string
+		timeout int
+		want    string
+	}{
+		{"echo 'no such backend' >&2; exit 1", 0, "no such backend"},
+		{"echo 'not json'", 0, "bad hook output"},
+		{"sleep 5", 50, "hook timed out"},
+	} {
+		hook := writeHook(t, tt.script)
+		to := &ToConf{Addr: "localhost:1", Hook: &HookConf{Command: []string{hook}, Timeout: tt.timeout}}
+		if err := to.validate(); err != nil {
+			t.Fatal(err)
+		}
+		r, err := http.NewRequest("GET", "http://example.com/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = to.Hook.apply(r.Context(), r, to.CreateRequest(r))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("hook %q: got error %v; want one containing %q", tt.script, err, tt.want)
+		}
+	}
+}
+
+func TestHookFailureResponse(t *testing.T) {
+	hook := writeHook(t, "echo 'db password is hunter2' >&2; exit 1")
+	backend := NewRecordingBackend()
+	rules := fmt.Sprintf(`[{"from": {}, "to": {"addr": "{{backend1}}", "hook": {"command": [%q]}}}]`, hook)
+	_, server := startProxy(t, rules, backend.Server)
+	logs := captureLog(t)
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusBadGateway || strings.Contains(string(body), "hunter2") {
+		t.Errorf("failed hook: got %d %q; want a 502 without the hook's stderr", resp.StatusCode, body)
+	}
+	if !strings.Contains(logs.String(), "hunter2") {
+		t.Errorf("got log %q; want it to include the hook's stderr", logs)
+	}
+}
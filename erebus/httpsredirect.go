@@ -0,0 +1,32 @@
+package erebus
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// RedirectToHTTPS responds to r with a permanent redirect to the https:// equivalent of its URL (the same host,
+// path, and query): a 301 for GET and HEAD requests, or a 308 (which clients must follow with the same method
+// and body) for others. If port is given and isn't 443, it's used as the port of the redirect target; otherwise
+// the target has no port. Requests without a Host get a 400.
+func RedirectToHTTPS(w http.ResponseWriter, r *http.Request, port string) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "" {
+		http.Error(w, "A Host header is required.", http.StatusBadRequest)
+		return
+	}
+	if port != "" && port != "443" {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]" // An IPv6 address
+	}
+	status := http.StatusMovedPermanently
+	if r.Method != "GET" && r.Method != "HEAD" {
+		status = http.StatusPermanentRedirect
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), status)
+}
@@ -0,0 +1,36 @@
+package erebus
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// backendsInFlight counts the requests in flight to each backend address. The zero value is ready to use.
+type backendsInFlight struct {
+	m sync.Map // addr -> *int64
+}
+
+func (b *backendsInFlight) add(addr string, delta int64) {
+	c, ok := b.m.Load(addr)
+	if !ok {
+		c, _ = b.m.LoadOrStore(addr, new(int64))
+	}
+	atomic.AddInt64(c.(*int64), delta)
+}
+
+// InFlight returns the number of requests currently being proxied by the rule, from sending the request to the
+// backend until the response has been relayed to the client.
+func (c *Conf) InFlight() int64 {
+	return atomic.LoadInt64(&c.inFlight)
+}
+
+// BackendsInFlight returns the number of requests currently in flight to each backend address that the Proxy
+// has sent requests to.
+func (p *Proxy) BackendsInFlight() map[string]int64 {
+	counts := make(map[string]int64)
+	p.backendsInFlight.m.Range(func(addr, c interface{}) bool {
+		counts[addr.(string)] = atomic.LoadInt64(c.(*int64))
+		return true
+	})
+	return counts
+}
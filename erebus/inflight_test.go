@@ -0,0 +1,65 @@
+package erebus
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInFlight(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer fast.Close()
+	proxy, server := startProxy(t, `[
+		{"from": {"path": "/slow"}, "to": {"addr": "{{backend1}}"}},
+		{"from": {}, "to": {"addr": "{{backend2}}"}}
+	]`, slow, fast)
+	slowAddr := strings.TrimPrefix(slow.URL, "http://")
+
+	waitFor := func(desc string, want int64) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			if proxy.Rules[0].InFlight() == want && proxy.BackendsInFlight()[slowAddr] == want {
+				return
+			}
+		}
+		t.Fatalf("%s: got %d in flight for the rule and %d for the backend; want %d", desc,
+			proxy.Rules[0].InFlight(), proxy.BackendsInFlight()[slowAddr], want)
+	}
+
+	const n = 5
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(server.URL + "/slow")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	waitFor("with requests blocked", n)
+
+	resp, err := http.Get(server.URL + "/fast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := proxy.Rules[0].InFlight(); got != n {
+		t.Errorf("after a request to another rule: got %d in flight for the slow rule; want %d", got, n)
+	}
+
+	close(release)
+	wg.Wait()
+	waitFor("after the requests finished", 0)
+}
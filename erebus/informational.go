@@ -0,0 +1,27 @@
+package erebus
+
+import (
+	"net/http"
+	"net/textproto"
+)
+
+// relayInformational returns a Got1xxResponse hook (for an httptrace.ClientTrace) which relays informational
+// responses from the backend, such as 103 Early Hints, to the client via w. 100 Continue is left to net/http,
+// which sends it itself when the request body is read.
+func relayInformational(w http.ResponseWriter) func(int, textproto.MIMEHeader) error {
+	return func(code int, header textproto.MIMEHeader) error {
+		if code == http.StatusContinue {
+			return nil
+		}
+		h := w.Header()
+		for k, vv := range header {
+			h[k] = vv
+		}
+		w.WriteHeader(code)
+		// The headers belong to the informational response only, not the final one.
+		for k := range header {
+			delete(h, k)
+		}
+		return nil
+	}
+}
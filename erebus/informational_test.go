@@ -0,0 +1,63 @@
+package erebus
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"testing"
+)
+
+func TestEarlyHints(t *testing.T) {
+	const link = "</style.css>; rel=preload; as=style"
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", link)
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Del("Link")
+		w.Write([]byte("hello"))
+	}))
+	_, server := startProxy(t, `[{"from": {}, "to": {"addr": "{{backend1}}"}}]`, backend)
+
+	var codes []int
+	var links []string
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			codes = append(codes, code)
+			links = append(links, header.Get("Link"))
+			return nil
+		},
+	}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), "GET",
+		server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if len(codes) != 1 || codes[0] != http.StatusEarlyHints || links[0] != link {
+		t.Errorf("got informational responses %v with Link headers %q; want a single 103 with Link %q",
+			codes, links, link)
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != "hello" {
+		t.Errorf("got final response %d %q; want 200 \"hello\"", resp.StatusCode, body)
+	}
+	if got := resp.Header.Get("Link"); got != "" {
+		t.Errorf("the final response has the early hints' Link header %q", got)
+	}
+}
+
+func TestStatusRecorderInformational(t *testing.T) {
+	rec := &statusRecorder{ResponseWriter: httptest.NewRecorder()}
+	rec.WriteHeader(http.StatusEarlyHints)
+	rec.WriteHeader(http.StatusOK)
+	if rec.status != http.StatusOK {
+		t.Errorf("got recorded status %d after early hints; want 200", rec.status)
+	}
+}
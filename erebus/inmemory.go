@@ -0,0 +1,95 @@
+package erebus
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+// A HandlerTransport is an http.RoundTripper which serves each request in-process using the handler for its
+// backend address (host:port), without opening any connections. It is meant for benchmarks and tests of a
+// Proxy which should measure erebus rather than the network. Responses are buffered in full before they are
+// returned, and rules with backend TLS settings don't use the Proxy's Transport, so they can't be served by a
+// HandlerTransport.
+//
+// A request for an address without a handler fails, as if the backend were unreachable.
+type HandlerTransport map[string]http.Handler
+
+func (t HandlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	h, ok := t[req.URL.Host]
+	if !ok {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, fmt.Errorf("no handler for backend %s", req.URL.Host)
+	}
+	// Make the request look like one received by a server.
+	sr := req.Clone(req.Context())
+	sr.RequestURI = req.URL.RequestURI()
+	sr.RemoteAddr = "127.0.0.1:1"
+	if sr.Host == "" {
+		sr.Host = req.URL.Host
+	}
+	if sr.Body == nil {
+		sr.Body = http.NoBody
+	}
+	w := &bufferedResponse{header: make(http.Header)}
+	h.ServeHTTP(w, sr)
+	sr.Body.Close()
+	w.WriteHeader(http.StatusOK) // In case the handler wrote nothing
+	resp := &http.Response{
+		Status:        strconv.Itoa(w.status) + " " + http.StatusText(w.status),
+		StatusCode:    w.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        w.sent,
+		Body:          ioutil.NopCloser(struct{ io.Reader }{&w.body}), // Hide WriteTo, as a network body would
+		ContentLength: int64(w.body.Len()),
+		Request:       req,
+	}
+	if req.Method == "HEAD" {
+		resp.ContentLength = -1
+	}
+	return resp, nil
+}
+
+// NewInMemoryProxy constructs a Proxy from a JSON configuration, as with NewProxyFromRules, whose requests to
+// backends are served by the given handlers (keyed by the backends' addresses) using a HandlerTransport. The
+// Proxy may be driven directly by calling ServeHTTP (with an httptest.ResponseRecorder, say), so benchmarks
+// can measure its per-request overhead without any sockets.
+func NewInMemoryProxy(jsonText []byte, backends map[string]http.Handler) (*Proxy, error) {
+	proxy, err := NewProxyFromRules(jsonText)
+	if err != nil {
+		return nil, err
+	}
+	proxy.Transport = HandlerTransport(backends)
+	return proxy, nil
+}
+
+// bufferedResponse is the http.ResponseWriter used by HandlerTransport.
+type bufferedResponse struct {
+	header http.Header // As modified by the handler
+	sent   http.Header // A copy of header made when the handler wrote the response headers
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedResponse) Header() http.Header { return w.header }
+
+func (w *bufferedResponse) WriteHeader(status int) {
+	if w.sent != nil {
+		return
+	}
+	w.status = status
+	w.sent = make(http.Header, len(w.header))
+	copyHeader(w.sent, w.header)
+}
+
+func (w *bufferedResponse) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(b)
+}
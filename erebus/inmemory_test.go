@@ -0,0 +1,85 @@
+package erebus
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestInMemoryProxy(t *testing.T) {
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Backend", "a")
+		w.WriteHeader(http.StatusCreated)
+		w.Header().Set("X-Late", "ignored")
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %s", r.Method, r.RequestURI, body)
+	})
+	rules := `[{"from": {"pathprefix": "/a/"}, "to": {"addr": "a:80"}},
+	           {"from": {"pathprefix": "/missing/"}, "to": {"addr": "missing:80"}}]`
+	proxy, err := NewInMemoryProxy([]byte(rules), map[string]http.Handler{"a:80": backend})
+	if err != nil {
+		t.Fatal(err)
+	}
+	captureLog(t)
+
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("POST", "/a/b?c=d", strings.NewReader("body")))
+	if w.Code != http.StatusCreated || w.Body.String() != "POST /a/b?c=d body" {
+		t.Errorf("got %d %q; want 201 \"POST /a/b?c=d body\"", w.Code, w.Body)
+	}
+	if got := w.Header().Get("X-Backend"); got != "a" {
+		t.Errorf("got X-Backend %q; want \"a\"", got)
+	}
+	if got := w.Header().Get("X-Late"); got != "" {
+		t.Errorf("got X-Late %q, set after the headers were written; want none", got)
+	}
+
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("GET", "/missing/", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("request to a backend without a handler: got status %d; want 502", w.Code)
+	}
+}
+
+// BenchmarkProxyOverhead measures the per-request cost of routing and proxying (with a trivial in-memory
+// backend) through a configuration with many rules.
+func BenchmarkProxyOverhead(b *testing.B) {
+	var rules []string
+	for i := 0; i < 50; i++ {
+		rules = append(rules, fmt.Sprintf(`{"from": {"host": "svc%d.example.com"}, "to": {"addr": "svc%d:80"}}`, i, i))
+	}
+	rules = append(rules, `{"from": {}, "to": {"addr": "default:80"}}`)
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})
+	proxy, err := NewInMemoryProxy([]byte("["+strings.Join(rules, ",")+"]"), map[string]http.Handler{
+		"svc0:80":    backend,
+		"default:80": backend,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for _, host := range []string{"svc0.example.com", "other.example.com"} {
+		b.Run(host, func(b *testing.B) {
+			r := httptest.NewRequest("GET", "/path?q=1", nil)
+			r.Host = host
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				w := httptest.NewRecorder()
+				proxy.ServeHTTP(w, r)
+				if w.Code != http.StatusOK {
+					b.Fatalf("got status %d; want 200", w.Code)
+				}
+			}
+		})
+	}
+}
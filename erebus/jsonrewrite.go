@@ -0,0 +1,500 @@
+package erebus
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// JSONRewriteConf rewrites the value at a JSON pointer (RFC 6901, such as "/user/internal_id") in JSON
+// response bodies. As an extension, a "*" in the pointer matches every element of an array (as in
+// "/items/*/internal_id"). Action is "delete", to remove the value, or "set", to replace it with Value.
+// Pointers to values which aren't present are ignored.
+type JSONRewriteConf struct {
+	Pointer string
+	Action  string
+	Value   json.RawMessage
+	tokens  []string
+}
+
+func validateJSONRewrites(rewrites []*JSONRewriteConf) error {
+	for _, c := range rewrites {
+		if c.Pointer != "" && !strings.HasPrefix(c.Pointer, "/") {
+			return fmt.Errorf("jsonrewrite pointer %q must be empty or start with /", c.Pointer)
+		}
+		c.tokens = nil
+		if c.Pointer != "" {
+			for _, tok := range strings.Split(c.Pointer[1:], "/") {
+				c.tokens = append(c.tokens, strings.NewReplacer("~1", "/", "~0", "~").Replace(tok))
+			}
+		}
+		switch c.Action {
+		case "delete":
+			if len(c.tokens) == 0 {
+				return fmt.Errorf("jsonrewrite cannot delete the whole document")
+			}
+		case "set":
+			if c.Value == nil || !json.Valid(c.Value) {
+				return fmt.Errorf("jsonrewrite action \"set\" requires a value")
+			}
+		default:
+			return fmt.Errorf("unknown jsonrewrite action: %q", c.Action)
+		}
+	}
+	return nil
+}
+
+// defaultJSONRewriteMaxBytes is the default ToConf.JSONRewriteMaxBytes: the most of a response body which is
+// buffered to apply the rewrites.
+const defaultJSONRewriteMaxBytes = 10 << 20
+
+// maxJSONRewriteDepth is the deepest nesting of arrays and objects a rewritten document may have (as for
+// encoding/json's decoding).
+const maxJSONRewriteDepth = 10000
+
+var (
+	errJSONRewriteTooLarge = errors.New("jsonrewrite: value to be buffered is too large")
+	errJSONRewriteTooDeep  = errors.New("jsonrewrite: document nested too deeply")
+)
+
+// shouldRewriteJSON reports whether the JSON rewrites of c apply to resp: the response must have a JSON content
+// type and must not be compressed.
+func (c *ToConf) shouldRewriteJSON(r *http.Request, resp *http.Response) bool {
+	if len(c.JSONRewrite) == 0 || r.Method == "HEAD" {
+		return false
+	}
+	if enc := resp.Header.Get("Content-Encoding"); enc != "" && !strings.EqualFold(enc, "identity") {
+		return false
+	}
+	t, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	t = strings.ToLower(t)
+	return err == nil && (t == "application/json" || strings.HasSuffix(t, "+json"))
+}
+
+// jsonRewriteReader applies JSON rewrites to the document read from an underlying reader, writing out each
+// part of it as soon as it's read. Only a value which the rewrites need whole is buffered, and then no more than
+// maxBytes of it. If the body isn't JSON at all, it's passed through unchanged; if it turns out to be invalid
+// (or too large to buffer) further on, reading fails there, so that the client doesn't get the rest
+// unrewritten.
+type jsonRewriteReader struct {
+	src  *errRecorder
+	raw  *bytes.Buffer // What's been read before the first token, in case it's not JSON
+	rw   *jsonRewriter
+	out  io.Reader // Set if the body is passed through
+	done bool
+	err  error
+}
+
+func newJSONRewriteReader(r io.Reader, rewrites []*JSONRewriteConf, maxBytes int) *jsonRewriteReader {
+	jr := &jsonRewriteReader{src: &errRecorder{r: r}, raw: new(bytes.Buffer)}
+	limit := &jsonBufferLimit{r: jr.src, max: int64(maxBytes)}
+	jr.rw = newJSONRewriter(io.TeeReader(limit, jr), rootJSONRewrites(rewrites), limit)
+	return jr
+}
+
+// Write records data read before the first token.
+func (jr *jsonRewriteReader) Write(p []byte) (int, error) {
+	if jr.raw != nil {
+		jr.raw.Write(p)
+	}
+	return len(p), nil
+}
+
+func (jr *jsonRewriteReader) Read(p []byte) (int, error) {
+	if jr.out != nil {
+		return jr.out.Read(p)
+	}
+	for jr.rw.out.Len() == 0 && jr.err == nil {
+		jr.err = jr.step()
+		if jr.out != nil {
+			return jr.out.Read(p)
+		}
+	}
+	if jr.rw.out.Len() > 0 {
+		return jr.rw.out.Read(p)
+	}
+	return 0, jr.err
+}
+
+// step rewrites the next part of the document, returning io.EOF once it's all done.
+func (jr *jsonRewriteReader) step() error {
+	if jr.done {
+		return io.EOF
+	}
+	err := jr.rw.step()
+	if jr.rw.tokens > 0 {
+		jr.raw = nil
+	}
+	if jr.src.err != nil && jr.src.err != io.EOF {
+		return jr.src.err
+	}
+	switch {
+	case err == io.EOF:
+		// There must be nothing after the document (besides whitespace).
+		if _, err := jr.rw.dec.Token(); err != io.EOF {
+			if err == nil {
+				err = fmt.Errorf("jsonrewrite: trailing data after the document")
+			}
+			return err
+		}
+		jr.rw.out.WriteByte('\n')
+		jr.done = true
+		return nil
+	case err != nil && jr.raw != nil:
+		jr.out = io.MultiReader(jr.raw, jr.src)
+		return nil
+	}
+	return err
+}
+
+// A jsonPathRewrite is a rewrite together with the tokens of its pointer which remain to be matched.
+type jsonPathRewrite struct {
+	c      *JSONRewriteConf
+	tokens []string
+}
+
+func rootJSONRewrites(rewrites []*JSONRewriteConf) []jsonPathRewrite {
+	prs := make([]jsonPathRewrite, len(rewrites))
+	for i, c := range rewrites {
+		prs[i] = jsonPathRewrite{c, c.tokens}
+	}
+	return prs
+}
+
+// A jsonRewriter rewrites a JSON document token by token, following the current pointer path with a stack of
+// the enclosing arrays and objects and the rewrites which may apply within each.
+type jsonRewriter struct {
+	dec      *json.Decoder
+	rewrites []jsonPathRewrite // Those applying to the whole document
+	limit    *jsonBufferLimit  // If non-nil, limits buffering
+	out      bytes.Buffer
+	stack    []jsonFrame
+	started  bool
+	tokens   int // The number of tokens read so far
+}
+
+type jsonFrame struct {
+	array    bool
+	rewrites []jsonPathRewrite // Those which may apply to the members or elements
+	index    int               // The index of the next element (in the original array)
+	key      string            // The key of the next member
+	n        int               // The number of members or elements written
+}
+
+func newJSONRewriter(r io.Reader, rewrites []jsonPathRewrite, limit *jsonBufferLimit) *jsonRewriter {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	return &jsonRewriter{dec: dec, rewrites: rewrites, limit: limit}
+}
+
+func (rw *jsonRewriter) token() (json.Token, error) {
+	tok, err := rw.dec.Token()
+	if err == nil {
+		rw.tokens++
+	}
+	return tok, err
+}
+
+// step reads and rewrites the next value or the end of the current array or object, returning io.EOF once the
+// document is done.
+func (rw *jsonRewriter) step() error {
+	if len(rw.stack) == 0 {
+		if rw.started {
+			return io.EOF
+		}
+		rw.started = true
+		return rw.value(rw.rewrites)
+	}
+	f := &rw.stack[len(rw.stack)-1]
+	if !rw.dec.More() {
+		tok, err := rw.token() // The closing ] or }
+		if err != nil {
+			return err
+		}
+		rw.out.WriteString(tok.(json.Delim).String())
+		rw.stack = rw.stack[:len(rw.stack)-1]
+		return nil
+	}
+	var rewrites []jsonPathRewrite
+	if f.array {
+		index := strconv.Itoa(f.index)
+		f.index++
+		for _, pr := range f.rewrites {
+			if pr.tokens[0] == "*" || pr.tokens[0] == index {
+				rewrites = append(rewrites, jsonPathRewrite{pr.c, pr.tokens[1:]})
+			}
+		}
+		return rw.value(rewrites)
+	}
+	tok, err := rw.token()
+	if err != nil {
+		return err
+	}
+	f.key = tok.(string)
+	for _, pr := range f.rewrites {
+		if pr.tokens[0] == f.key {
+			rewrites = append(rewrites, jsonPathRewrite{pr.c, pr.tokens[1:]})
+		}
+	}
+	return rw.value(rewrites)
+}
+
+// value reads and rewrites the next value, to which rewrites apply.
+func (rw *jsonRewriter) value(rewrites []jsonPathRewrite) error {
+	// The value itself is deleted or replaced by the first rewrite pointing at it which deletes it or by the
+	// last which sets it (with any later rewrites applied to the new value).
+	replace := -1
+	for i, pr := range rewrites {
+		if len(pr.tokens) > 0 {
+			continue
+		}
+		if pr.c.Action == "delete" {
+			return rw.skip()
+		}
+		replace = i
+	}
+	if replace >= 0 {
+		if err := rw.skip(); err != nil {
+			return err
+		}
+		v := rewrites[replace].c.apply(nil, nil)
+		for _, pr := range rewrites[replace+1:] {
+			v = pr.c.apply(v, pr.tokens)
+		}
+		rw.separate()
+		return rw.write(v)
+	}
+
+	tok, err := rw.token()
+	if err != nil {
+		return err
+	}
+	rw.separate()
+	delim, ok := tok.(json.Delim)
+	if !ok {
+		return rw.write(tok)
+	}
+	if delim == '[' && needsBuffering(rewrites) {
+		return rw.bufferArray(rewrites)
+	}
+	if len(rw.stack) >= maxJSONRewriteDepth {
+		return errJSONRewriteTooDeep
+	}
+	rw.out.WriteString(delim.String())
+	rw.stack = append(rw.stack, jsonFrame{array: delim == '[', rewrites: rewrites})
+	return nil
+}
+
+// separate writes what comes before a value: a comma and, in an object, the value's key.
+func (rw *jsonRewriter) separate() {
+	if len(rw.stack) == 0 {
+		return
+	}
+	f := &rw.stack[len(rw.stack)-1]
+	if f.n > 0 {
+		rw.out.WriteByte(',')
+	}
+	f.n++
+	if !f.array {
+		rw.write(f.key)
+		rw.out.WriteByte(':')
+	}
+}
+
+func (rw *jsonRewriter) write(v interface{}) error {
+	enc := json.NewEncoder(&rw.out)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	rw.out.Truncate(rw.out.Len() - 1) // Encode adds a newline
+	return nil
+}
+
+// skip reads past the next value.
+func (rw *jsonRewriter) skip() error {
+	depth := 0
+	for {
+		tok, err := rw.token()
+		if err != nil {
+			return err
+		}
+		if delim, ok := tok.(json.Delim); ok {
+			if delim == '[' || delim == '{' {
+				depth++
+			} else {
+				depth--
+			}
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+// needsBuffering reports whether rewrites must see the whole of an array to which they apply: if one deletes an
+// element, the indexes used by those after it refer to the array without that element.
+func needsBuffering(rewrites []jsonPathRewrite) bool {
+	deleted := false
+	for _, pr := range rewrites {
+		if pr.tokens[0] == "*" {
+			continue
+		}
+		if deleted {
+			return true
+		}
+		deleted = len(pr.tokens) == 1 && pr.c.Action == "delete"
+	}
+	return false
+}
+
+// bufferArray reads the rest of an array, whose [ has been written, and writes it with the rewrites applied one
+// after another.
+func (rw *jsonRewriter) bufferArray(rewrites []jsonPathRewrite) error {
+	if rw.limit != nil {
+		rw.limit.start()
+		defer rw.limit.stop()
+	}
+	type element struct {
+		raw      json.RawMessage
+		rewrites []jsonPathRewrite
+	}
+	var elems []element
+	for rw.dec.More() {
+		var raw json.RawMessage
+		if err := rw.dec.Decode(&raw); err != nil {
+			return err
+		}
+		elems = append(elems, element{raw: raw})
+	}
+	if rw.limit != nil && rw.limit.exceeded() {
+		return errJSONRewriteTooLarge
+	}
+	if _, err := rw.token(); err != nil { // The closing ]
+		return err
+	}
+	for _, pr := range rewrites {
+		kept := elems[:0]
+		for i, e := range elems {
+			if pr.tokens[0] != "*" && pr.tokens[0] != strconv.Itoa(i) {
+				kept = append(kept, e)
+				continue
+			}
+			if len(pr.tokens) == 1 && pr.c.Action == "delete" {
+				continue
+			}
+			e.rewrites = append(e.rewrites, jsonPathRewrite{pr.c, pr.tokens[1:]})
+			kept = append(kept, e)
+		}
+		elems = kept
+	}
+	rw.out.WriteByte('[')
+	for i, e := range elems {
+		if i > 0 {
+			rw.out.WriteByte(',')
+		}
+		sub := newJSONRewriter(bytes.NewReader(e.raw), e.rewrites, nil)
+		for {
+			err := sub.step()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+		rw.out.Write(sub.out.Bytes())
+	}
+	rw.out.WriteByte(']')
+	return nil
+}
+
+// A jsonBufferLimit reads from r, but while a value is being buffered, it fails with errJSONRewriteTooLarge
+// once more than max bytes have been read.
+type jsonBufferLimit struct {
+	r         io.Reader
+	max       int64
+	buffering bool
+	n         int64 // The number of bytes read while buffering
+}
+
+func (l *jsonBufferLimit) start() { l.buffering, l.n = true, 0 }
+func (l *jsonBufferLimit) stop()  { l.buffering = false }
+
+func (l *jsonBufferLimit) exceeded() bool { return l.buffering && l.n > l.max }
+
+func (l *jsonBufferLimit) Read(p []byte) (int, error) {
+	if !l.buffering {
+		return l.r.Read(p)
+	}
+	if l.exceeded() {
+		return 0, errJSONRewriteTooLarge
+	}
+	if int64(len(p)) > l.max-l.n+1 {
+		p = p[:l.max-l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	return n, err
+}
+
+// apply applies the rewrite c to v at the remaining pointer tokens, returning the new value.
+func (c *JSONRewriteConf) apply(v interface{}, tokens []string) interface{} {
+	if len(tokens) == 0 {
+		var value interface{}
+		dec := json.NewDecoder(bytes.NewReader(c.Value))
+		dec.UseNumber()
+		dec.Decode(&value) // Checked by validateJSONRewrites
+		return value
+	}
+	tok, last := tokens[0], len(tokens) == 1
+	switch v := v.(type) {
+	case map[string]interface{}:
+		child, ok := v[tok]
+		if !ok {
+			return v
+		}
+		if last && c.Action == "delete" {
+			delete(v, tok)
+		} else {
+			v[tok] = c.apply(child, tokens[1:])
+		}
+		return v
+	case []interface{}:
+		var kept []interface{}
+		for i, child := range v {
+			if tok != "*" && tok != strconv.Itoa(i) {
+				kept = append(kept, child)
+				continue
+			}
+			if !(last && c.Action == "delete") {
+				kept = append(kept, c.apply(child, tokens[1:]))
+			}
+		}
+		if kept == nil {
+			kept = []interface{}{} // Encode as [], not null
+		}
+		return kept
+	}
+	return v
+}
+
+// errRecorder records the first error from reading r.
+type errRecorder struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errRecorder) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil && e.err == nil {
+		e.err = err
+	}
+	return n, err
+}
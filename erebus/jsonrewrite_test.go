@@ -0,0 +1,222 @@
+package erebus
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestJSONRewriteReader(t *testing.T) {
+	rewrites := []*JSONRewriteConf{
+		{Pointer: "/internal_id", Action: "delete"},
+		{Pointer: "/items/*/secret", Action: "delete"},
+		{Pointer: "/items/0/name", Action: "set", Value: []byte(`"first"`)},
+		{Pointer: "/a~1b", Action: "set", Value: []byte(`{"x": 1}`)},
+	}
+	if err := validateJSONRewrites(rewrites); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		in   string
+		want string
+	}{
+		{`{"internal_id": 7, "id": 12345678901234567890}`, `{"id":12345678901234567890}`},
+		{`{"items": [{"name": "a", "secret": 1}, {"name": "b", "secret": 2}]}`,
+			`{"items":[{"name":"first"},{"name":"b"}]}`},
+		{`{"a/b": null, "html": "<b>"}`, `{"a/b":{"x":1},"html":"<b>"}`},
+		{`{"items": "not an array"}`, `{"items":"not an array"}`},
+		{`[1, 2]`, `[1,2]`},
+		{`{"b": 1, "a": 2, "internal_id": 3}`, `{"b":1,"a":2}`},
+		// Something that isn't JSON at all is passed on unchanged.
+		{`not json`, `not json`},
+	} {
+		in := iotest.OneByteReader(strings.NewReader(tc.in))
+		r := newJSONRewriteReader(in, rewrites, defaultJSONRewriteMaxBytes)
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.TrimSuffix(string(got), "\n") != tc.want {
+			t.Errorf("rewriting %s: got %s; want %s", tc.in, got, tc.want)
+		}
+	}
+
+	// A document which turns out to be invalid is cut off.
+	for _, tc := range []struct {
+		in   string
+		want string
+	}{
+		{`{"internal_id": 7, "id": 1`, `{"id":1`},
+		{`{"id": 7} {"id": 8}`, `{"id":7}`},
+		{`{"items": [{"name": "a"} {}]}`, `{"items":[{"name":"first"}`},
+	} {
+		got, err := ioutil.ReadAll(newJSONRewriteReader(strings.NewReader(tc.in), rewrites, defaultJSONRewriteMaxBytes))
+		if err == nil {
+			t.Errorf("rewriting %s: got no error", tc.in)
+		}
+		if string(got) != tc.want {
+			t.Errorf("rewriting %s: got %s before the error; want %s", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestJSONRewriteOrder(t *testing.T) {
+	for _, tc := range []struct {
+		rewrites []*JSONRewriteConf
+		in       string
+		want     string
+	}{
+		{
+			// The second rewrite sees the array without its first element.
+			[]*JSONRewriteConf{
+				{Pointer: "/items/0", Action: "delete"},
+				{Pointer: "/items/0/name", Action: "set", Value: []byte(`"first"`)},
+			},
+			`{"items": [{"name": "a"}, {"name": "b", "x": [1]}, {"name": "c"}], "z": 1}`,
+			`{"items":[{"name":"first","x":[1]},{"name":"c"}],"z":1}`,
+		},
+		{
+			[]*JSONRewriteConf{
+				{Pointer: "/items/1", Action: "delete"},
+				{Pointer: "/items/1", Action: "delete"},
+			},
+			`{"items": [1, 2, 3, 4]}`,
+			`{"items":[1,4]}`,
+		},
+		{
+			// Later rewrites apply to a value that's been set.
+			[]*JSONRewriteConf{
+				{Pointer: "/a/x", Action: "set", Value: []byte(`1`)},
+				{Pointer: "/a", Action: "set", Value: []byte(`{"x": 2, "y": 3}`)},
+				{Pointer: "/a/y", Action: "delete"},
+			},
+			`{"a": null}`,
+			`{"a":{"x":2}}`,
+		},
+		{
+			[]*JSONRewriteConf{
+				{Pointer: "/a", Action: "delete"},
+				{Pointer: "/a", Action: "set", Value: []byte(`1`)},
+			},
+			`{"a": {}, "b": {}}`,
+			`{"b":{}}`,
+		},
+		{
+			[]*JSONRewriteConf{{Pointer: "", Action: "set", Value: []byte(`{"replaced": true}`)}},
+			`[{"a": 1}]`,
+			`{"replaced":true}`,
+		},
+	} {
+		if err := validateJSONRewrites(tc.rewrites); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(newJSONRewriteReader(strings.NewReader(tc.in), tc.rewrites, 1000))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.TrimSuffix(string(got), "\n") != tc.want {
+			t.Errorf("rewriting %s: got %s; want %s", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestJSONRewriteStreaming(t *testing.T) {
+	rewrites := []*JSONRewriteConf{{Pointer: "/items/*/secret", Action: "delete"}}
+	if err := validateJSONRewrites(rewrites); err != nil {
+		t.Fatal(err)
+	}
+	pr, pw := io.Pipe()
+	r := newJSONRewriteReader(pr, rewrites, 100)
+	go io.WriteString(pw, `{"items": [{"secret": 1, "id": 1}, `)
+	var got []byte
+	for !bytes.Contains(got, []byte(`"id":1}`)) {
+		buf := make([]byte, 100)
+		n, err := r.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if want := `{"items":[{"id":1}`; string(got) != want {
+		t.Errorf("before the document was finished, got %s; want %s", got, want)
+	}
+
+	// Only values which must be buffered are subject to the limit.
+	go func() {
+		io.WriteString(pw, `{"id": 2, "pad": "`+strings.Repeat("x", 1000)+`"}]}`)
+		pw.Close()
+	}()
+	rest, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(rest), `"}]}`+"\n") {
+		t.Errorf("got %s at the end of the document", rest)
+	}
+	buffered := []*JSONRewriteConf{
+		{Pointer: "/items/0", Action: "delete"},
+		{Pointer: "/items/0/secret", Action: "delete"},
+	}
+	if err := validateJSONRewrites(buffered); err != nil {
+		t.Fatal(err)
+	}
+	big := `{"items": [{}, {"pad": "` + strings.Repeat("x", 10000) + `"}]}`
+	_, err = ioutil.ReadAll(newJSONRewriteReader(strings.NewReader(big), buffered, 100))
+	if err != errJSONRewriteTooLarge {
+		t.Errorf("buffering more than the limit: got error %v; want %v", err, errJSONRewriteTooLarge)
+	}
+}
+
+func TestJSONRewriteValidation(t *testing.T) {
+	for _, c := range []*JSONRewriteConf{
+		{Pointer: "internal_id", Action: "delete"},
+		{Pointer: "", Action: "delete"},
+		{Pointer: "/a", Action: "set"},
+		{Pointer: "/a", Action: "set", Value: []byte(`{`)},
+		{Pointer: "/a", Action: "redact"},
+	} {
+		if err := validateJSONRewrites([]*JSONRewriteConf{c}); err == nil {
+			t.Errorf("jsonrewrite %+v: expected a validation error", c)
+		}
+	}
+	to := &ToConf{Addr: "localhost:1", JSONRewriteMaxBytes: -1}
+	if err := to.validate(); err == nil {
+		t.Error("expected an error for a negative jsonrewritemaxbytes")
+	}
+}
+
+func TestJSONRewrite(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		w.Write([]byte(`{"user": {"name": "ann", "internal_id": 42}}`))
+	}))
+	rules := `[{"from": {}, "to": {"addr": "{{backend1}}",
+	            "jsonrewrite": [{"pointer": "/user/internal_id", "action": "delete"}]}}]`
+	_, server := startProxy(t, rules, backend)
+	captureLog(t)
+
+	for _, tc := range []struct {
+		contentType string
+		want        string
+	}{
+		{"application/json", `{"user":{"name":"ann"}}` + "\n"},
+		{"application/problem+json; charset=utf-8", `{"user":{"name":"ann"}}` + "\n"},
+		{"text/plain", `{"user": {"name": "ann", "internal_id": 42}}`},
+	} {
+		resp, err := http.Get(server.URL + "/?type=" + url.QueryEscape(tc.contentType))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != tc.want {
+			t.Errorf("Content-Type %s: got body %q; want %q", tc.contentType, body, tc.want)
+		}
+	}
+}
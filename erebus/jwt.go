@@ -0,0 +1,118 @@
+package erebus
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// JWTClaimConf matches requests whose bearer JWT (in the Authorization header) has the claim Name with the
+// given Value. A claim which is a list matches if any of its elements is Value.
+//
+// If Secret is given, the token must be signed with it using HS256; otherwise the signature is NOT checked,
+// so the claim should only be trusted if something in front of erebus has already verified the token. In
+// either case, expired tokens (per the exp claim) are rejected.
+//
+// If Required is set, a request which otherwise matches the rule but lacks a valid token gets a 401 (rather
+// than falling through to later rules).
+type JWTClaimConf struct {
+	Name     string
+	Value    string
+	Secret   string
+	Required bool
+}
+
+func (c *JWTClaimConf) validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("a jwtclaim must have a name")
+	}
+	return nil
+}
+
+func (c *JWTClaimConf) matches(r *http.Request) bool {
+	claims, err := c.claims(r)
+	if err != nil {
+		return false
+	}
+	switch v := claims[c.Name].(type) {
+	case []interface{}:
+		for _, elem := range v {
+			if claimString(elem) == c.Value {
+				return true
+			}
+		}
+		return false
+	case nil:
+		return false
+	default:
+		return claimString(v) == c.Value
+	}
+}
+
+func claimString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return fmt.Sprint(v)
+}
+
+var errNoBearerToken = errors.New("no bearer token")
+
+// claims decodes (and, if there is a Secret, verifies) the bearer token of r, returning its claims.
+func (c *JWTClaimConf) claims(r *http.Request) (map[string]interface{}, error) {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "bearer ") {
+		return nil, errNoBearerToken
+	}
+	parts := strings.Split(strings.TrimSpace(auth[7:]), ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed JWT")
+	}
+	if c.Secret != "" {
+		if err := verifyHS256(parts, c.Secret); err != nil {
+			return nil, err
+		}
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWT payload: %s", err)
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("malformed JWT payload: %s", err)
+	}
+	if exp, ok := claims["exp"].(float64); ok && time.Now().After(time.Unix(int64(exp), 0)) {
+		return nil, fmt.Errorf("expired JWT")
+	}
+	return claims, nil
+}
+
+func verifyHS256(parts []string, secret string) error {
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return fmt.Errorf("malformed JWT header: %s", err)
+	}
+	var h struct{ Alg string }
+	if err := json.Unmarshal(header, &h); err != nil {
+		return fmt.Errorf("malformed JWT header: %s", err)
+	}
+	if h.Alg != "HS256" {
+		return fmt.Errorf("unsupported JWT algorithm %q", h.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("malformed JWT signature: %s", err)
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return fmt.Errorf("invalid JWT signature")
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package erebus
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func makeJWT(t *testing.T, claims map[string]interface{}, secret string) string {
+	t.Helper()
+	enc := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	s := enc(map[string]string{"alg": "HS256", "typ": "JWT"}) + "." + enc(claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(s))
+	return s + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestJWTClaim(t *testing.T) {
+	admin := NewRecordingBackend()
+	other := NewRecordingBackend()
+	rules := `[{"from": {"pathprefix": "/admin/", "jwtclaim": {"name": "role", "value": "admin", "required": true}},
+	            "to": {"addr": "{{backend1}}"}},
+	           {"from": {"jwtclaim": {"name": "groups", "value": "beta", "secret": "s3cret"}},
+	            "to": {"addr": "{{backend1}}"}},
+	           {"from": {}, "to": {"addr": "{{backend2}}"}}]`
+	_, server := startProxy(t, rules, admin.Server, other.Server)
+
+	type claims = map[string]interface{}
+	expired := time.Now().Add(-time.Hour).Unix()
+	for _, tc := range []struct {
+		desc       string
+		path       string
+		token      string
+		wantStatus int
+		wantAdmin  bool
+	}{
+		{"matching claim", "/admin/x", makeJWT(t, claims{"role": "admin"}, "k"), 200, true},
+		{"non-matching claim", "/x", makeJWT(t, claims{"role": "user"}, "k"), 200, false},
+		{"required claim mismatch falls through", "/admin/x", makeJWT(t, claims{"role": "user"}, "k"), 200, false},
+		{"required token missing", "/admin/x", "", 401, false},
+		{"required token malformed", "/admin/x", "not-a-jwt", 401, false},
+		{"required token expired", "/admin/x", makeJWT(t, claims{"role": "admin", "exp": expired}, "k"), 401, false},
+		{"list claim with valid signature", "/x", makeJWT(t, claims{"groups": []string{"a", "beta"}}, "s3cret"), 200, true},
+		{"list claim with bad signature", "/x", makeJWT(t, claims{"groups": []string{"beta"}}, "wrong"), 200, false},
+	} {
+		req, err := http.NewRequest("GET", server.URL+tc.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.wantStatus {
+			t.Errorf("%s: got status %d; want %d", tc.desc, resp.StatusCode, tc.wantStatus)
+			continue
+		}
+		if tc.wantStatus == 401 {
+			if got := resp.Header.Get("WWW-Authenticate"); got != "Bearer" {
+				t.Errorf("%s: got WWW-Authenticate %q; want %q", tc.desc, got, "Bearer")
+			}
+			continue
+		}
+		if tc.wantAdmin {
+			admin.Next(t)
+		} else {
+			other.Next(t)
+		}
+	}
+
+	if err := (&FromConf{JWTClaim: &JWTClaimConf{Value: "x"}}).validate(nil); err == nil {
+		t.Error("expected an error for a jwtclaim without a name")
+	}
+}
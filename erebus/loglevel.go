@@ -0,0 +1,57 @@
+package erebus
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// A LogLevel controls which messages are logged: those at the level or any more severe level.
+type LogLevel int32
+
+const (
+	LogLevelError LogLevel = iota // Failures, such as unreachable backends and panics
+	LogLevelWarn                  // Problems which don't cause failures, such as slow requests
+	LogLevelInfo                  // Routine events, including the access log (the default)
+	LogLevelDebug                 // Detail for diagnosing problems
+)
+
+var logLevelNames = []string{"error", "warn", "info", "debug"}
+
+func (l LogLevel) String() string {
+	if l < 0 || int(l) >= len(logLevelNames) {
+		return fmt.Sprintf("LogLevel(%d)", l)
+	}
+	return logLevelNames[l]
+}
+
+// ParseLogLevel parses the name of a log level: error, warn, info, or debug.
+func ParseLogLevel(s string) (LogLevel, error) {
+	for i, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return LogLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+var logLevel = int32(LogLevelInfo)
+
+// SetLogLevel sets the level of the messages logged by the package (and by the Log*f functions).
+func SetLogLevel(l LogLevel) { atomic.StoreInt32(&logLevel, int32(l)) }
+
+// logEnabled reports whether messages at level l are logged.
+func logEnabled(l LogLevel) bool { return l <= LogLevel(atomic.LoadInt32(&logLevel)) }
+
+func logAt(l LogLevel, format string, args ...interface{}) {
+	if logEnabled(l) {
+		LogCprintf(format, args...)
+	}
+}
+
+// LogErrorf, LogWarnf, LogInfof, and LogDebugf are like LogCprintf, but only log if the level set by
+// SetLogLevel permits.
+func LogErrorf(format string, args ...interface{}) { logAt(LogLevelError, format, args...) }
+func LogWarnf(format string, args ...interface{})  { logAt(LogLevelWarn, format, args...) }
+func LogInfof(format string, args ...interface{})  { logAt(LogLevelInfo, format, args...) }
+func LogDebugf(format string, args ...interface{}) { logAt(LogLevelDebug, format, args...) }
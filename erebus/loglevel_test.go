@@ -0,0 +1,60 @@
+package erebus
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogLevel(t *testing.T) {
+	proxy, err := NewProxyFromRules([]byte(`[{"from": {}, "to": {"addr": "localhost:1", "maxretries": 1}}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.Transport = &failingTransport{n: 100}
+	proxy.SlowThreshold = time.Nanosecond
+	defer SetLogLevel(LogLevelInfo)
+
+	for _, tc := range []struct {
+		level string
+		want  []string // Messages which should be logged, among the access log, slow request, error, and retry
+	}{
+		{"error", []string{"backend error"}},
+		{"warn", []string{"backend error", "Slow request"}},
+		{"info", []string{"backend error", "Slow request", "→"}},
+		{"debug", []string{"backend error", "Slow request", "→", "Retrying"}},
+	} {
+		level, err := ParseLogLevel(tc.level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		SetLogLevel(level)
+		logs := captureLog(t)
+		proxy.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		for _, msg := range []string{"backend error", "Slow request", "→", "Retrying"} {
+			want := false
+			for _, m := range tc.want {
+				want = want || m == msg
+			}
+			if got := strings.Contains(logs.String(), msg); got != want {
+				t.Errorf("level %s: message %q logged: %t; want %t", tc.level, msg, got, want)
+			}
+		}
+	}
+
+	// The CLF access log is also at the info level.
+	proxy.LogFormat = LogFormatCLF
+	proxy.Transport = http.DefaultTransport
+	SetLogLevel(LogLevelWarn)
+	logs := captureLog(t)
+	proxy.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if strings.Contains(logs.String(), `"GET / HTTP/1.1"`) {
+		t.Errorf("level warn: got CLF access log %q", logs)
+	}
+
+	if _, err := ParseLogLevel("verbose"); err == nil {
+		t.Error("expected an error for an unknown log level")
+	}
+}
@@ -0,0 +1,108 @@
+package erebus
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// errConnTooOld is returned when writing to a backend connection which has exceeded its maximum age.
+var errConnTooOld = errors.New("backend connection exceeded its maximum age")
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// maxAgeDial wraps dial so that the connections it makes are retired once they are older than maxAge.
+func maxAgeDial(dial dialFunc, maxAge time.Duration, now func() time.Time) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		mc := &maxAgeConn{Conn: c, expires: now().Add(maxAge), now: now}
+		mc.timer = time.AfterFunc(maxAge, mc.closeIfIdle)
+		return mc, nil
+	}
+}
+
+// A maxAgeConn is a net.Conn which is retired once it expires. The connection can only be closed safely while
+// it's idle in the transport's pool (the transport then discards it), so requests report when they start and
+// stop using it (see trackConnAge): it's closed when it expires if it's idle, or else once its current request
+// is done.
+//
+// As a last resort, the connection refuses writes after it expires, closing itself instead. This only happens
+// if the transport hands out an expired connection before it could be closed (or without telling the request
+// trace). Nothing will have been written, so the transport retries the request on a fresh connection, but it
+// can't do that for requests with bodies; these fail as though the backend had closed the connection.
+type maxAgeConn struct {
+	net.Conn
+	expires time.Time
+	now     func() time.Time
+	timer   *time.Timer
+
+	mu   sync.Mutex
+	busy bool
+}
+
+func (c *maxAgeConn) Write(b []byte) (int, error) {
+	if !c.now().Before(c.expires) {
+		c.Close()
+		return 0, errConnTooOld
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *maxAgeConn) Close() error {
+	c.timer.Stop()
+	return c.Conn.Close()
+}
+
+func (c *maxAgeConn) closeIfIdle() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.busy {
+		c.Conn.Close()
+	}
+}
+
+// acquire marks the connection as in use by a request.
+func (c *maxAgeConn) acquire() {
+	c.mu.Lock()
+	c.busy = true
+	c.mu.Unlock()
+}
+
+// release marks the connection as idle again, closing it if it has expired meanwhile.
+func (c *maxAgeConn) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.busy = false
+	if !c.now().Before(c.expires) {
+		c.Conn.Close()
+	}
+}
+
+// trackConnAge returns a request trace which tells the maxAgeConn (if any) carrying the request when the
+// request starts and stops using it.
+func trackConnAge() *httptrace.ClientTrace {
+	var conn *maxAgeConn
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			c := info.Conn
+			if tc, ok := c.(interface{ NetConn() net.Conn }); ok {
+				c = tc.NetConn() // A TLS connection
+			}
+			if mc, ok := c.(*maxAgeConn); ok {
+				conn = mc
+				conn.acquire()
+			}
+		},
+		PutIdleConn: func(err error) {
+			if conn != nil && err == nil {
+				conn.release()
+			}
+		},
+	}
+}
@@ -0,0 +1,128 @@
+package erebus
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMaxConnAge(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		conns int
+	)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	backend.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			conns++
+			mu.Unlock()
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+
+	now := time.Unix(1000, 0)
+	transport, err := (&TransportConf{MaxConnAge: time.Minute, now: func() time.Time { return now }}).NewTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.CloseIdleConnections()
+	get := func() {
+		t.Helper()
+		req, err := http.NewRequest("GET", backend.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	numConns := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return conns
+	}
+
+	get()
+	now = now.Add(30 * time.Second)
+	get()
+	if n := numConns(); n != 1 {
+		t.Fatalf("within the maximum age, got %d backend connections; want 1", n)
+	}
+	now = now.Add(time.Minute)
+	get()
+	if n := numConns(); n != 2 {
+		t.Fatalf("after the maximum age, got %d backend connections; want 2", n)
+	}
+}
+
+func TestMaxConnAgeRequestBody(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		conns int
+	)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		io.Copy(w, r.Body)
+	}))
+	backend.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			conns++
+			mu.Unlock()
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+
+	transport, err := (&TransportConf{MaxConnAge: 50 * time.Millisecond}).NewTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.CloseIdleConnections()
+	proxy, server := startProxy(t, `[{"from": {}, "to": {"addr": "{{backend1}}"}}]`, backend)
+	proxy.Transport = transport
+	captureLog(t)
+	post := func(path string) {
+		t.Helper()
+		resp, err := http.Post(server.URL+path, "text/plain", strings.NewReader("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK || string(body) != "hello" {
+			t.Fatalf("POST %s: got %d %q (err = %v); want 200 \"hello\"", path, resp.StatusCode, body, err)
+		}
+	}
+	numConns := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return conns
+	}
+
+	// A connection which expires while idle is retired before the next request.
+	post("/")
+	time.Sleep(100 * time.Millisecond)
+	post("/")
+	if n := numConns(); n != 2 {
+		t.Errorf("after the connection expired while idle, got %d backend connections; want 2", n)
+	}
+	// So is one which expires during a request.
+	post("/slow")
+	post("/")
+	if n := numConns(); n != 3 {
+		t.Errorf("after the connection expired during a request, got %d backend connections; want 3", n)
+	}
+}
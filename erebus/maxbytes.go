@@ -0,0 +1,33 @@
+package erebus
+
+import (
+	"errors"
+	"io"
+)
+
+var errResponseTooLarge = errors.New("response body too large")
+
+// A maxBytesReader reads at most n bytes from r. If r has more, it fails with errResponseTooLarge instead of
+// returning them.
+type maxBytesReader struct {
+	r io.Reader
+	n int64 // The number of bytes remaining
+}
+
+func (m *maxBytesReader) Read(b []byte) (int, error) {
+	if m.n <= 0 {
+		// Check whether there is anything more.
+		var probe [1]byte
+		n, err := m.r.Read(probe[:])
+		if n > 0 {
+			return 0, errResponseTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(b)) > m.n {
+		b = b[:m.n]
+	}
+	n, err := m.r.Read(b)
+	m.n -= int64(n)
+	return n, err
+}
@@ -0,0 +1,68 @@
+package erebus
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMaxResponseBytes(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small":
+			w.Write(bytes.Repeat([]byte("x"), 100))
+		case "/large":
+			w.Write(bytes.Repeat([]byte("x"), 1000))
+		case "/chunked":
+			// Without a Content-Length, the size isn't known until the body is read.
+			for i := 0; i < 10; i++ {
+				w.Write(bytes.Repeat([]byte("x"), 100))
+				w.(http.Flusher).Flush()
+			}
+		}
+	}))
+	proxy, server := startProxy(t, `[{"from": {}, "to": {"addr": "{{backend1}}"}}]`, backend)
+	proxy.MaxResponseBytes = 500
+	logs := captureLog(t)
+
+	resp, err := http.Get(server.URL + "/small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || len(body) != 100 {
+		t.Errorf("small response: got %d bytes (err = %v); want 100", len(body), err)
+	}
+
+	resp, err = http.Get(server.URL + "/large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("response with a large Content-Length: got status %d; want 502", resp.StatusCode)
+	}
+
+	resp, err = http.Get(server.URL + "/chunked")
+	if err == nil {
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err == nil {
+			t.Errorf("large chunked response: got %d bytes and no error; want the response to be aborted",
+				len(body))
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		for _, line := range logLines(logs) {
+			if strings.Contains(line, "response body exceeded 500 bytes") {
+				return
+			}
+		}
+	}
+	t.Errorf("got log %q; want the oversized response to be logged", logs)
+}
@@ -0,0 +1,75 @@
+package erebus
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// A ConcurrencyLimits holds the concurrency slots of rules with MaxConcurrent, by their configuration, so that
+// Proxies can share them (such as the old and new Proxy across a configuration reload). A rule which a reload
+// leaves unchanged then keeps its slots, and the requests still holding them count against its limit in the
+// new Proxy too. The zero ConcurrencyLimits is empty and ready to use. It is safe for concurrent use.
+type ConcurrencyLimits struct {
+	mu   sync.Mutex
+	sems map[string]chan struct{}
+}
+
+// share returns the slots of the rule whose configuration is key, which are sem if the rule is new.
+func (l *ConcurrencyLimits) share(key string, sem chan struct{}) chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if shared, ok := l.sems[key]; ok {
+		return shared
+	}
+	if l.sems == nil {
+		l.sems = make(map[string]chan struct{})
+	}
+	l.sems[key] = sem
+	return sem
+}
+
+// shareLimit switches rule over to the slots in p.Limits for its configuration (once, on its first request,
+// because p.Limits may be set after the Proxy is constructed).
+func (p *Proxy) shareLimit(rule *Conf) {
+	if rule.To.sem == nil || p.Limits == nil {
+		return
+	}
+	rule.limitOnce.Do(func() {
+		if key, err := json.Marshal(rule); err == nil {
+			rule.To.sem = p.Limits.share(string(key), rule.To.sem)
+		}
+	})
+}
+
+// acquire takes one of the rule's concurrency slots (if it has MaxConcurrent), waiting up to QueueTimeout for
+// one to be released if they're all in use. It reports whether it got a slot; if so, the caller must release
+// it when the request is done.
+func (c *ToConf) acquire(ctx context.Context) bool {
+	if c.sem == nil {
+		return true
+	}
+	select {
+	case c.sem <- struct{}{}:
+		return true
+	default:
+	}
+	if c.QueueTimeout == 0 {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(c.QueueTimeout)*time.Millisecond)
+	defer cancel()
+	select {
+	case c.sem <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (c *ToConf) release() {
+	if c.sem != nil {
+		<-c.sem
+	}
+}
@@ -0,0 +1,108 @@
+package erebus
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueue(t *testing.T) {
+	started := make(chan struct{}, 2)
+	unblock := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		if r.URL.Path == "/block" {
+			<-unblock
+		}
+	}))
+	rules := `[{"from": {}, "to": {"addr": "{{backend1}}", "maxconcurrent": 1, "queuetimeout": 100}}]`
+	_, server := startProxy(t, rules, backend)
+
+	get := func(path string) <-chan int {
+		status := make(chan int, 1)
+		go func() {
+			resp, err := http.Get(server.URL + path)
+			if err != nil {
+				t.Error(err)
+				status <- 0
+				return
+			}
+			resp.Body.Close()
+			status <- resp.StatusCode
+		}()
+		return status
+	}
+
+	// While the only slot is held, another request times out in the queue.
+	blocked := get("/block")
+	<-started
+	if got := <-get("/other"); got != http.StatusServiceUnavailable {
+		t.Errorf("got status %d for a request that timed out in the queue; want 503", got)
+	}
+
+	// A queued request proceeds once the slot is released within the queue timeout.
+	queued := get("/other")
+	time.Sleep(20 * time.Millisecond)
+	unblock <- struct{}{}
+	if got := <-blocked; got != http.StatusOK {
+		t.Errorf("got status %d for the first request; want 200", got)
+	}
+	if got := <-queued; got != http.StatusOK {
+		t.Errorf("got status %d for a queued request; want 200", got)
+	}
+}
+
+func TestConcurrencyLimitsShared(t *testing.T) {
+	started := make(chan struct{}, 1)
+	unblock := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/block" {
+			started <- struct{}{}
+			<-unblock
+		}
+	}))
+	defer backend.Close()
+	var limits ConcurrencyLimits
+	load := func(maxConcurrent int) *httptest.Server {
+		rules := fmt.Sprintf(`[{"from": {}, "to": {"addr": %q, "maxconcurrent": %d}}]`,
+			strings.TrimPrefix(backend.URL, "http://"), maxConcurrent)
+		proxy, err := NewProxyFromRules([]byte(rules))
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxy.Limits = &limits
+		server := httptest.NewServer(proxy)
+		t.Cleanup(server.Close)
+		return server
+	}
+	get := func(server *httptest.Server, path string) int {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Error(err)
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	old := load(1)
+	blocked := make(chan int, 1)
+	go func() { blocked <- get(old, "/block") }()
+	<-started
+
+	// After a reload which leaves the rule unchanged, the request in flight still holds its only slot.
+	if got := get(load(1), "/other"); got != http.StatusServiceUnavailable {
+		t.Errorf("unchanged rule after a reload: got status %d; want 503", got)
+	}
+	// A changed rule starts afresh.
+	if got := get(load(2), "/other"); got != http.StatusOK {
+		t.Errorf("changed rule after a reload: got status %d; want 200", got)
+	}
+	unblock <- struct{}{}
+	if got := <-blocked; got != http.StatusOK {
+		t.Errorf("got status %d for the first request; want 200", got)
+	}
+}
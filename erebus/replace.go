@@ -0,0 +1,140 @@
+package erebus
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// ReplaceConf is a search/replace applied to the bodies of backend responses.
+type ReplaceConf struct {
+	Old string
+	New string
+}
+
+func validateReplacements(replacements []*ReplaceConf) error {
+	for _, r := range replacements {
+		if r.Old == "" {
+			return fmt.Errorf("a bodyreplace must have a non-empty 'old'")
+		}
+	}
+	return nil
+}
+
+// shouldReplaceBody reports whether the body replacements of c apply to resp: the response must have a text
+// content type and must not be compressed.
+func (c *ToConf) shouldReplaceBody(r *http.Request, resp *http.Response) bool {
+	if len(c.BodyReplace) == 0 || r.Method == "HEAD" {
+		return false
+	}
+	if enc := resp.Header.Get("Content-Encoding"); enc != "" && !strings.EqualFold(enc, "identity") {
+		return false
+	}
+	t, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return err == nil && isTextMediaType(t)
+}
+
+// isTextMediaType reports whether t is a textual media type which may be rewritten.
+func isTextMediaType(t string) bool {
+	t = strings.ToLower(t)
+	switch {
+	case strings.HasPrefix(t, "text/"):
+		return true
+	case strings.HasSuffix(t, "+xml"), strings.HasSuffix(t, "+json"):
+		return true
+	}
+	switch t {
+	case "application/json", "application/javascript", "application/xml":
+		return true
+	}
+	return false
+}
+
+// replaceReader applies a list of replacements to the data from an underlying reader as it is streamed. As
+// with strings.Replacer, at each position the first replacement in the list which matches is used and
+// replacements are not applied to replaced text. Only a few bytes (less than the longest Old string) are held
+// back at a time to match replacements which span reads.
+type replaceReader struct {
+	r            io.Reader
+	replacements []*ReplaceConf
+	old          [][]byte
+	maxOld       int
+
+	buf     []byte
+	pending []byte // Input which has been read but not yet processed
+	out     []byte // Processed output which has not been returned by Read
+	err     error  // The error from r, returned once pending and out are empty
+}
+
+func newReplaceReader(r io.Reader, replacements []*ReplaceConf) *replaceReader {
+	old := make([][]byte, len(replacements))
+	maxOld := 0
+	for i, rep := range replacements {
+		old[i] = []byte(rep.Old)
+		if len(rep.Old) > maxOld {
+			maxOld = len(rep.Old)
+		}
+	}
+	return &replaceReader{
+		r:            r,
+		replacements: replacements,
+		old:          old,
+		maxOld:       maxOld,
+		buf:          make([]byte, 32*1024),
+	}
+}
+
+func (rr *replaceReader) Read(p []byte) (int, error) {
+	for len(rr.out) == 0 {
+		if rr.err != nil {
+			return 0, rr.err
+		}
+		n, err := rr.r.Read(rr.buf)
+		rr.pending = append(rr.pending, rr.buf[:n]...)
+		rr.err = err
+		rr.process(err != nil)
+	}
+	n := copy(p, rr.out)
+	rr.out = rr.out[n:]
+	return n, nil
+}
+
+// process moves as much of pending to out as possible, applying replacements. Unless final is set, any input
+// which could be the start of a match is kept in pending.
+func (rr *replaceReader) process(final bool) {
+	for {
+		safe := len(rr.pending)
+		if !final {
+			safe -= rr.maxOld - 1
+		}
+		if safe <= 0 {
+			return
+		}
+		i, rep := rr.nextMatch()
+		if rep == nil || i >= safe {
+			rr.out = append(rr.out, rr.pending[:safe]...)
+			rr.pending = append(rr.pending[:0], rr.pending[safe:]...)
+			return
+		}
+		rr.out = append(rr.out, rr.pending[:i]...)
+		rr.out = append(rr.out, rep.New...)
+		rr.pending = rr.pending[i+len(rep.Old):]
+	}
+}
+
+// nextMatch finds the leftmost replacement which matches in pending, preferring earlier replacements when
+// several match at the same position.
+func (rr *replaceReader) nextMatch() (int, *ReplaceConf) {
+	index := -1
+	var match *ReplaceConf
+	for j, old := range rr.old {
+		i := bytes.Index(rr.pending, old)
+		if i >= 0 && (index < 0 || i < index) {
+			index, match = i, rr.replacements[j]
+		}
+	}
+	return index, match
+}
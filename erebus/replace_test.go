@@ -0,0 +1,110 @@
+package erebus
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReplaceReader(t *testing.T) {
+	replacements := []*ReplaceConf{
+		{Old: "http://internal:8080", New: "https://example.com"},
+		{Old: "http://internal", New: "https://www.example.com"},
+		{Old: "foo", New: "foofoo"},
+	}
+	for _, tc := range []struct {
+		in   string
+		want string
+	}{
+		{"", ""},
+		{"nothing to replace", "nothing to replace"},
+		{`<a href="http://internal:8080/a">`, `<a href="https://example.com/a">`},
+		{"http://internal/b http://internal:8080/c", "https://www.example.com/b https://example.com/c"},
+		{"foo foo", "foofoo foofoo"},
+		{"trailing http://internal:80", "trailing https://www.example.com:80"},
+		{"partial http://intern", "partial http://intern"},
+	} {
+		want := strings.NewReplacer("http://internal:8080", "https://example.com",
+			"http://internal", "https://www.example.com", "foo", "foofoo").Replace(tc.in)
+		if want != tc.want {
+			t.Fatalf("bad test case: strings.Replacer gives %q for %q", want, tc.in)
+		}
+		// Reading a byte at a time exercises matches which span reads.
+		for _, oneByte := range []bool{false, true} {
+			r := newReplaceReader(strings.NewReader(tc.in), replacements)
+			if oneByte {
+				r = newReplaceReader(iotest.OneByteReader(strings.NewReader(tc.in)), replacements)
+			}
+			got, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tc.want {
+				t.Errorf("replacing in %q (one byte at a time: %t): got %q; want %q", tc.in, oneByte, got,
+					tc.want)
+			}
+		}
+	}
+}
+
+func TestBodyReplace(t *testing.T) {
+	const page = `<html><a href="http://backend.internal/login">Log in</a>` +
+		`<img src="http://backend.internal/logo.png"></html>`
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/page.html":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		case "/image.png":
+			w.Header().Set("Content-Type", "image/png")
+		case "/compressed.html":
+			w.Header().Set("Content-Type", "text/html")
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(page)))
+		fmt.Fprint(w, page)
+	}))
+	rules := `[{"from": {}, "to": {"addr": "{{backend1}}", "bodyreplace": [
+	             {"old": "http://backend.internal/", "new": "https://www.example.com/"}]}}]`
+	_, server := startProxy(t, rules, backend)
+
+	rewritten := strings.Replace(page, "http://backend.internal/", "https://www.example.com/", -1)
+	for _, tc := range []struct {
+		path string
+		want string
+	}{
+		{"/page.html", rewritten},
+		{"/image.png", page},
+		{"/compressed.html", page},
+	} {
+		req, err := http.NewRequest("GET", server.URL+tc.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Prevent the client from transparently decompressing the response.
+		req.Header.Set("Accept-Encoding", "identity")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != tc.want {
+			t.Errorf("%s: got body %q; want %q", tc.path, body, tc.want)
+		}
+		if resp.ContentLength >= 0 && resp.ContentLength != int64(len(body)) {
+			t.Errorf("%s: got Content-Length %d for a body of length %d", tc.path, resp.ContentLength, len(body))
+		}
+	}
+
+	if _, err := NewProxyFromRules([]byte(`[{"from": {}, "to": {"addr": "localhost:1",
+	    "bodyreplace": [{"old": "", "new": "x"}]}}]`)); err == nil {
+		t.Error("expected an error for a bodyreplace with an empty old string")
+	}
+}
@@ -0,0 +1,62 @@
+package erebus
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+)
+
+// retryable reports whether r may be sent again after it failed with err. A request whose connection couldn't
+// even be made never reached the backend and can always be retried; otherwise the backend may have acted on
+// it, so only idempotent requests (by method, or marked with an Idempotency-Key) are repeated.
+func retryable(r *http.Request, err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS", "PUT", "DELETE":
+		return true
+	}
+	return r.Header.Get("Idempotency-Key") != ""
+}
+
+// retryBackoff returns how long to wait before the given retry (counting from 0): RetryBackoff doubled for each
+// earlier retry, capped at RetryBackoffMax (if set), and then randomly reduced by up to half so that clients
+// which failed together don't all retry together.
+func (c *ToConf) retryBackoff(attempt int) time.Duration {
+	if c.RetryBackoff == 0 {
+		return 0
+	}
+	d := time.Duration(c.RetryBackoff) * time.Millisecond
+	max := time.Duration(c.RetryBackoffMax) * time.Millisecond
+	for i := 0; i < attempt && (max == 0 || d < max) && d < math.MaxInt64/2; i++ {
+		d *= 2
+	}
+	if max > 0 && d > max {
+		d = max
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// sleepContext waits for d, returning early (and false) if ctx is done first.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if d <= 0 {
+		return true
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
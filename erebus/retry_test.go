@@ -0,0 +1,205 @@
+package erebus
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	c := &ToConf{RetryBackoff: 100, RetryBackoffMax: 500}
+	for _, tc := range []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{0, 100 * time.Millisecond},
+		{1, 200 * time.Millisecond},
+		{2, 400 * time.Millisecond},
+		{3, 500 * time.Millisecond},
+		{100, 500 * time.Millisecond},
+	} {
+		for i := 0; i < 100; i++ {
+			if got := c.retryBackoff(tc.attempt); got < tc.max/2 || got > tc.max {
+				t.Fatalf("attempt %d: got backoff %s; want between %s and %s", tc.attempt, got, tc.max/2, tc.max)
+			}
+		}
+	}
+	if got := (&ToConf{}).retryBackoff(3); got != 0 {
+		t.Errorf("got backoff %s with no retrybackoff; want 0", got)
+	}
+}
+
+// failingTransport fails the first n requests and then responds with 200.
+type failingTransport struct {
+	n     int32
+	calls int32
+}
+
+func (ft *failingTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	if atomic.AddInt32(&ft.calls, 1) <= ft.n {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	}
+	rec := httptest.NewRecorder()
+	rec.WriteString("ok")
+	return rec.Result(), nil
+}
+
+func TestRetries(t *testing.T) {
+	for _, tc := range []struct {
+		rules    string
+		failures int32
+		status   int
+		calls    int32
+		minDelay time.Duration
+	}{
+		{`{"addr": "localhost:1", "maxretries": 2, "retrybackoff": 40}`, 2, http.StatusOK, 3, 60 * time.Millisecond},
+		{`{"addr": "localhost:1", "maxretries": 2}`, 3, http.StatusBadGateway, 3, 0},
+		{`{"addr": "localhost:1"}`, 1, http.StatusBadGateway, 1, 0},
+	} {
+		proxy, err := NewProxyFromRules([]byte(`[{"from": {}, "to": ` + tc.rules + `}]`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		transport := &failingTransport{n: tc.failures}
+		proxy.Transport = transport
+		w := httptest.NewRecorder()
+		start := time.Now()
+		proxy.ServeHTTP(w, httptest.NewRequest("POST", "/", nil))
+		elapsed := time.Since(start)
+		if w.Code != tc.status {
+			t.Errorf("%s: got status %d; want %d", tc.rules, w.Code, tc.status)
+		}
+		if transport.calls != tc.calls {
+			t.Errorf("%s: got %d attempts; want %d", tc.rules, transport.calls, tc.calls)
+		}
+		if elapsed < tc.minDelay {
+			t.Errorf("%s: took %s; want at least %s of backoff", tc.rules, elapsed, tc.minDelay)
+		}
+	}
+}
+
+func TestRetriesOnlyIdempotent(t *testing.T) {
+	// The backend reads each request and then drops the connection without responding.
+	var received int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&received, 1)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.Close()
+	}))
+	defer backend.Close()
+	_, server := startProxy(t, `[{"from": {}, "to": {"addr": "{{backend1}}", "maxretries": 2}}]`, backend)
+	captureLog(t)
+
+	for _, tc := range []struct {
+		method   string
+		header   string
+		received int32
+	}{
+		{"POST", "", 1},
+		{"PATCH", "", 1},
+		{"POST", "Idempotency-Key", 3},
+		{"GET", "", 3},
+		{"PUT", "", 3},
+	} {
+		atomic.StoreInt32(&received, 0)
+		req, err := http.NewRequest(tc.method, server.URL, strings.NewReader("body"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.header != "" {
+			req.Header.Set(tc.header, "abc")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadGateway {
+			t.Errorf("%s %s: got status %d; want 502", tc.method, tc.header, resp.StatusCode)
+		}
+		if got := atomic.LoadInt32(&received); got != tc.received {
+			t.Errorf("%s %s: backend got the request %d times; want %d", tc.method, tc.header, got, tc.received)
+		}
+	}
+}
+
+func TestRetriesStopWithClient(t *testing.T) {
+	proxy, err := NewProxyFromRules([]byte(`[{"from": {},
+	  "to": {"addr": "localhost:1", "maxretries": 10, "retrybackoff": 1000}}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := &failingTransport{n: 100}
+	proxy.Transport = transport
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	proxy.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("retries continued for %s after the client went away", elapsed)
+	}
+	if transport.calls != 1 {
+		t.Errorf("got %d attempts; want 1", transport.calls)
+	}
+}
+
+// blockingTransport blocks each request until it's canceled.
+type blockingTransport struct{}
+
+func (blockingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	<-r.Context().Done()
+	return nil, r.Context().Err()
+}
+
+func TestDeadline(t *testing.T) {
+	for _, tc := range []struct {
+		rules     string
+		transport http.RoundTripper
+		status    int
+		minCalls  int32
+		maxCalls  int32
+	}{
+		// The backoff between retries is cut short by the budget shared by all the attempts.
+		{`{"addr": "localhost:1", "maxretries": 10, "retrybackoff": 100, "deadline": 250}`,
+			&failingTransport{n: 100}, http.StatusGatewayTimeout, 2, 4},
+		// So is an attempt in progress.
+		{`{"addr": "localhost:1", "maxretries": 10, "deadline": 100}`, blockingTransport{},
+			http.StatusGatewayTimeout, 0, 0},
+		// A response within the budget is relayed as usual.
+		{`{"addr": "localhost:1", "maxretries": 10, "retrybackoff": 10, "deadline": 1000}`,
+			&failingTransport{n: 2}, http.StatusOK, 3, 3},
+	} {
+		proxy, err := NewProxyFromRules([]byte(`[{"from": {}, "to": ` + tc.rules + `}]`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxy.Transport = tc.transport
+		captureLog(t)
+		w := httptest.NewRecorder()
+		start := time.Now()
+		proxy.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s: took %s", tc.rules, elapsed)
+		}
+		if w.Code != tc.status {
+			t.Errorf("%s: got status %d; want %d", tc.rules, w.Code, tc.status)
+		}
+		if ft, ok := tc.transport.(*failingTransport); ok && (ft.calls < tc.minCalls || ft.calls > tc.maxCalls) {
+			t.Errorf("%s: got %d attempts; want %d to %d", tc.rules, ft.calls, tc.minCalls, tc.maxCalls)
+		}
+	}
+
+	if _, err := NewProxyFromRules([]byte(`[{"from": {}, "to": {"addr": "a:1", "deadline": -1}}]`)); err == nil {
+		t.Error("a negative deadline: expected a validation error")
+	}
+}
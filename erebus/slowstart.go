@@ -0,0 +1,97 @@
+package erebus
+
+import (
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A SlowStartSet records when each canary began receiving requests and when any backend last recovered from
+// errors or a failed health check; those are when their CanarySlowStart ramps begin. Sharing a SlowStartSet
+// between Proxies (such as the old and new Proxy across a configuration reload) keeps reloads from restarting
+// the ramps. The zero SlowStartSet is empty and ready to use. It is safe for concurrent use.
+type SlowStartSet struct {
+	mu        sync.Mutex
+	started   map[string]time.Time
+	recovered map[string]time.Time
+}
+
+// start returns when the ramp of the backend at addr began, recording t if there's none yet. A nil
+// SlowStartSet always returns t.
+func (s *SlowStartSet) start(addr string, t time.Time) time.Time {
+	if s == nil {
+		return t
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if start, ok := s.started[addr]; ok {
+		return start
+	}
+	if s.started == nil {
+		s.started = make(map[string]time.Time)
+	}
+	s.started[addr] = t
+	return t
+}
+
+// restart begins the ramp of the backend at addr again at t, as it has just recovered.
+func (s *SlowStartSet) restart(addr string, t time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.recovered == nil {
+		s.recovered = make(map[string]time.Time)
+	}
+	s.recovered[addr] = t
+}
+
+// progress returns how far the backend at addr is, at now, through a ramp of length window since it last
+// recovered: from 0 to 1, or 1 if it hasn't recovered that recently. A nil SlowStartSet always returns 1.
+func (s *SlowStartSet) progress(addr string, now time.Time, window time.Duration) float64 {
+	if s == nil {
+		return 1
+	}
+	s.mu.Lock()
+	t, ok := s.recovered[addr]
+	s.mu.Unlock()
+	if !ok {
+		return 1
+	}
+	if elapsed := now.Sub(t); elapsed < window {
+		return float64(elapsed) / float64(window)
+	}
+	return 1
+}
+
+// rampStart returns when the slow start of c's canary began.
+func (p *Proxy) rampStart(c *ToConf) time.Time {
+	if c.CanarySlowStart == 0 {
+		return c.loaded
+	}
+	return p.SlowStarts.start(c.CanaryAddr, c.loaded)
+}
+
+// unavailableFor returns the test of whether the request r to the rule c should not be sent to a backend:
+// besides those which are draining or down, a backend which has recently recovered is passed over for a share
+// of the requests it would get which shrinks to nothing over the CanarySlowStart ramp. For requests hashed
+// among Addrs, that share is a fixed set of keys (which go to the next backend on the ring meanwhile), so
+// each key moves back to its own backend just once.
+func (p *Proxy) unavailableFor(c *ToConf, r *http.Request) func(string) bool {
+	if c.CanarySlowStart == 0 || p.SlowStarts == nil {
+		return p.unavailable
+	}
+	roll := rand.Float64()
+	if c.ring != nil {
+		if key := c.hashAttr(r); key != "" {
+			roll = float64(hashKey(key+"#slowstart")>>11) / (1 << 53)
+		}
+	}
+	now := c.now()
+	window := time.Duration(c.CanarySlowStart) * time.Millisecond
+	return func(addr string) bool {
+		return p.unavailable(addr) || roll >= p.SlowStarts.progress(addr, now, window)
+	}
+}
@@ -0,0 +1,141 @@
+package erebus
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSlowStartAcrossReloads(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	load := func() (*Proxy, *ToConf) {
+		to := &ToConf{
+			Addr:            "stable:80",
+			CanaryAddr:      "canary:80",
+			CanaryPercent:   40,
+			CanarySlowStart: 10000,
+			now:             func() time.Time { return now },
+		}
+		if err := to.validate(); err != nil {
+			t.Fatal(err)
+		}
+		return &Proxy{}, to
+	}
+	var slowStarts SlowStartSet
+
+	p, to := load()
+	p.SlowStarts = &slowStarts
+	if got := to.canaryPercent(p.rampStart(to)); got != 0 {
+		t.Fatalf("at first, got canary share %v%%; want 0%%", got)
+	}
+
+	// A reload halfway through the ramp carries on from there.
+	now = now.Add(5 * time.Second)
+	p, to = load()
+	p.SlowStarts = &slowStarts
+	if got := to.canaryPercent(p.rampStart(to)); got != 20 {
+		t.Errorf("after reloading, got canary share %v%%; want 20%%", got)
+	}
+
+	// Once the canary recovers from errors, its ramp starts over.
+	p.backendErrors.failure("canary:80")
+	if !p.backendErrors.success("canary:80") {
+		t.Fatal("success after a failure wasn't reported as a recovery")
+	}
+	slowStarts.restart("canary:80", now)
+	for i := 0; i < 100; i++ {
+		if addr := route(p, to, httptest.NewRequest("GET", "/", nil)); addr != "stable:80" {
+			t.Fatalf("after recovering, a request was sent to %s", addr)
+		}
+	}
+	now = now.Add(10 * time.Second)
+	if got := to.canaryPercent(p.rampStart(to)); got != 40 {
+		t.Errorf("after the ramp, got canary share %v%%; want 40%%", got)
+	}
+}
+
+// route returns the backend to which p sends r (for the rule to).
+func route(p *Proxy, to *ToConf, r *http.Request) string {
+	return to.availableAddr(r, to.createRequest(r, p.rampStart(to)).URL.Host, p.unavailableFor(to, r))
+}
+
+func TestSlowStartRecovery(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	p := &Proxy{SlowStarts: &SlowStartSet{}}
+
+	// A recovered Addr gets a growing share of its requests; the canary gets the rest.
+	to := &ToConf{Addr: "stable:80", CanaryAddr: "canary:80", CanaryPercent: 10, CanarySlowStart: 10000, now: clock}
+	if err := to.validate(); err != nil {
+		t.Fatal(err)
+	}
+	recovered := now
+	p.SlowStarts.restart("stable:80", recovered)
+	stableShare := func() float64 {
+		var n int
+		for i := 0; i < 2000; i++ {
+			if route(p, to, httptest.NewRequest("GET", "/", nil)) == "stable:80" {
+				n++
+			}
+		}
+		return float64(n) / 2000
+	}
+	for _, tc := range []struct {
+		elapsed time.Duration
+		want    float64
+	}{
+		{0, 0},
+		{5 * time.Second, 0.45},
+		{10 * time.Second, 0.9},
+	} {
+		now = recovered.Add(tc.elapsed)
+		if got := stableShare(); math.Abs(got-tc.want) > 0.07 {
+			t.Errorf("%s after recovering: got stable share %.2f; want about %.2f", tc.elapsed, got, tc.want)
+		}
+	}
+
+	// Among hashed Addrs, a growing set of a recovered backend's keys go back to it.
+	to = &ToConf{Addrs: []string{"a:80", "b:80", "c:80"}, HashBy: "path", CanarySlowStart: 10000, now: clock}
+	if err := to.validate(); err != nil {
+		t.Fatal(err)
+	}
+	const keys = 1000
+	usual := make([]string, keys)
+	for i := range usual {
+		usual[i] = route(p, to, httptest.NewRequest("GET", fmt.Sprintf("/%d", i), nil))
+	}
+	recovered = now
+	p.SlowStarts.restart("b:80", recovered)
+	var prev map[int]bool
+	for _, elapsed := range []time.Duration{0, 2500 * time.Millisecond, 5 * time.Second, 10 * time.Second} {
+		now = recovered.Add(elapsed)
+		back := make(map[int]bool)
+		var owned int
+		for i := range usual {
+			addr := route(p, to, httptest.NewRequest("GET", fmt.Sprintf("/%d", i), nil))
+			if usual[i] != "b:80" {
+				if addr != usual[i] {
+					t.Fatalf("%s after recovering: key %d moved from %s to %s", elapsed, i, usual[i], addr)
+				}
+				continue
+			}
+			owned++
+			if addr == "b:80" {
+				back[i] = true
+			}
+		}
+		want := float64(elapsed) / float64(10*time.Second)
+		if got := float64(len(back)) / float64(owned); math.Abs(got-want) > 0.1 {
+			t.Errorf("%s after recovering: b got %.2f of its keys; want about %.2f", elapsed, got, want)
+		}
+		for i := range prev {
+			if !back[i] {
+				t.Errorf("%s after recovering: key %d went back to b and then away again", elapsed, i)
+			}
+		}
+		prev = back
+	}
+}
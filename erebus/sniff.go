@@ -0,0 +1,37 @@
+package erebus
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+)
+
+// A sniffedBody is a request body whose first bytes have been read to detect its content type. It replays
+// those bytes, so the backend still receives the whole body.
+type sniffedBody struct {
+	io.Reader
+	io.Closer
+	mediaType string
+}
+
+// sniffMediaType returns the media type of the body of r as detected by http.DetectContentType (from at most
+// its first 512 bytes), or "" if it has no body. The bytes read are put back by replacing r.Body.
+func sniffMediaType(r *http.Request) string {
+	if b, ok := r.Body.(*sniffedBody); ok {
+		return b.mediaType
+	}
+	if r.Body == nil || r.Body == http.NoBody {
+		return ""
+	}
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(r.Body, head)
+	// Any read error is seen again by whoever reads the rest of the body.
+	head = head[:n]
+	b := &sniffedBody{Reader: io.MultiReader(bytes.NewReader(head), r.Body), Closer: r.Body}
+	if n > 0 {
+		b.mediaType, _, _ = mime.ParseMediaType(http.DetectContentType(head))
+	}
+	r.Body = b
+	return b.mediaType
+}
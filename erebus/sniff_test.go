@@ -0,0 +1,50 @@
+package erebus
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestSniffContentType(t *testing.T) {
+	images := NewRecordingBackend()
+	other := NewRecordingBackend()
+	rules := `[{"from": {"contenttype": "image/png", "sniffcontenttype": true}, "to": {"addr": "{{backend1}}"}},
+	           {"from": {}, "to": {"addr": "{{backend2}}"}}]`
+	_, server := startProxy(t, rules, images.Server, other.Server)
+
+	png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 1000)...)
+	json := []byte(`{"name": "upload"}`)
+	for _, tc := range []struct {
+		desc        string
+		contentType string
+		body        []byte
+		backend     *RecordingBackend
+	}{
+		{"PNG without a content type", "", png, images},
+		{"JSON without a content type", "", json, other},
+		{"PNG declared as something else", "application/octet-stream", png, other},
+	} {
+		req, err := http.NewRequest("POST", server.URL+"/upload", bytes.NewReader(tc.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.contentType != "" {
+			req.Header.Set("Content-Type", tc.contentType)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		got := tc.backend.Next(t)
+		if body, _ := ioutil.ReadAll(got.Body); !bytes.Equal(body, tc.body) {
+			t.Errorf("%s: backend got a body of %d bytes; want the original %d bytes", tc.desc, len(body),
+				len(tc.body))
+		}
+		if got := got.Header.Get("Content-Type"); got != tc.contentType {
+			t.Errorf("%s: backend got Content-Type %q; want %q", tc.desc, got, tc.contentType)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package erebus
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// srvPrefix marks a backend address as a DNS SRV name to be resolved, as in "srv:_http._tcp.service.consul".
+const srvPrefix = "srv:"
+
+// srvName returns the SRV name given by addr, if it has one.
+func srvName(addr string) (string, bool) {
+	if !strings.HasPrefix(addr, srvPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(addr, srvPrefix), true
+}
+
+// srvTTL is how long SRV lookup results are cached. (The Go resolver doesn't provide the TTLs of records.)
+const srvTTL = 30 * time.Second
+
+// srvLookupTimeout is how long an SRV lookup may take, so that a slow DNS server doesn't hold up requests
+// indefinitely.
+const srvLookupTimeout = 5 * time.Second
+
+// srvResolver resolves SRV names to backend addresses, caching the results.
+type srvResolver struct {
+	lookup  func(ctx context.Context, name string) ([]*net.SRV, error)
+	now     func() time.Time
+	ttl     time.Duration
+	timeout time.Duration // For each lookup
+
+	mu    sync.Mutex
+	cache map[string]srvCacheEntry
+}
+
+type srvCacheEntry struct {
+	records []*net.SRV
+	expires time.Time
+}
+
+func newSRVResolver() *srvResolver {
+	return &srvResolver{
+		lookup: func(ctx context.Context, name string) ([]*net.SRV, error) {
+			_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+			return records, err
+		},
+		now:     time.Now,
+		ttl:     srvTTL,
+		timeout: srvLookupTimeout,
+		cache:   make(map[string]srvCacheEntry),
+	}
+}
+
+// resolve picks a host:port for the SRV name, giving up on the lookup (if one is needed) when ctx is done or
+// after r.timeout. An empty set of records is an error.
+func (r *srvResolver) resolve(ctx context.Context, name string) (string, error) {
+	records, err := r.records(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	if len(records) == 0 {
+		return "", fmt.Errorf("no SRV records found for %s", name)
+	}
+	srv := pickSRV(records)
+	host := strings.TrimSuffix(srv.Target, ".")
+	return net.JoinHostPort(host, strconv.Itoa(int(srv.Port))), nil
+}
+
+func (r *srvResolver) records(ctx context.Context, name string) ([]*net.SRV, error) {
+	now := r.now()
+	r.mu.Lock()
+	entry, ok := r.cache[name]
+	r.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.records, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	records, err := r.lookup(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	r.cache[name] = srvCacheEntry{records: records, expires: now.Add(r.ttl)}
+	r.mu.Unlock()
+	return records, nil
+}
+
+// pickSRV chooses among the records with the lowest priority, randomly in proportion to their weights (as
+// described in RFC 2782).
+func pickSRV(records []*net.SRV) *net.SRV {
+	var candidates []*net.SRV
+	totalWeight := 0
+	for _, srv := range records {
+		switch {
+		case len(candidates) == 0 || srv.Priority < candidates[0].Priority:
+			candidates = []*net.SRV{srv}
+			totalWeight = int(srv.Weight)
+		case srv.Priority == candidates[0].Priority:
+			candidates = append(candidates, srv)
+			totalWeight += int(srv.Weight)
+		}
+	}
+	if totalWeight == 0 {
+		return candidates[rand.Intn(len(candidates))]
+	}
+	n := rand.Intn(totalWeight)
+	for _, srv := range candidates {
+		if n < int(srv.Weight) {
+			return srv
+		}
+		n -= int(srv.Weight)
+	}
+	panic("unreached")
+}
@@ -0,0 +1,148 @@
+package erebus
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSRV is a fake SRV lookup function which counts the lookups it performs.
+type fakeSRV struct {
+	records map[string][]*net.SRV
+	lookups int
+}
+
+func (f *fakeSRV) lookup(ctx context.Context, name string) ([]*net.SRV, error) {
+	f.lookups++
+	records, ok := f.records[name]
+	if !ok {
+		return nil, fmt.Errorf("no such host: %s", name)
+	}
+	return records, nil
+}
+
+func TestSRVResolverCache(t *testing.T) {
+	fake := &fakeSRV{records: map[string][]*net.SRV{
+		"_http._tcp.svc": {{Target: "a.example.com.", Port: 8080}},
+	}}
+	now := time.Unix(1000, 0)
+	r := newSRVResolver()
+	r.lookup = fake.lookup
+	r.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		addr, err := r.resolve(context.Background(), "_http._tcp.svc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr != "a.example.com:8080" {
+			t.Fatalf("got address %q; want a.example.com:8080", addr)
+		}
+	}
+	if fake.lookups != 1 {
+		t.Fatalf("got %d lookups within the TTL; want 1", fake.lookups)
+	}
+
+	fake.records["_http._tcp.svc"] = []*net.SRV{{Target: "b.example.com.", Port: 9090}}
+	now = now.Add(srvTTL + time.Second)
+	addr, err := r.resolve(context.Background(), "_http._tcp.svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != "b.example.com:9090" || fake.lookups != 2 {
+		t.Fatalf("after the TTL, got address %q with %d lookups; want b.example.com:9090 with 2", addr,
+			fake.lookups)
+	}
+
+	if _, err := r.resolve(context.Background(), "_http._tcp.missing"); err == nil {
+		t.Fatal("expected an error resolving a missing name")
+	}
+}
+
+func TestSRVLookupTimeout(t *testing.T) {
+	r := newSRVResolver()
+	r.timeout = 10 * time.Millisecond
+	r.lookup = func(ctx context.Context, name string) ([]*net.SRV, error) {
+		<-ctx.Done() // A DNS server which never answers
+		return nil, ctx.Err()
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := r.resolve(context.Background(), "_http._tcp.slow")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != context.DeadlineExceeded {
+			t.Errorf("got error %v from a lookup that never finishes; want a timeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the lookup didn't time out")
+	}
+}
+
+func TestPickSRV(t *testing.T) {
+	records := []*net.SRV{
+		{Target: "backup.", Priority: 20, Weight: 100},
+		{Target: "heavy.", Priority: 10, Weight: 3},
+		{Target: "light.", Priority: 10, Weight: 1},
+	}
+	counts := make(map[string]int)
+	for i := 0; i < 4000; i++ {
+		counts[pickSRV(records).Target]++
+	}
+	if counts["backup."] != 0 {
+		t.Errorf("a higher-priority-number record was picked %d times", counts["backup."])
+	}
+	if counts["heavy."] < 2700 || counts["heavy."] > 3300 {
+		t.Errorf("got %d picks of the weight-3 record out of 4000; want about 3000", counts["heavy."])
+	}
+}
+
+func TestSRVBackend(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	host, port, err := net.SplitHostPort(backend.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	portNum, _ := strconv.Atoi(port)
+	fake := &fakeSRV{records: map[string][]*net.SRV{
+		"_http._tcp.up":    {{Target: host + ".", Port: uint16(portNum)}},
+		"_http._tcp.empty": {},
+	}}
+	proxy, server := startProxy(t, `[{"from": {"path": "/up"}, "to": {"addr": "srv:_http._tcp.up"}},
+	                                 {"from": {}, "to": {"addr": "srv:_http._tcp.empty"}}]`, backend)
+	proxy.srv.lookup = fake.lookup
+	logs := captureLog(t)
+
+	for _, tc := range []struct {
+		path   string
+		status int
+	}{
+		{"/up", http.StatusOK},
+		{"/empty", http.StatusBadGateway},
+	} {
+		resp, err := http.Get(server.URL + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: got status %d; want %d", tc.path, resp.StatusCode, tc.status)
+		}
+	}
+
+	want := fmt.Sprintf("srv:_http._tcp.up (%s) 200 ", backend.Listener.Addr())
+	for _, line := range logLines(logs) {
+		if strings.Contains(line, want) {
+			return
+		}
+	}
+	t.Fatalf("got log %q; want a line naming the resolved backend, %q", logs, want)
+}
@@ -0,0 +1,27 @@
+package erebus
+
+import (
+	"io"
+	"time"
+)
+
+// A stallReader calls abort if reading from r makes no progress for the timeout.
+type stallReader struct {
+	r       io.Reader
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+func newStallReader(r io.Reader, timeout time.Duration, abort func()) *stallReader {
+	return &stallReader{r: r, timeout: timeout, timer: time.AfterFunc(timeout, abort)}
+}
+
+func (s *stallReader) Read(b []byte) (int, error) {
+	n, err := s.r.Read(b)
+	if n > 0 {
+		s.timer.Reset(s.timeout)
+	}
+	return n, err
+}
+
+func (s *stallReader) stop() { s.timer.Stop() }
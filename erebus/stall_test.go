@@ -0,0 +1,80 @@
+package erebus
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newStallingBackend starts a backend which, for /stall-body, sends its headers and part of the body and then
+// stalls, and for /stall-headers stalls before sending anything.
+func newStallingBackend(t *testing.T) *httptest.Server {
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stall-body" {
+			w.Header().Set("Content-Length", "100")
+			w.Write([]byte("partial"))
+			w.(http.Flusher).Flush()
+		}
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+}
+
+func TestBodyReadTimeout(t *testing.T) {
+	proxy, server := startProxy(t, `[{"from": {}, "to": {"addr": "{{backend1}}"}}]`, newStallingBackend(t))
+	proxy.BodyReadTimeout = 100 * time.Millisecond
+	logs := captureLog(t)
+
+	start := time.Now()
+	// The status (and perhaps part of the body) may already have been sent when the response is aborted, or
+	// it may still be buffered; either way the client sees an error rather than a truncated response.
+	resp, err := http.Get(server.URL + "/stall-body")
+	if err == nil {
+		body, readErr := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if readErr == nil {
+			t.Fatalf("reading a stalled response got body %q and no error; want the response to be aborted", body)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the stalled response was aborted after %s; want about 100ms", elapsed)
+	}
+	// The access log is written as the handler unwinds.
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		for _, line := range logLines(logs) {
+			if strings.Contains(line, "response body timed out") {
+				return
+			}
+		}
+	}
+	t.Errorf("got log %q; want the timeout to be logged", logs)
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	proxy, server := startProxy(t, `[{"from": {}, "to": {"addr": "{{backend1}}"}}]`, newStallingBackend(t))
+	transport, err := (&TransportConf{ResponseHeaderTimeout: 100 * time.Millisecond}).NewTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.Transport = transport
+
+	start := time.Now()
+	resp, err := http.Get(server.URL + "/stall-headers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("got status %d; want 502", resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the request took %s; want it to time out after about 100ms", elapsed)
+	}
+}
@@ -0,0 +1,79 @@
+package erebus
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"math/rand"
+	"net/http"
+	"strings"
+)
+
+// outgoingTraceParent returns the W3C Trace Context traceparent header (https://www.w3.org/TR/trace-context/)
+// for a request to the backend, given the client's request headers. Each backend request is a new span in the
+// client's trace, keeping its trace ID and flags. If the client's traceparent is absent or invalid (including
+// if it sent several), a new trace is started.
+func outgoingTraceParent(h http.Header) string {
+	var traceID, flags string
+	ok := false
+	if incoming := h["Traceparent"]; len(incoming) == 1 {
+		traceID, flags, ok = parseTraceParent(incoming[0])
+	}
+	if !ok {
+		traceID = randomHex(16)
+		flags = "01" // Sampled, so that the backends record the trace erebus started
+	}
+	return "00-" + traceID + "-" + randomHex(8) + "-" + flags
+}
+
+// parseTraceParent parses a traceparent header, returning its trace ID and flags. Headers of versions after 00
+// are accepted as long as they start with the fields of version 00, as the specification requires.
+func parseTraceParent(s string) (traceID, flags string, ok bool) {
+	fields := strings.Split(strings.TrimSpace(s), "-")
+	if len(fields) < 4 {
+		return "", "", false
+	}
+	version, traceID, parentID, flags := fields[0], fields[1], fields[2], fields[3]
+	if !isLowerHex(version, 2) || version == "ff" || (version == "00" && len(fields) != 4) {
+		return "", "", false
+	}
+	if !isLowerHex(traceID, 32) || traceID == strings.Repeat("0", 32) {
+		return "", "", false
+	}
+	if !isLowerHex(parentID, 16) || parentID == strings.Repeat("0", 16) {
+		return "", "", false
+	}
+	if !isLowerHex(flags, 2) {
+		return "", "", false
+	}
+	return traceID, flags, true
+}
+
+func isLowerHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !('0' <= s[i] && s[i] <= '9' || 'a' <= s[i] && s[i] <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// randomHex returns n random bytes, hex-encoded. They're never all zero, which is invalid for trace and span
+// IDs.
+func randomHex(n int) string {
+	b := make([]byte, n)
+	for {
+		for i := 0; i < n; i += 8 {
+			var u [8]byte
+			binary.LittleEndian.PutUint64(u[:], rand.Uint64())
+			copy(b[i:], u[:])
+		}
+		for _, c := range b {
+			if c != 0 {
+				return hex.EncodeToString(b)
+			}
+		}
+	}
+}
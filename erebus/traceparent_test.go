@@ -0,0 +1,80 @@
+package erebus
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTraceParentPropagation(t *testing.T) {
+	const incoming = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"
+	to := &ToConf{Addr: "localhost:1", TraceParent: true}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Traceparent", incoming)
+	r.Header.Set("Tracestate", "vendor=value")
+	out := to.CreateRequest(r)
+
+	got := out.Header.Get("Traceparent")
+	traceID, flags, ok := parseTraceParent(got)
+	if !ok {
+		t.Fatalf("got invalid Traceparent %q", got)
+	}
+	if traceID != "4bf92f3577b34da6a3ce929d0e0e4736" || flags != "00" {
+		t.Errorf("got Traceparent %q; want the incoming trace ID and flags", got)
+	}
+	if strings.Split(got, "-")[2] == "00f067aa0ba902b7" {
+		t.Errorf("got Traceparent %q; want a new span ID", got)
+	}
+	if got := out.Header.Get("Tracestate"); got != "vendor=value" {
+		t.Errorf("got Tracestate %q; want it passed on unchanged", got)
+	}
+	if got := r.Header.Get("Traceparent"); got != incoming {
+		t.Errorf("the inbound request's Traceparent was changed to %q", got)
+	}
+}
+
+func TestTraceParentGeneration(t *testing.T) {
+	to := &ToConf{Addr: "localhost:1", TraceParent: true}
+	for _, incoming := range []string{
+		"",
+		"garbage",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01", // Zero trace ID
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", // Zero parent ID
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", // Uppercase
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", // Invalid version
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		if incoming != "" {
+			r.Header.Set("Traceparent", incoming)
+		}
+		got := to.CreateRequest(r).Header.Get("Traceparent")
+		traceID, flags, ok := parseTraceParent(got)
+		if !ok {
+			t.Errorf("with Traceparent %q: got invalid Traceparent %q", incoming, got)
+			continue
+		}
+		if strings.Contains(incoming, traceID) || flags != "01" {
+			t.Errorf("with Traceparent %q: got %q; want a new sampled trace", incoming, got)
+		}
+	}
+
+	// Each new trace has its own ID.
+	r := httptest.NewRequest("GET", "/", nil)
+	if a, b := to.CreateRequest(r).Header.Get("Traceparent"), to.CreateRequest(r).Header.Get("Traceparent"); a == b {
+		t.Errorf("two requests both got Traceparent %q", a)
+	}
+
+	// A later version's header is continued, if it starts with the version 00 fields.
+	r.Header.Set("Traceparent", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra")
+	got := to.CreateRequest(r).Header.Get("Traceparent")
+	if !strings.HasPrefix(got, "00-4bf92f3577b34da6a3ce929d0e0e4736-") {
+		t.Errorf("with a version 01 Traceparent: got %q; want the trace continued as version 00", got)
+	}
+
+	// Without the option, the header is passed on untouched (or not at all).
+	to.TraceParent = false
+	if got := to.CreateRequest(httptest.NewRequest("GET", "/", nil)).Header.Get("Traceparent"); got != "" {
+		t.Errorf("without TraceParent: got Traceparent %q; want none", got)
+	}
+}
@@ -0,0 +1,62 @@
+package erebus
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// upgradeType returns the protocol named by the Upgrade header if h requests a connection upgrade (that is,
+// the Connection header includes the "upgrade" option), or "" otherwise.
+func upgradeType(h http.Header) string {
+	for _, v := range h["Connection"] {
+		for _, option := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(option), "upgrade") {
+				return h.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// serveUpgrade completes a protocol switch (a 101 response from the backend to a request for an upgrade to
+// the protocol reqType) by hijacking the client connection and copying bytes in both directions between the
+// client and the backend until either side is done.
+func serveUpgrade(w http.ResponseWriter, reqType string, resp *http.Response) error {
+	if respType := upgradeType(resp.Header); !strings.EqualFold(reqType, respType) {
+		return fmt.Errorf("backend switched to protocol %q when %q was requested", respType, reqType)
+	}
+	backend, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		return fmt.Errorf("backend connection for protocol switch is not writable")
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return fmt.Errorf("client connection cannot be hijacked")
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	resp.Body = nil // Don't write the backend connection as the body
+	if err := resp.Write(brw); err != nil {
+		return err
+	}
+	if err := brw.Flush(); err != nil {
+		return err
+	}
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(backend, brw) // Includes any bytes the server buffered from the client
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, backend)
+		done <- struct{}{}
+	}()
+	<-done
+	return nil
+}
@@ -0,0 +1,99 @@
+package erebus
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newUpgradeBackend starts a backend which switches to a line-based protocol, responding with the uppercased
+// line, for requests to upgrade to protocol; it switches to respType instead if that is given.
+func newUpgradeBackend(protocol, respType string) *httptest.Server {
+	if respType == "" {
+		respType = protocol
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if upgradeType(r.Header) != protocol {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: %s\r\n\r\n", respType)
+		brw.Flush()
+		for {
+			line, err := brw.ReadString('\n')
+			if err != nil {
+				return
+			}
+			brw.WriteString(strings.ToUpper(line))
+			brw.Flush()
+		}
+	}))
+}
+
+// dialUpgrade sends a request to switch to protocol through the proxy server at addr, returning the
+// connection and the proxy's response.
+func dialUpgrade(t *testing.T, addr, protocol string) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: %s\r\n\r\n", protocol)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, br, resp
+}
+
+func TestUpgrade(t *testing.T) {
+	backend := newUpgradeBackend("x-shout/1", "")
+	_, server := startProxy(t, `[{"from": {}, "to": {"addr": "{{backend1}}"}}]`, backend)
+
+	conn, br, resp := dialUpgrade(t, server.Listener.Addr().String(), "x-shout/1")
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got status %d; want 101", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Upgrade"); got != "x-shout/1" {
+		t.Fatalf("got Upgrade header %q; want x-shout/1", got)
+	}
+	for _, msg := range []string{"hello", "tunneled bytes"} {
+		fmt.Fprintf(conn, "%s\n", msg)
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := strings.ToUpper(msg) + "\n"; line != want {
+			t.Fatalf("got %q through the tunnel; want %q", line, want)
+		}
+	}
+
+	// A normal request to the same backend still takes the usual path.
+	plain, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain.Body.Close()
+	if plain.StatusCode != http.StatusUpgradeRequired {
+		t.Fatalf("plain request: got status %d; want 426", plain.StatusCode)
+	}
+}
+
+func TestUpgradeMismatch(t *testing.T) {
+	backend := newUpgradeBackend("x-shout/1", "x-other/1")
+	_, server := startProxy(t, `[{"from": {}, "to": {"addr": "{{backend1}}"}}]`, backend)
+	_, _, resp := dialUpgrade(t, server.Listener.Addr().String(), "x-shout/1")
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("backend switched to the wrong protocol: got status %d; want 502", resp.StatusCode)
+	}
+}
@@ -0,0 +1,3 @@
+module github.com/cespare/erebus
+
+go 1.20
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// starterConfig is the example configuration written by -init. JSON has no comments, so the explanations are
+// in "comment" fields, which erebus ignores.
+const starterConfig = `[
+  {
+    "comment": "Rules are tried in order; each request is handled by the first rule that matches it. This one matches requests for example.com (any path) and proxies them to the backend at localhost:8100.",
+    "from": {"host": "example.com"},
+    "to":   {"addr": "localhost:8100"}
+  },
+  {
+    "comment": "Match exactly one path.",
+    "from": {"path": "/healthz"},
+    "respond": {"status": 200, "body": "ok"}
+  },
+  {
+    "comment": "Match every path starting with /api/ (such as /api/users).",
+    "from": {"pathprefix": "/api/"},
+    "to":   {"addr": "localhost:8101"}
+  },
+  {
+    "comment": "Match paths with a regular expression (anywhere in the path, unless pathregexfullmatch is set).",
+    "from": {"pathregex": "^/static/.+\\.(css|js)$"},
+    "to":   {"addr": "localhost:8102"}
+  },
+  {
+    "comment": "An empty 'from' matches everything, so this catches the requests no other rule matched.",
+    "from": {},
+    "respond": {"status": 404, "body": "Not found."}
+  }
+]
+`
+
+// writeStarterConfig writes starterConfig to a new file at path. It fails if the file already exists.
+func writeStarterConfig(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("%s already exists", path)
+		}
+		return err
+	}
+	if _, err := f.WriteString(starterConfig); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
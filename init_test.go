@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/cespare/erebus/erebus"
+)
+
+func TestWriteStarterConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conf.json")
+	if err := writeStarterConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := erebus.NewProxyFromRules(contents)
+	if err != nil {
+		t.Fatalf("the starter config doesn't parse: %s", err)
+	}
+	if len(proxy.Rules) != 5 {
+		t.Errorf("got %d rules; want 5", len(proxy.Rules))
+	}
+	for _, tc := range []struct {
+		url  string
+		rule int
+	}{
+		{"http://example.com/anything", 0},
+		{"http://localhost/healthz", 1},
+		{"http://localhost/api/users", 2},
+		{"http://localhost/static/app.js", 3},
+		{"http://localhost/other", 4},
+	} {
+		r := httptest.NewRequest("GET", tc.url, nil)
+		for i, rule := range proxy.Rules {
+			if rule.From.Matches(r) {
+				if i != tc.rule {
+					t.Errorf("%s matched rule %d; want rule %d", tc.url, i, tc.rule)
+				}
+				break
+			}
+		}
+	}
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/healthz", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "ok" {
+		t.Errorf("GET /healthz: got %d %q; want 200 \"ok\"", w.Code, w.Body)
+	}
+
+	// An existing file isn't overwritten.
+	if err := ioutil.WriteFile(path, []byte("[]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeStarterConfig(path); err == nil {
+		t.Error("writing over an existing file: expected an error")
+	}
+	if contents, _ := ioutil.ReadFile(path); string(contents) != "[]" {
+		t.Errorf("the existing file was changed to %q", contents)
+	}
+}
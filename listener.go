@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// limitListener is a net.Listener which accepts at most n simultaneous connections; Accept blocks until an
+// existing connection is closed. It is equivalent to golang.org/x/net/netutil.LimitListener.
+//
+// The limit applies to client connections only. It is independent of any limits on the number of backend
+// connections, which are pooled separately by the transport. With keep-alives enabled, idle client
+// connections count towards the limit.
+type limitListener struct {
+	net.Listener
+	sem chan struct{}
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newLimitListener(l net.Listener, n int) *limitListener {
+	return &limitListener{
+		Listener: l,
+		sem:      make(chan struct{}, n),
+		done:     make(chan struct{}),
+	}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	select {
+	case l.sem <- struct{}{}:
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+	c, err := l.Listener.Accept()
+	if err != nil {
+		<-l.sem
+		return nil, err
+	}
+	return &limitListenerConn{Conn: c, release: func() { <-l.sem }}, nil
+}
+
+func (l *limitListener) Close() error {
+	err := l.Listener.Close()
+	l.closeOnce.Do(func() { close(l.done) })
+	return err
+}
+
+type limitListenerConn struct {
+	net.Conn
+	releaseOnce sync.Once
+	release     func()
+}
+
+func (c *limitListenerConn) Close() error {
+	err := c.Conn.Close()
+	c.releaseOnce.Do(c.release)
+	return err
+}
+
+// keepAliveListener is a net.Listener which sets the TCP keep-alive period of each accepted connection. A
+// negative period disables keep-alives.
+type keepAliveListener struct {
+	net.Listener
+	period time.Duration
+}
+
+// keepAliveConn is implemented by *net.TCPConn.
+type keepAliveConn interface {
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(d time.Duration) error
+}
+
+func (l *keepAliveListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if kc, ok := c.(keepAliveConn); ok {
+		if l.period < 0 {
+			kc.SetKeepAlive(false)
+		} else {
+			kc.SetKeepAlive(true)
+			kc.SetKeepAlivePeriod(l.period)
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLimitListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newLimitListener(inner, 2)
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 10)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		c, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+	}
+
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		select {
+		case c := <-accepted:
+			conns = append(conns, c)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d connections were accepted; want 2", i)
+		}
+	}
+	select {
+	case <-accepted:
+		t.Fatal("a connection beyond the limit was accepted")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Closing a connection makes room for the waiting one.
+	conns[0].Close()
+	select {
+	case c := <-accepted:
+		c.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("the waiting connection was not accepted after another was closed")
+	}
+	conns[1].Close()
+}
+
+// fakeKeepAliveConn records the keep-alive settings applied to it.
+type fakeKeepAliveConn struct {
+	net.Conn
+	keepAlive bool
+	period    time.Duration
+}
+
+func (c *fakeKeepAliveConn) SetKeepAlive(keepAlive bool) error {
+	c.keepAlive = keepAlive
+	return nil
+}
+
+func (c *fakeKeepAliveConn) SetKeepAlivePeriod(d time.Duration) error {
+	c.period = d
+	return nil
+}
+
+type fakeListener struct {
+	net.Listener
+	conn net.Conn
+}
+
+func (l *fakeListener) Accept() (net.Conn, error) { return l.conn, nil }
+
+func TestKeepAliveListener(t *testing.T) {
+	for _, tc := range []struct {
+		period        time.Duration
+		wantKeepAlive bool
+		wantPeriod    time.Duration
+	}{
+		{30 * time.Second, true, 30 * time.Second},
+		{-1, false, 0},
+	} {
+		conn := &fakeKeepAliveConn{}
+		l := &keepAliveListener{Listener: &fakeListener{conn: conn}, period: tc.period}
+		if _, err := l.Accept(); err != nil {
+			t.Fatal(err)
+		}
+		if conn.keepAlive != tc.wantKeepAlive || conn.period != tc.wantPeriod {
+			t.Errorf("period %s: got keep-alive %t with period %s; want %t with period %s", tc.period,
+				conn.keepAlive, conn.period, tc.wantKeepAlive, tc.wantPeriod)
+		}
+	}
+
+	// Real TCP connections are configured without error.
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &keepAliveListener{Listener: inner, period: 10 * time.Second}
+	defer l.Close()
+	c, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+	if _, ok := accepted.(keepAliveConn); !ok {
+		t.Errorf("accepted connection of type %T does not support keep-alive settings", accepted)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// timeLayouts are the names accepted by -logtimeformat in place of a Go time layout.
+var timeLayouts = map[string]string{
+	"rfc3339":     time.RFC3339,
+	"rfc3339nano": time.RFC3339Nano,
+}
+
+// parseTimeLayout returns the time layout named by s, or s itself if it isn't a known name.
+func parseTimeLayout(s string) string {
+	if layout, ok := timeLayouts[strings.ToLower(s)]; ok {
+		return layout
+	}
+	return s
+}
+
+// A timestampWriter prefixes each write (one log line, when used as the output of a log.Logger with no flags)
+// with the current time in the given layout.
+type timestampWriter struct {
+	w      io.Writer
+	layout string
+	utc    bool
+	now    func() time.Time
+
+	mu sync.Mutex
+}
+
+func newTimestampWriter(w io.Writer, layout string, utc bool) *timestampWriter {
+	return &timestampWriter{w: w, layout: layout, utc: utc, now: time.Now}
+}
+
+func (tw *timestampWriter) Write(b []byte) (int, error) {
+	t := tw.now()
+	if tw.utc {
+		t = t.UTC()
+	}
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if _, err := fmt.Fprintf(tw.w, "%s %s", t.Format(tw.layout), b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"testing"
+	"time"
+)
+
+func TestTimestampWriter(t *testing.T) {
+	now := time.Date(2020, 3, 4, 5, 6, 7, 0, time.FixedZone("UTC-8", -8*60*60))
+	for _, tc := range []struct {
+		format string
+		utc    bool
+		want   string
+	}{
+		{"rfc3339", false, "2020-03-04T05:06:07-08:00 hello\n"},
+		{"RFC3339", true, "2020-03-04T13:06:07Z hello\n"},
+		{"2006/01/02 15:04:05.000", true, "2020/03/04 13:06:07.000 hello\n"},
+	} {
+		var buf bytes.Buffer
+		tw := newTimestampWriter(&buf, parseTimeLayout(tc.format), tc.utc)
+		tw.now = func() time.Time { return now }
+		log.New(tw, "", 0).Print("hello")
+		if got := buf.String(); got != tc.want {
+			t.Errorf("format %q (utc=%t): got log line %q; want %q", tc.format, tc.utc, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cespare/erebus/erebus"
+)
+
+var (
+	listenAddr = flag.String("listenaddr", "localhost:3111", "The address on which erebus should listen")
+	listenNet  = flag.String("listennet", "tcp", "The network on which to listen: tcp, tcp4 (IPv4 only), or tcp6")
+	configFile = flag.String("conf", "conf.json", "The configuration file to use (- for stdin)")
+	verbose    = flag.Bool("verbose", false, "Log each request")
+	debugMatch = flag.Bool("debugmatch", false, "Log the rules tried for each request and why they didn't match")
+	showVer    = flag.Bool("version", false, "Print version information and exit")
+	initConf   = flag.Bool("init", false, "Write an example configuration to the -conf file (if it's new) and exit")
+	testReq    = flag.String("testrequest", "", `Print how a request ("METHOD URL") would be routed, and exit`)
+	tlsCert    = flag.String("tlscert", "", "A TLS certificate file; if given (with -tlskey), erebus serves HTTPS")
+	tlsKey     = flag.String("tlskey", "", "The TLS key file corresponding to -tlscert")
+	tlsCerts   = flag.String("tlscerts", "", "A JSON file listing TLS certificates for particular hosts (by SNI)")
+	clientCA   = flag.String("clientca", "", "A file of CA certificates used to verify TLS client certificates")
+	localAddr  = flag.String("localaddr", "", "The local IP address from which to make backend connections")
+	proxyProto = flag.Bool("proxyprotocol", false, "Expect a PROXY protocol header on each client connection")
+	maxConns   = flag.Int("maxconns", 0, "The maximum number of simultaneous client connections (0 for no limit)")
+
+	maxHeaderBytes = flag.Int("maxheaderbytes", 0,
+		"The maximum size of client request headers (0 means the Go default of 1MB)")
+	keepAlive   = flag.Bool("keepalive", true, "Allow clients to reuse connections (HTTP keep-alive)")
+	idleTimeout = flag.Duration("idletimeout", 0,
+		"How long to keep idle client connections open (0 means use the read timeout, if any)")
+	tcpKeepAlive = flag.Duration("tcpkeepalive", 0,
+		"The TCP keep-alive period for client connections (0 means the Go default; negative disables them)")
+
+	admin      = flag.Bool("admin", false, "Serve the admin endpoints (such as "+reloadPath+")")
+	adminAllow = flag.String("adminallow", "127.0.0.0/8,::1/128",
+		"Comma-separated networks from which clients may use the admin endpoints")
+	controlSocket = flag.String("controlsocket", "",
+		"If given, the path of a Unix socket on which to accept control commands (such as reload and drain)")
+
+	maintenance     = flag.Bool("maintenance", false, "Start in maintenance mode (see "+maintenancePath+")")
+	maintenancePage = flag.String("maintenancepage", "", "An HTML file to serve (with a 503) in maintenance mode")
+
+	watch         = flag.Bool("watch", false, "Reload the configuration whenever the -conf file changes")
+	watchDebounce = flag.Duration("watchdebounce", 500*time.Millisecond,
+		"With -watch, wait until the file has been unchanged for this long before reloading")
+
+	trustForwardedProto = flag.Bool("trustforwardedproto", false,
+		"Trust the X-Forwarded-Proto header to give the scheme of client requests")
+
+	httpsRedirectAddr = flag.String("httpsredirectaddr", "",
+		"If given, an address on which to serve plain HTTP, redirecting every request to HTTPS")
+
+	backendAllowlist = flag.String("backendallowlist", "",
+		`Comma-separated host patterns (such as "*.internal"); if given, rules may only use matching backends`)
+
+	healthCheckConcurrency = flag.Int("healthcheckconcurrency", 10,
+		"The maximum number of backend health checks to run at once")
+
+	pprofAddr = flag.String("pprof", "", "If given, an address on which to serve the pprof profiling endpoints")
+
+	logTimeFormat = flag.String("logtimeformat", "",
+		"The format of log timestamps: a Go time layout, rfc3339, or rfc3339nano (by default, the log package's)")
+	logUTC   = flag.Bool("logutc", false, "Use UTC for log timestamps")
+	logLevel = flag.String("loglevel", "info",
+		"The level of messages to log: error, warn, info (including the access log), or debug")
+	logFormat = flag.String("logformat", "", "The access log format: the default, or clf (Combined Log Format)")
+
+	allowMethods = flag.String("allowmethods", "",
+		"Comma-separated request methods to permit (by default, any)")
+	cleanPath = flag.Bool("cleanpath", false,
+		"Resolve dot segments and repeated slashes in request paths before matching them against the rules")
+	maxURLLen = flag.Int("maxurllen", 65536, "The maximum length of request URLs (0 for no limit)")
+
+	noMatchStatus = flag.Int("nomatchstatus", http.StatusBadGateway,
+		"The status of responses to requests which match no rule")
+	noMatchBody = flag.String("nomatchbody", "No matching rule.", "The body of responses to requests which match no rule")
+
+	slowThreshold = flag.Duration("slowthreshold", 0, "Log a warning for requests slower than this (0 to disable)")
+
+	maxResponseHeaderBytes = flag.Int64("maxresponseheaderbytes", 0,
+		"The maximum size of backend response headers (0 means the Go default)")
+	maxConnsPerHost = flag.Int("maxconnsperhost", 0,
+		"The maximum number of connections to each backend (0 for no limit)")
+	maxConnAge = flag.Duration("maxconnage", 0,
+		"Don't reuse backend connections older than this (0 to reuse connections indefinitely)")
+	dialTimeout           = flag.Duration("dialtimeout", 30*time.Second, "The timeout for connecting to a backend")
+	responseHeaderTimeout = flag.Duration("responseheadertimeout", 0,
+		"The timeout for receiving a backend's response headers (0 for no limit)")
+	copyBufferSize = flag.Int("copybuffersize", 0,
+		"The size of the buffer used to relay each response body, in bytes (0 means 32KB)")
+	maxResponseBytes = flag.Int64("maxresponsebytes", 0,
+		"The maximum size of backend response bodies relayed to clients (0 for no limit)")
+	bodyReadTimeout = flag.Duration("bodyreadtimeout", 0,
+		"Abort responses whose backend sends no body data for this long (0 for no limit)")
+	maxBackground = flag.Int("maxbackground", 100,
+		"The maximum number of mirrored requests and cache refreshes in flight at once; more are dropped")
+	backgroundTimeout = flag.Duration("backgroundtimeout", 30*time.Second,
+		"The timeout for mirrored requests and cache refreshes")
+)
+
+// listen listens on addr using network, which must be "tcp", "tcp4", or "tcp6".
+func listen(network, addr string) (net.Listener, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("unsupported listen network %q", network)
+	}
+	return net.Listen(network, addr)
+}
+
+// newServer creates the http.Server for serving h, configured by the flags.
+func newServer(h http.Handler) *http.Server {
+	server := &http.Server{
+		Handler:        h,
+		MaxHeaderBytes: *maxHeaderBytes,
+		IdleTimeout:    *idleTimeout,
+	}
+	server.SetKeepAlivesEnabled(*keepAlive)
+	return server
+}
+
+// newTLSConfig constructs the TLS configuration for serving HTTPS. The certificate in certFile (if given) is
+// the default; hostCertsFile (if given) lists certificates to use for particular hosts, chosen by SNI. If caFile
+// is given, clients may present certificates signed by one of its CAs.
+func newTLSConfig(certFile, keyFile, hostCertsFile, caFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if hostCertsFile != "" {
+		certs, err := loadHostCerts(hostCertsFile)
+		if err != nil {
+			return nil, err
+		}
+		config.GetCertificate = sniCertificate(certs)
+	}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+func main() {
+	var testHeaders headerFlags
+	flag.Var(&testHeaders, "testheader", `A header ("Name: value") for -testrequest; may be repeated`)
+	var responseHeaders headerFlags
+	flag.Var(&responseHeaders, "responseheader",
+		`A header ("Name: value") to add to every response which doesn't have it; may be repeated`)
+	flag.Parse()
+	if *showVer {
+		printVersion(os.Stdout)
+		return
+	}
+	if *initConf {
+		if *configFile == "-" {
+			fmt.Print(starterConfig)
+			return
+		}
+		if err := writeStarterConfig(*configFile); err != nil {
+			log.Fatalf("Error writing an example configuration: %s", err)
+		}
+		erebus.LogInfof("Wrote an example configuration to %s", *configFile)
+		return
+	}
+	level, err := erebus.ParseLogLevel(*logLevel)
+	if err != nil {
+		log.Fatalf("Bad -loglevel: %s", err)
+	}
+	erebus.SetLogLevel(level)
+	if *logFormat != "" && *logFormat != erebus.LogFormatCLF {
+		log.Fatalf("Unknown -logformat: %q", *logFormat)
+	}
+	if *noMatchStatus < 100 || *noMatchStatus > 599 {
+		log.Fatalf("Bad -nomatchstatus: %d", *noMatchStatus)
+	}
+	switch {
+	case *logTimeFormat != "":
+		log.SetFlags(0)
+		log.SetOutput(newTimestampWriter(os.Stderr, parseTimeLayout(*logTimeFormat), *logUTC))
+	case *logUTC:
+		log.SetFlags(log.LstdFlags | log.LUTC)
+	}
+	transportConf := &erebus.TransportConf{
+		LocalAddr:              *localAddr,
+		MaxResponseHeaderBytes: *maxResponseHeaderBytes,
+		MaxConnsPerHost:        *maxConnsPerHost,
+		MaxConnAge:             *maxConnAge,
+		DialTimeout:            *dialTimeout,
+		ResponseHeaderTimeout:  *responseHeaderTimeout,
+	}
+	transport, err := transportConf.NewTransport()
+	if err != nil {
+		log.Fatalf("Error with transport configuration: %s", err)
+	}
+	// The transport is shared across reloads so that backend connections are reused.
+	// With -conf -, the configuration is read from stdin. That can only be done once, so reloading reapplies the
+	// same rules.
+	var stdinConf []byte
+	if *configFile == "-" {
+		if stdinConf, err = ioutil.ReadAll(os.Stdin); err != nil {
+			log.Fatalf("Error reading configuration from stdin: %s", err)
+		}
+	}
+	var backendPatterns []string
+	for _, pattern := range strings.Split(*backendAllowlist, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			backendPatterns = append(backendPatterns, pattern)
+		}
+	}
+	defaultHeaders := make(http.Header)
+	for _, h := range responseHeaders {
+		name, value := splitHeader(h)
+		defaultHeaders.Add(name, value)
+	}
+	var methods []string
+	for _, m := range strings.Split(*allowMethods, ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			methods = append(methods, strings.ToUpper(m))
+		}
+	}
+	load := func() (*erebus.Proxy, error) {
+		contents := stdinConf
+		if *configFile != "-" {
+			var err error
+			if contents, err = readConfigFile(*configFile); err != nil {
+				return nil, err
+			}
+		}
+		proxy, err := erebus.NewProxyFromRules(contents)
+		if err != nil {
+			return nil, err
+		}
+		proxy.BackendAllowlist = backendPatterns
+		if err := proxy.CheckBackends(); err != nil {
+			return nil, fmt.Errorf("error with configuration: %s", err)
+		}
+		proxy.Transport = transport
+		proxy.SlowThreshold = *slowThreshold
+		proxy.TrustForwardedProto = *trustForwardedProto
+		proxy.LogFormat = *logFormat
+		proxy.AccessLog = os.Stderr // The log's own output may add a -logtimeformat timestamp
+		proxy.BodyReadTimeout = *bodyReadTimeout
+		proxy.MaxResponseBytes = *maxResponseBytes
+		proxy.CopyBufferSize = *copyBufferSize
+		proxy.MaxBackground = *maxBackground
+		proxy.BackgroundTimeout = *backgroundTimeout
+		proxy.AllowMethods = methods
+		proxy.MaxURLLength = *maxURLLen
+		proxy.CleanPath = *cleanPath
+		proxy.DebugMatch = *debugMatch
+		proxy.NoMatchStatus = *noMatchStatus
+		proxy.NoMatchBody = *noMatchBody
+		proxy.ResponseHeaders = defaultHeaders
+		return proxy, nil
+	}
+	if *testReq != "" {
+		proxy, err := load()
+		if err != nil {
+			log.Fatalf("Error with configuration %s: %s", *configFile, err)
+		}
+		matched, err := testRequest(os.Stdout, proxy, *testReq, testHeaders)
+		if err != nil {
+			log.Fatalf("Bad -testrequest: %s", err)
+		}
+		if !matched {
+			os.Exit(1)
+		}
+		return
+	}
+	rl, err := newReloader(load)
+	if err != nil {
+		log.Fatalf("Error with configuration %s: %s", *configFile, err)
+	}
+	if *maintenancePage != "" {
+		if rl.maintenance.page, err = ioutil.ReadFile(*maintenancePage); err != nil {
+			log.Fatalf("Error reading the maintenance page: %s", err)
+		}
+	}
+	rl.maintenance.set(*maintenance)
+	if rl.admin = *admin; rl.admin {
+		if rl.adminAllow, err = parseNetworks(*adminAllow); err != nil {
+			log.Fatalf("Bad -adminallow: %s", err)
+		}
+	}
+	rl.health.Concurrency = *healthCheckConcurrency
+	go rl.health.Run(context.Background(), rl.current)
+	go rl.reloadOnSignal()
+	if *watch {
+		if *configFile == "-" {
+			log.Fatal("-watch cannot be used with -conf -")
+		}
+		go rl.reloadOnChange(*configFile, *watchDebounce)
+	}
+
+	if *controlSocket != "" {
+		l, err := listenControl(*controlSocket)
+		if err != nil {
+			log.Fatalf("Error listening on the control socket: %s", err)
+		}
+		go func() {
+			log.Fatal(rl.serveControl(l))
+		}()
+	}
+
+	if *pprofAddr != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(*pprofAddr, pprofHandler()))
+		}()
+	}
+
+	server := newServer(rl)
+	if *tlsCert != "" || *tlsCerts != "" {
+		if server.TLSConfig, err = newTLSConfig(*tlsCert, *tlsKey, *tlsCerts, *clientCA); err != nil {
+			log.Fatalf("Error with TLS configuration: %s", err)
+		}
+	}
+	if *httpsRedirectAddr != "" {
+		// When erebus serves HTTPS itself, redirect to its port; otherwise, TLS is presumably terminated in
+		// front of erebus on the default port.
+		var httpsPort string
+		if server.TLSConfig != nil {
+			if _, httpsPort, err = net.SplitHostPort(*listenAddr); err != nil {
+				log.Fatalf("Bad -listenaddr: %s", err)
+			}
+		}
+		go func() {
+			log.Fatal(http.ListenAndServe(*httpsRedirectAddr, httpsRedirectHandler(httpsPort)))
+		}()
+	}
+	listener, err := listen(*listenNet, *listenAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *tcpKeepAlive != 0 {
+		listener = &keepAliveListener{Listener: listener, period: *tcpKeepAlive}
+	}
+	if *maxConns > 0 {
+		listener = newLimitListener(listener, *maxConns)
+	}
+	if *proxyProto {
+		listener = &proxyProtoListener{listener}
+	}
+	erebus.LogInfof("Now listening on %s", *listenAddr)
+	if server.TLSConfig == nil {
+		log.Fatal(server.Serve(listener))
+	}
+	log.Fatal(server.ServeTLS(listener, "", ""))
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cespare/erebus/erebus"
+)
+
+// startServer starts a test server for h using the http.Server from newServer, with flags as set by
+// setFlags. The flags are restored before startServer returns.
+func startServer(t *testing.T, h http.Handler, setFlags func()) *httptest.Server {
+	defer func(oldMaxHeaderBytes int, oldKeepAlive bool) {
+		*maxHeaderBytes, *keepAlive = oldMaxHeaderBytes, oldKeepAlive
+	}(*maxHeaderBytes, *keepAlive)
+	setFlags()
+	server := httptest.NewUnstartedServer(h)
+	server.Config = newServer(h)
+	server.Start()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	proxy, err := erebus.NewProxyFromRules([]byte(`[{"from": {}, "respond": {"body": "ok"}}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := startServer(t, proxy, func() { *maxHeaderBytes = 1024 })
+
+	for _, tc := range []struct {
+		size   int
+		status int
+	}{
+		{100, http.StatusOK},
+		// The server allows a little slack (4KB) beyond MaxHeaderBytes.
+		{10000, http.StatusRequestHeaderFieldsTooLarge},
+	} {
+		req, err := http.NewRequest("GET", server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Big", strings.Repeat("x", tc.size))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("header of %d bytes: got status %d; want %d", tc.size, resp.StatusCode, tc.status)
+		}
+	}
+}
+
+func TestKeepAliveDisabled(t *testing.T) {
+	proxy, err := erebus.NewProxyFromRules([]byte(`[{"from": {}, "respond": {"body": "ok"}}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, enabled := range []bool{true, false} {
+		server := startServer(t, proxy, func() { *keepAlive = enabled })
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.Close == enabled {
+			t.Errorf("keepalive=%t: got Connection: close=%t", enabled, resp.Close)
+		}
+		if !enabled {
+			// The server should have closed the connection.
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := br.ReadByte(); err != io.EOF {
+				t.Errorf("keepalive=false: reading after the response got %v; want EOF", err)
+			}
+		}
+	}
+}
+
+func TestListenNetwork(t *testing.T) {
+	l, err := listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			c.Close()
+		}
+	}()
+	conn, err := net.Dial("tcp4", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if ip := l.Addr().(*net.TCPAddr).IP; ip.To4() == nil {
+		t.Errorf("tcp4 listener has non-IPv4 address %s", ip)
+	}
+
+	if _, err := listen("tcp4", "[::1]:0"); err == nil {
+		t.Error("expected an error listening on tcp4 at an IPv6 address")
+	}
+	if _, err := listen("udp", "127.0.0.1:0"); err == nil {
+		t.Error("expected an error for a non-TCP listen network")
+	}
+}
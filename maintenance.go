@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/cespare/erebus/erebus"
+)
+
+const maintenancePath = "/__erebus_maintenance"
+
+// A maintenanceMode, when enabled, answers every request with a 503 maintenance page instead of applying the
+// rules. It is kept separately from the rules so that it survives reloads.
+type maintenanceMode struct {
+	enabled int32 // Accessed atomically
+	page    []byte
+}
+
+func (m *maintenanceMode) isEnabled() bool { return atomic.LoadInt32(&m.enabled) != 0 }
+
+func (m *maintenanceMode) set(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&m.enabled, v)
+}
+
+func (m *maintenanceMode) serve(w http.ResponseWriter) {
+	if m.page == nil {
+		http.Error(w, "Down for maintenance.", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write(m.page)
+}
+
+// serveMaintenance serves the admin endpoint for maintenance mode: GET reports whether it's enabled, and POST
+// with enabled=true or enabled=false turns it on or off.
+func (rl *reloader) serveMaintenance(w http.ResponseWriter, r *http.Request) {
+	if !rl.adminAllowed(r) {
+		http.Error(w, "Forbidden.", http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case "GET":
+	case "POST":
+		enabled, err := strconv.ParseBool(r.FormValue("enabled"))
+		if err != nil {
+			http.Error(w, "enabled must be true or false", http.StatusBadRequest)
+			return
+		}
+		rl.maintenance.set(enabled)
+		if enabled {
+			erebus.LogInfof("#yellow{Maintenance mode enabled}")
+		} else {
+			erebus.LogInfof("#green{Maintenance mode disabled}")
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	fmt.Fprintf(w, "Maintenance mode enabled: %t.\n", rl.maintenance.isEnabled())
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+	rl, _ := newFileReloader(t, `[{"from": {}, "respond": {"body": "normal"}}]`)
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		rl.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		return w
+	}
+	setMaintenance := func(enabled, remoteAddr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", maintenancePath+"?enabled="+enabled, nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		rl.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := get(); w.Code != http.StatusOK || w.Body.String() != "normal" {
+		t.Fatalf("before maintenance: got %d %q; want 200 \"normal\"", w.Code, w.Body)
+	}
+
+	if w := setMaintenance("true", "192.0.2.1:5000"); w.Code != http.StatusForbidden {
+		t.Errorf("enabling maintenance from a disallowed client: got status %d; want 403", w.Code)
+	}
+	if w := setMaintenance("true", "127.0.0.1:5000"); w.Code != http.StatusOK {
+		t.Fatalf("enabling maintenance: got status %d; want 200", w.Code)
+	}
+	if w := get(); w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "maintenance") {
+		t.Errorf("in maintenance: got %d %q; want a 503 maintenance page", w.Code, w.Body)
+	}
+
+	// Maintenance mode survives a reload.
+	if w := postReload(rl, "127.0.0.1:5000"); w.Code != http.StatusOK {
+		t.Fatalf("reload: got status %d; want 200", w.Code)
+	}
+	if w := get(); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("in maintenance after a reload: got status %d; want 503", w.Code)
+	}
+
+	rl.maintenance.page = []byte("<h1>Back soon</h1>")
+	w := get()
+	if ct := w.Header().Get("Content-Type"); w.Body.String() != "<h1>Back soon</h1>" || ct != "text/html; charset=utf-8" {
+		t.Errorf("with a maintenance page: got %q (Content-Type %q); want the page", w.Body, ct)
+	}
+
+	if w := setMaintenance("bogus", "127.0.0.1:5000"); w.Code != http.StatusBadRequest {
+		t.Errorf("setting maintenance to a non-boolean: got status %d; want 400", w.Code)
+	}
+	if w := setMaintenance("false", "127.0.0.1:5000"); w.Code != http.StatusOK {
+		t.Fatalf("disabling maintenance: got status %d; want 200", w.Code)
+	}
+	if w := get(); w.Code != http.StatusOK || w.Body.String() != "normal" {
+		t.Errorf("after maintenance: got %d %q; want 200 \"normal\"", w.Code, w.Body)
+	}
+}
+
+func TestMaintenanceResponseHeaders(t *testing.T) {
+	rl, _ := newFileReloader(t, `[{"from": {}, "respond": {"body": "normal"}}]`)
+	rl.current().ResponseHeaders = http.Header{"X-Frame-Options": {"DENY"}}
+	rl.maintenance.set(true)
+	w := httptest.NewRecorder()
+	rl.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("X-Frame-Options") != "DENY" {
+		t.Errorf("in maintenance: got %d with X-Frame-Options %q; want 503 with DENY", w.Code,
+			w.Header().Get("X-Frame-Options"))
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cespare/erebus/erebus"
+)
+
+func TestPprofHandler(t *testing.T) {
+	server := httptest.NewServer(pprofHandler())
+	defer server.Close()
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/goroutine?debug=1"} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "goroutine") {
+			t.Errorf("%s: got status %d and body %q; want a profile", path, resp.StatusCode, body)
+		}
+	}
+
+	// The profiling endpoints aren't served by the proxy itself.
+	proxy, err := erebus.NewProxyFromRules([]byte(`[{"from": {"path": "/"}, "respond": {"body": "ok"}}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+	resp, err := http.Get(proxyServer.URL + "/debug/pprof/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("proxy request for /debug/pprof/: got status %d; want 502", resp.StatusCode)
+	}
+}
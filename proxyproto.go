@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyProtoListener wraps a net.Listener whose connections begin with a PROXY protocol (v1) header, as sent
+// by load balancers such as HAProxy and ELB. The RemoteAddr of each accepted connection is the client address
+// given by the header.
+type proxyProtoListener struct {
+	net.Listener
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtoConn{Conn: c, r: bufio.NewReader(c)}, nil
+}
+
+// proxyProtoHeaderTimeout bounds how long we wait for the PROXY header on a new connection.
+const proxyProtoHeaderTimeout = 10 * time.Second
+
+// proxyProtoConn reads the PROXY header lazily (on the first Read or RemoteAddr) so that Accept does not block
+// on slow clients.
+type proxyProtoConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+func (c *proxyProtoConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyProtoHeaderTimeout))
+		c.remoteAddr, c.err = readProxyProtoHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+	})
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// maxProxyProtoHeaderLen is the maximum length of a v1 header, including the trailing CRLF.
+const maxProxyProtoHeaderLen = 107
+
+// readProxyProtoHeader parses a v1 PROXY protocol header such as
+//
+//	PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n
+//
+// and returns the source address. For the UNKNOWN protocol it returns a nil address.
+func readProxyProtoHeader(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < maxProxyProtoHeaderLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("error reading PROXY protocol header: %s", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	header := string(line)
+	if !strings.HasSuffix(header, "\r\n") {
+		return nil, fmt.Errorf("malformed PROXY protocol header")
+	}
+	fields := strings.Fields(header)
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("malformed PROXY protocol header: %q", header)
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol: %q", fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("malformed PROXY protocol header: %q", header)
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil {
+		return nil, fmt.Errorf("invalid PROXY protocol source address: %q", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY protocol source port: %q", fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cespare/erebus/erebus"
+)
+
+func TestReadProxyProtoHeader(t *testing.T) {
+	for _, tc := range []struct {
+		header string
+		want   string // "" means a nil address; "error" means an error
+	}{
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", "192.0.2.1:56324"},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", "[2001:db8::1]:56324"},
+		{"PROXY UNKNOWN\r\n", ""},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n", "error"},
+		{"PROXY TCP4 bogus 198.51.100.1 56324 443\r\n", "error"},
+		{"PROXY UDP4 192.0.2.1 198.51.100.1 56324 443\r\n", "error"},
+		{"GET / HTTP/1.1\r\n", "error"},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n", "error"},
+		{"PROXY " + strings.Repeat("x", 200) + "\r\n", "error"},
+	} {
+		addr, err := readProxyProtoHeader(bufio.NewReader(strings.NewReader(tc.header)))
+		var got string
+		switch {
+		case err != nil:
+			got = "error"
+		case addr != nil:
+			got = addr.String()
+		}
+		if got != tc.want {
+			t.Errorf("readProxyProtoHeader(%q): got %q (err=%v); want %q", tc.header, got, err, tc.want)
+		}
+	}
+}
+
+func TestProxyProtoForwardedFor(t *testing.T) {
+	forwardedFor := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwardedFor <- r.Header.Get("X-Forwarded-For")
+	}))
+	defer backend.Close()
+	proxy, err := erebus.NewProxyFromRules([]byte(fmt.Sprintf(`[{"from": {}, "to": {"addr": %q}}]`,
+		strings.TrimPrefix(backend.URL, "http://"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(proxy)
+	server.Listener = &proxyProtoListener{server.Listener}
+	server.Start()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "PROXY TCP4 203.0.113.7 198.51.100.1 56324 80\r\n")
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := <-forwardedFor; got != "203.0.113.7" {
+		t.Fatalf("backend got X-Forwarded-For %q; want 203.0.113.7", got)
+	}
+}
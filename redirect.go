@@ -0,0 +1,16 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/cespare/erebus/erebus"
+)
+
+// httpsRedirectHandler answers every request with a redirect to HTTPS (see erebus.RedirectToHTTPS), using
+// httpsPort as the port of the redirect target. It is served on its own listener (see -httpsredirectaddr),
+// never through the proxy.
+func httpsRedirectHandler(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		erebus.RedirectToHTTPS(w, r, httpsPort)
+	})
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPSRedirectHandler(t *testing.T) {
+	for _, tt := range []struct {
+		httpsPort string
+		host      string
+		uri       string
+		want      string
+	}{
+		{"", "example.com", "/a/b?c=d", "https://example.com/a/b?c=d"},
+		{"", "example.com:8080", "/", "https://example.com/"},
+		{"443", "example.com:80", "/x", "https://example.com/x"},
+		{"8443", "example.com:8080", "/x", "https://example.com:8443/x"},
+		{"8443", "example.com", "/x", "https://example.com:8443/x"},
+		{"", "[::1]:8080", "/x", "https://[::1]/x"},
+		{"8443", "[::1]:8080", "/x", "https://[::1]:8443/x"},
+	} {
+		r := httptest.NewRequest("GET", tt.uri, nil)
+		r.Host = tt.host
+		w := httptest.NewRecorder()
+		httpsRedirectHandler(tt.httpsPort).ServeHTTP(w, r)
+		if loc := w.Header().Get("Location"); w.Code != http.StatusMovedPermanently || loc != tt.want {
+			t.Errorf("(port %q) %s%s: got %d to %q; want 301 to %q", tt.httpsPort, tt.host, tt.uri, w.Code, loc, tt.want)
+		}
+	}
+
+	// Other methods get a 308, so that clients repeat them (rather than switching to GET).
+	for method, want := range map[string]int{"HEAD": 301, "POST": 308, "PUT": 308} {
+		r := httptest.NewRequest(method, "/x", nil)
+		r.Host = "example.com"
+		w := httptest.NewRecorder()
+		httpsRedirectHandler("").ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("%s: got status %d; want %d", method, w.Code, want)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Host = ""
+	w := httptest.NewRecorder()
+	httpsRedirectHandler("").ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("request without a Host: got status %d; want 400", w.Code)
+	}
+}
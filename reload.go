@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cespare/erebus/erebus"
+)
+
+// A reloader serves requests using a Proxy which may be replaced at runtime by reloading the configuration,
+// either on SIGHUP or (if enabled) via the admin reload endpoint.
+type reloader struct {
+	load       func() (*erebus.Proxy, error)
+	admin      bool         // Whether to serve the admin endpoints
+	adminAllow []*net.IPNet // The client networks permitted to use the admin endpoints
+
+	maintenance maintenanceMode
+	drains      erebus.DrainSet          // Shared by each Proxy, so that draining backends survives reloads
+	health      erebus.HealthChecker     // Shared by each Proxy, and following the current one's health checks
+	slowStarts  erebus.SlowStartSet      // Shared by each Proxy, so that slow starts survive reloads
+	limits      erebus.ConcurrencyLimits // Shared by each Proxy, so that rules' concurrency limits survive reloads
+
+	mu    sync.RWMutex
+	proxy *erebus.Proxy
+}
+
+// newReloader creates a reloader with an initial Proxy obtained from load.
+func newReloader(load func() (*erebus.Proxy, error)) (*reloader, error) {
+	proxy, err := load()
+	if err != nil {
+		return nil, err
+	}
+	rl := &reloader{load: load, proxy: proxy}
+	proxy.Drains = &rl.drains
+	proxy.Health = &rl.health
+	proxy.SlowStarts = &rl.slowStarts
+	proxy.Limits = &rl.limits
+	return rl, nil
+}
+
+func (rl *reloader) current() *erebus.Proxy {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+	return rl.proxy
+}
+
+// A configReadError is a failure to read the configuration file, as opposed to a problem with its contents.
+// These may be transient: a file replaced by renaming a new one over it can briefly appear to be missing.
+type configReadError struct {
+	err error
+}
+
+func (e *configReadError) Error() string { return "error reading configuration: " + e.err.Error() }
+
+// readConfigFile reads the configuration file at path, wrapping any error in a configReadError.
+func readConfigFile(path string) ([]byte, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, &configReadError{err}
+	}
+	return contents, nil
+}
+
+// How many times, and how often, a reload retries loading the configuration when it can't be read.
+var (
+	reloadReadAttempts   = 5
+	reloadReadRetryDelay = 100 * time.Millisecond
+)
+
+// reload loads a new Proxy and swaps it in. If loading fails, the current Proxy remains in use. Failures to
+// read the configuration file are retried for a little while before giving up.
+func (rl *reloader) reload() (*erebus.Proxy, error) {
+	var proxy *erebus.Proxy
+	var err error
+	for i := 0; i < reloadReadAttempts; i++ {
+		if i > 0 {
+			time.Sleep(reloadReadRetryDelay)
+		}
+		proxy, err = rl.load()
+		if _, ok := err.(*configReadError); !ok {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	proxy.Drains = &rl.drains
+	proxy.Health = &rl.health
+	proxy.SlowStarts = &rl.slowStarts
+	proxy.Limits = &rl.limits
+	rl.mu.Lock()
+	rl.proxy = proxy
+	rl.mu.Unlock()
+	return proxy, nil
+}
+
+// reloadAndLog reloads the configuration, logging the outcome.
+func (rl *reloader) reloadAndLog() {
+	if proxy, err := rl.reload(); err != nil {
+		erebus.LogErrorf("#red{Error reloading configuration (keeping the current rules):} %s", err)
+	} else {
+		erebus.LogInfof("#green{Reloaded configuration} (%d rules)", len(proxy.Rules))
+	}
+}
+
+// reloadOnSignal reloads the configuration whenever the process receives SIGHUP.
+func (rl *reloader) reloadOnSignal() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		rl.reloadAndLog()
+	}
+}
+
+const watchPollInterval = 250 * time.Millisecond
+
+// reloadOnChange reloads the configuration whenever the file at path changes. Editors often write a file
+// several times in quick succession when saving, so the reload waits until the file has been left alone for
+// the debounce period.
+func (rl *reloader) reloadOnChange(path string, debounce time.Duration) {
+	changes := make(chan struct{})
+	go watchFile(path, watchPollInterval, changes)
+	debounceEvents(changes, debounce, rl.reloadAndLog)
+}
+
+// watchFile polls the file at path every interval, sending on changes whenever its modification time or size
+// differs from the last time it was checked.
+func watchFile(path string, interval time.Duration, changes chan<- struct{}) {
+	last, _ := os.Stat(path)
+	for range time.Tick(interval) {
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue // Perhaps the file is being replaced; check again next time.
+		}
+		if last == nil || !fi.ModTime().Equal(last.ModTime()) || fi.Size() != last.Size() {
+			changes <- struct{}{}
+		}
+		last = fi
+	}
+}
+
+// debounceEvents calls fn once no events have arrived for d, coalescing each burst of events into a single
+// call. It returns when events is closed, dropping any pending call.
+func debounceEvents(events <-chan struct{}, d time.Duration, fn func()) {
+	var timer *time.Timer
+	for range events {
+		if timer == nil {
+			timer = time.AfterFunc(d, fn)
+		} else {
+			timer.Reset(d)
+		}
+	}
+	if timer != nil {
+		timer.Stop()
+	}
+}
+
+const reloadPath = "/__erebus_reload"
+
+func (rl *reloader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	proxy := rl.current()
+	// The reloader's own responses get the -responseheader defaults too.
+	own := func() http.ResponseWriter { return erebus.WithDefaultHeaders(w, proxy.ResponseHeaders) }
+	if rl.admin {
+		switch r.URL.Path {
+		case reloadPath:
+			rl.serveReload(own(), r)
+			return
+		case maintenancePath:
+			rl.serveMaintenance(own(), r)
+			return
+		case drainPath, undrainPath:
+			rl.serveDrain(own(), r)
+			return
+		case statsPath:
+			rl.serveStats(own(), r)
+			return
+		}
+	}
+	if rl.maintenance.isEnabled() {
+		rl.maintenance.serve(own())
+		return
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+func (rl *reloader) serveReload(w http.ResponseWriter, r *http.Request) {
+	if !rl.adminAllowed(r) {
+		http.Error(w, "Forbidden.", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	proxy, err := rl.reload()
+	if err != nil {
+		erebus.LogErrorf("#red{Error reloading configuration (keeping the current rules):} %s", err)
+		status := http.StatusBadRequest
+		if _, ok := err.(*configReadError); ok {
+			status = http.StatusServiceUnavailable // Not a problem with the configuration itself
+		}
+		http.Error(w, fmt.Sprintf("error reloading configuration: %s", err), status)
+		return
+	}
+	erebus.LogInfof("#green{Reloaded configuration} (%d rules)", len(proxy.Rules))
+	fmt.Fprintf(w, "Reloaded configuration (%d rules).\n", len(proxy.Rules))
+}
+
+// adminAllowed reports whether r comes from a client permitted to use the admin endpoints.
+func (rl *reloader) adminAllowed(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range rl.adminAllow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseNetworks parses a comma-separated list of CIDR networks.
+func parseNetworks(s string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range strings.Split(s, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
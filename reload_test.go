@@ -0,0 +1,228 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cespare/erebus/erebus"
+)
+
+// newFileReloader creates a reloader which loads its rules from a temporary file, returning the reloader and
+// a function for replacing the file's contents.
+func newFileReloader(t *testing.T, rules string) (*reloader, func(string)) {
+	file := filepath.Join(t.TempDir(), "conf.json")
+	write := func(rules string) {
+		if err := ioutil.WriteFile(file, []byte(rules), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(rules)
+	rl, err := newReloader(func() (*erebus.Proxy, error) {
+		contents, err := readConfigFile(file)
+		if err != nil {
+			return nil, err
+		}
+		return erebus.NewProxyFromRules(contents)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl.admin = true
+	if rl.adminAllow, err = parseNetworks("127.0.0.0/8,::1/128"); err != nil {
+		t.Fatal(err)
+	}
+	return rl, write
+}
+
+func postReload(rl *reloader, remoteAddr string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", reloadPath, nil)
+	r.RemoteAddr = remoteAddr
+	w := httptest.NewRecorder()
+	rl.ServeHTTP(w, r)
+	return w
+}
+
+func TestAdminReload(t *testing.T) {
+	rl, write := newFileReloader(t, `[{"from": {"host": "a.com"}, "to": {"addr": "localhost:1"}}]`)
+
+	write(`[{"from": {"host": "a.com"}, "to": {"addr": "localhost:1"}},
+	        {"from": {"host": "b.com"}, "to": {"addr": "localhost:2"}}]`)
+	w := postReload(rl, "127.0.0.1:5000")
+	if w.Code != http.StatusOK {
+		t.Fatalf("reloading a valid config: got status %d; want 200", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "2 rules") {
+		t.Errorf("reloading a valid config: got body %q; want a summary of the rules", w.Body)
+	}
+	if n := len(rl.current().Rules); n != 2 {
+		t.Fatalf("after reloading a valid config, got %d rules; want 2", n)
+	}
+
+	write(`[{"from": {"pathregex": "("}, "to": {"addr": "localhost:1"}}]`)
+	w = postReload(rl, "127.0.0.1:5000")
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("reloading an invalid config: got status %d; want 400", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "error parsing regexp") {
+		t.Errorf("reloading an invalid config: got body %q; want the parse error", w.Body)
+	}
+	if n := len(rl.current().Rules); n != 2 {
+		t.Fatalf("after reloading an invalid config, got %d rules; want the old 2", n)
+	}
+}
+
+func TestAdminReloadRestricted(t *testing.T) {
+	rl, _ := newFileReloader(t, `[{"from": {}, "to": {"addr": "localhost:1"}}]`)
+	if w := postReload(rl, "192.0.2.1:5000"); w.Code != http.StatusForbidden {
+		t.Errorf("reload from a disallowed address: got status %d; want 403", w.Code)
+	}
+	if w := postReload(rl, "[::1]:5000"); w.Code != http.StatusOK {
+		t.Errorf("reload from an allowed address: got status %d; want 200", w.Code)
+	}
+
+	r := httptest.NewRequest("GET", reloadPath, nil)
+	r.RemoteAddr = "127.0.0.1:5000"
+	w := httptest.NewRecorder()
+	rl.ServeHTTP(w, r)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET reload: got status %d; want 405", w.Code)
+	}
+
+	rl.admin = false
+	if w := postReload(rl, "127.0.0.1:5000"); w.Code == http.StatusOK {
+		t.Error("reload succeeded with the admin endpoints disabled")
+	}
+}
+
+func TestReloadEmptyRules(t *testing.T) {
+	rl, write := newFileReloader(t, `[{"from": {}, "respond": {"body": "still here"}}]`)
+	for _, rules := range []string{`[]`, `null`} {
+		write(rules)
+		if _, err := rl.reload(); err == nil {
+			t.Fatalf("reloading rules %s: expected an error", rules)
+		}
+		w := httptest.NewRecorder()
+		rl.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if w.Body.String() != "still here" {
+			t.Fatalf("after reloading rules %s, got body %q; want the old rules to stay active", rules, w.Body)
+		}
+		if w := postReload(rl, "127.0.0.1:5000"); w.Code != http.StatusBadRequest ||
+			!strings.Contains(w.Body.String(), "at least one rule") {
+			t.Errorf("admin reload of rules %s: got status %d and body %q; want 400 explaining the problem", rules,
+				w.Code, w.Body)
+		}
+	}
+}
+
+func TestDebounceEvents(t *testing.T) {
+	events := make(chan struct{})
+	var calls int32
+	done := make(chan struct{})
+	go func() {
+		debounceEvents(events, 50*time.Millisecond, func() { atomic.AddInt32(&calls, 1) })
+		close(done)
+	}()
+	for i := 0; i < 5; i++ {
+		events <- struct{}{}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Fatalf("after a burst of 5 events, got %d calls; want 1", got)
+	}
+
+	// A later event triggers another call.
+	events <- struct{}{}
+	time.Sleep(150 * time.Millisecond)
+	close(events)
+	<-done
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Fatalf("after a second burst, got %d calls; want 2", got)
+	}
+}
+
+func TestReloadMissingFile(t *testing.T) {
+	defer func(delay time.Duration) { reloadReadRetryDelay = delay }(reloadReadRetryDelay)
+	reloadReadRetryDelay = time.Millisecond
+
+	file := filepath.Join(t.TempDir(), "conf.json")
+	if err := ioutil.WriteFile(file, []byte(`[{"from": {}, "respond": {"body": "still here"}}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var loads int
+	rl, err := newReloader(func() (*erebus.Proxy, error) {
+		loads++
+		contents, err := readConfigFile(file)
+		if err != nil {
+			return nil, err
+		}
+		return erebus.NewProxyFromRules(contents)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl.admin = true
+	if rl.adminAllow, err = parseNetworks("127.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	loads = 0
+	w := postReload(rl, "127.0.0.1:5000")
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "error reading configuration") {
+		t.Errorf("reloading a missing file: got %d %q; want a 503 read error", w.Code, w.Body)
+	}
+	if loads != reloadReadAttempts {
+		t.Errorf("reloading a missing file: got %d attempts; want %d", loads, reloadReadAttempts)
+	}
+	w = httptest.NewRecorder()
+	rl.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Body.String() != "still here" {
+		t.Errorf("after reloading a missing file, got body %q; want the old rules to stay active", w.Body)
+	}
+
+	// A parse error isn't retried.
+	if err := ioutil.WriteFile(file, []byte(`[`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	loads = 0
+	if w := postReload(rl, "127.0.0.1:5000"); w.Code != http.StatusBadRequest {
+		t.Errorf("reloading an unparseable file: got status %d; want 400", w.Code)
+	}
+	if loads != 1 {
+		t.Errorf("reloading an unparseable file: got %d attempts; want 1", loads)
+	}
+}
+
+func TestReloadRetriesReadErrors(t *testing.T) {
+	defer func(delay time.Duration) { reloadReadRetryDelay = delay }(reloadReadRetryDelay)
+	reloadReadRetryDelay = time.Millisecond
+
+	// The file is missing on the first attempt, as if caught in the middle of being replaced.
+	var loads int
+	rl, err := newReloader(func() (*erebus.Proxy, error) {
+		loads++
+		if loads == 2 {
+			return nil, &configReadError{os.ErrNotExist}
+		}
+		return erebus.NewProxyFromRules([]byte(`[{"from": {}, "respond": {"body": "ok"}}]`))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rl.reload(); err != nil {
+		t.Fatalf("reload: %s", err)
+	}
+	if loads != 3 {
+		t.Errorf("got %d loads; want 3", loads)
+	}
+}
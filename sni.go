@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// CertConf is a TLS certificate to serve to clients which request Host (by SNI).
+type CertConf struct {
+	Host string
+	Cert string
+	Key  string
+}
+
+// loadHostCerts reads a JSON list of CertConfs from file and loads the certificates, keyed by host.
+func loadHostCerts(file string) (map[string]*tls.Certificate, error) {
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var confs []*CertConf
+	if err := json.Unmarshal(contents, &confs); err != nil {
+		return nil, err
+	}
+	certs := make(map[string]*tls.Certificate)
+	for _, conf := range confs {
+		if conf.Host == "" {
+			return nil, fmt.Errorf("a certificate must have a host")
+		}
+		host := strings.ToLower(conf.Host)
+		if _, ok := certs[host]; ok {
+			return nil, fmt.Errorf("duplicate certificate for host %s", conf.Host)
+		}
+		cert, err := tls.LoadX509KeyPair(conf.Cert, conf.Key)
+		if err != nil {
+			return nil, fmt.Errorf("error loading certificate for host %s: %s", conf.Host, err)
+		}
+		certs[host] = &cert
+	}
+	return certs, nil
+}
+
+// sniCertificate returns a tls.Config.GetCertificate function which picks the certificate for the server name
+// requested by the client. If there isn't one, the config's default certificate (if any) is used.
+func sniCertificate(certs map[string]*tls.Certificate) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return certs[strings.ToLower(hello.ServerName)], nil
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeSelfSignedCert writes a self-signed certificate and key for host into dir, returning the file names.
+func writeSelfSignedCert(t *testing.T, dir, host string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = filepath.Join(dir, host+".crt")
+	keyFile = filepath.Join(dir, host+".key")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestSNICertificates(t *testing.T) {
+	dir := t.TempDir()
+	defaultCert, defaultKey := writeSelfSignedCert(t, dir, "default.example")
+	aCert, aKey := writeSelfSignedCert(t, dir, "a.example")
+	bCert, bKey := writeSelfSignedCert(t, dir, "b.example")
+	certsFile := filepath.Join(dir, "certs.json")
+	certs := fmt.Sprintf(`[{"host": "a.example", "cert": %q, "key": %q},
+	                       {"host": "B.example", "cert": %q, "key": %q}]`, aCert, aKey, bCert, bKey)
+	if err := ioutil.WriteFile(certsFile, []byte(certs), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := newTLSConfig(defaultCert, defaultKey, certsFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.NotFoundHandler())
+	server.TLS = config
+	server.StartTLS()
+	defer server.Close()
+
+	for _, tc := range []struct {
+		serverName string
+		want       string
+	}{
+		{"a.example", "a.example"},
+		{"b.example", "b.example"},
+		{"other.example", "default.example"},
+	} {
+		conn, err := tls.Dial("tcp", server.Listener.Addr().String(),
+			&tls.Config{ServerName: tc.serverName, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+		conn.Close()
+		if got != tc.want {
+			t.Errorf("SNI server name %s: got certificate for %s; want %s", tc.serverName, got, tc.want)
+		}
+	}
+
+	if err := ioutil.WriteFile(certsFile, []byte(`[{"host": "", "cert": "x", "key": "y"}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newTLSConfig("", "", certsFile, ""); err == nil {
+		t.Error("expected an error for a certificate without a host")
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+
+	"github.com/cespare/erebus/erebus"
+)
+
+const statsPath = "/__erebus_stats"
+
+// serveStats serves the admin endpoint listing the requests currently in flight for each rule and backend.
+func (rl *reloader) serveStats(w http.ResponseWriter, r *http.Request) {
+	if !rl.adminAllowed(r) {
+		http.Error(w, "Forbidden.", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	writeStats(w, rl.current())
+}
+
+// writeStats writes the requests currently in flight for each of proxy's rules and backends to w.
+func writeStats(w io.Writer, proxy *erebus.Proxy) {
+	fmt.Fprintln(w, "In flight by rule:")
+	for i, rule := range proxy.Rules {
+		fmt.Fprintf(w, "  %d: %d\n", i+1, rule.InFlight())
+	}
+	backends := proxy.BackendsInFlight()
+	addrs := make([]string, 0, len(backends))
+	for addr := range backends {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	fmt.Fprintln(w, "In flight by backend:")
+	for _, addr := range addrs {
+		fmt.Fprintf(w, "  %s: %d\n", addr, backends[addr])
+	}
+}
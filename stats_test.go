@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer backend.Close()
+	addr := strings.TrimPrefix(backend.URL, "http://")
+	rl, _ := newFileReloader(t, fmt.Sprintf(`[{"from": {}, "to": {"addr": %q}}]`, addr))
+	stats := func(method, remoteAddr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, statsPath, nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		rl.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := stats("GET", "192.0.2.1:5000"); w.Code != http.StatusForbidden {
+		t.Errorf("stats from a disallowed client: got status %d; want 403", w.Code)
+	}
+	if w := stats("POST", "127.0.0.1:5000"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST to stats: got status %d; want 405", w.Code)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		rl.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}()
+	want := []string{"  1: 1\n", "  " + addr + ": 1\n"}
+	var body string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		w := stats("GET", "127.0.0.1:5000")
+		if w.Code != http.StatusOK {
+			t.Fatalf("stats: got status %d; want 200", w.Code)
+		}
+		body = w.Body.String()
+		if strings.Contains(body, want[0]) && strings.Contains(body, want[1]) {
+			break
+		}
+	}
+	for _, s := range want {
+		if !strings.Contains(body, s) {
+			t.Errorf("stats with a request in flight: got %q; want it to contain %q", body, s)
+		}
+	}
+	close(release)
+	<-done
+}
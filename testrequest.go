@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/cespare/erebus/erebus"
+)
+
+// headerFlags is a repeatable flag of "Name: value" headers.
+type headerFlags []string
+
+func (h *headerFlags) String() string { return strings.Join(*h, ", ") }
+
+func (h *headerFlags) Set(s string) error {
+	if !strings.Contains(s, ":") {
+		return fmt.Errorf("header %q is not of the form Name: value", s)
+	}
+	*h = append(*h, s)
+	return nil
+}
+
+// splitHeader splits a header flag into its name and value.
+func splitHeader(h string) (name, value string) {
+	i := strings.Index(h, ":")
+	return strings.TrimSpace(h[:i]), strings.TrimSpace(h[i+1:])
+}
+
+// testRequest describes to w how proxy would handle the request given by spec ("METHOD URL", or just a URL for
+// a GET; the URL's scheme is the one the client used) with the given headers: which rules don't match it (and
+// why), which rule does, and what that rule would do with it. Nothing is sent to any backend. It reports
+// whether any rule matched.
+func testRequest(w io.Writer, proxy *erebus.Proxy, spec string, headers []string) (bool, error) {
+	method, url := "GET", spec
+	if fields := strings.Fields(spec); len(fields) == 2 {
+		method, url = fields[0], fields[1]
+	}
+	r, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return false, err
+	}
+	if r.URL.Host == "" {
+		return false, fmt.Errorf("the URL %q must be absolute", url)
+	}
+	r.RequestURI = r.URL.RequestURI()
+	r.RemoteAddr = "127.0.0.1:0"
+	if r.URL.Scheme == "https" {
+		r.TLS = &tls.ConnectionState{ServerName: r.URL.Hostname()}
+	}
+	for _, h := range headers {
+		name, value := splitHeader(h)
+		if strings.EqualFold(name, "Host") {
+			r.Host = value
+		} else {
+			r.Header.Add(name, value)
+		}
+	}
+
+	if proxy.CleanPath {
+		r = erebus.CleanRequestPath(r)
+	}
+	for i, rule := range proxy.Rules {
+		if !rule.IsEnabled() {
+			fmt.Fprintf(w, "rule %d: disabled\n", i+1)
+			continue
+		}
+		if rule.From.TokenRequired(r) {
+			fmt.Fprintf(w, "rule %d: match except for a missing or invalid bearer token; 401 response\n", i+1)
+			return true, nil
+		}
+		matched, reason := rule.From.MatchReason(r)
+		if !matched {
+			fmt.Fprintf(w, "rule %d: no match (%s)\n", i+1, reason)
+			continue
+		}
+		if rule.From.RedirectsToHTTPS(r) {
+			fmt.Fprintf(w, "rule %d: match; redirect to HTTPS\n", i+1)
+			return true, nil
+		}
+		if len(rule.OptionsAllow) > 0 && r.Method == "OPTIONS" {
+			fmt.Fprintf(w, "rule %d: match; OPTIONS response (Allow: %s)\n", i+1, strings.Join(rule.OptionsAllow, ", "))
+			return true, nil
+		}
+		if rule.Respond != nil {
+			status := rule.Respond.Status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			fmt.Fprintf(w, "rule %d: match; static response %d\n", i+1, status)
+			return true, nil
+		}
+		out := rule.To.CreateRequest(r)
+		fmt.Fprintf(w, "rule %d: match; %s %s\n", i+1, out.Method, out.URL)
+		return true, nil
+	}
+	fmt.Fprintln(w, "no rule matches")
+	return false, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/cespare/erebus/erebus"
+)
+
+func TestTestRequest(t *testing.T) {
+	proxy, err := erebus.NewProxyFromRules([]byte(`[
+		{"from": {"host": "api.example.com", "pathprefix": "/v1/"}, "to": {"addr": "10.0.0.1:8080"}},
+		{"from": {"host": "api.example.com", "headersabsent": ["authorization"]}, "respond": {"status": 401}},
+		{"from": {"host": "www.example.com"}, "to": {"addr": "10.0.0.2:8080", "addprefix": "/site"}}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		spec    string
+		headers []string
+		want    string
+		matched bool
+	}{
+		{
+			"GET http://api.example.com/v1/users?id=3", nil,
+			"rule 1: match; GET http://10.0.0.1:8080/v1/users?id=3\n",
+			true,
+		},
+		{
+			"http://api.example.com/v2/users", nil,
+			"rule 1: no match (pathprefix)\nrule 2: match; static response 401\n",
+			true,
+		},
+		{
+			"POST http://api.example.com/v2/users", []string{"Authorization: Bearer x"},
+			"rule 1: no match (pathprefix)\nrule 2: no match (headersabsent)\nrule 3: no match (host)\nno rule matches\n",
+			false,
+		},
+		{
+			"GET http://10.0.0.9/about", []string{"Host: www.example.com"},
+			"rule 1: no match (host)\nrule 2: no match (host)\nrule 3: match; GET http://10.0.0.2:8080/site/about\n",
+			true,
+		},
+	} {
+		var buf bytes.Buffer
+		matched, err := testRequest(&buf, proxy, tc.spec, tc.headers)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.spec, err)
+		}
+		if matched != tc.matched || buf.String() != tc.want {
+			t.Errorf("%s %q: got matched = %t and output:\n%s\nwant matched = %t and output:\n%s", tc.spec,
+				tc.headers, matched, buf.String(), tc.matched, tc.want)
+		}
+	}
+
+	if _, err := testRequest(&bytes.Buffer{}, proxy, "GET /relative", nil); err == nil {
+		t.Error("expected an error for a relative URL")
+	}
+
+	proxy, err = erebus.NewProxyFromRules([]byte(`[
+		{"from": {}, "to": {"addr": "10.0.0.1:8080"}, "enabled": false},
+		{"from": {}, "to": {"addr": "10.0.0.2:8080"}}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := testRequest(&buf, proxy, "http://example.com/", nil); err != nil {
+		t.Fatal(err)
+	}
+	if want := "rule 1: disabled\nrule 2: match; GET http://10.0.0.2:8080/\n"; buf.String() != want {
+		t.Errorf("with a disabled rule: got output:\n%s\nwant:\n%s", buf.String(), want)
+	}
+
+	// Requests which get a 401 or an HTTPS redirect instead of being proxied are reported as such.
+	proxy, err = erebus.NewProxyFromRules([]byte(`[
+		{"from": {"pathprefix": "/admin/", "jwtclaim": {"name": "role", "value": "admin", "required": true}},
+		 "to": {"addr": "10.0.0.1:8080"}},
+		{"from": {"requiretls": true}, "to": {"addr": "10.0.0.2:8080"}}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		spec string
+		want string
+	}{
+		{
+			"http://example.com/admin/",
+			"rule 1: match except for a missing or invalid bearer token; 401 response\n",
+		},
+		{
+			"POST http://example.com/a",
+			"rule 1: no match (pathprefix)\nrule 2: match; redirect to HTTPS\n",
+		},
+		{
+			"https://example.com/a",
+			"rule 1: no match (pathprefix)\nrule 2: match; GET https://10.0.0.2:8080/a\n",
+		},
+	} {
+		var buf bytes.Buffer
+		if _, err := testRequest(&buf, proxy, tc.spec, nil); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tc.want {
+			t.Errorf("%s: got output:\n%s\nwant:\n%s", tc.spec, buf.String(), tc.want)
+		}
+	}
+}
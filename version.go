@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+)
+
+// version is the erebus version. Release builds set it with
+//
+//	go build -ldflags "-X main.version=v1.2.3"
+var version = "dev"
+
+// printVersion writes the version, the VCS revision (if known), and the Go version used to build erebus.
+func printVersion(w io.Writer) {
+	commit := "unknown"
+	goVersion := runtime.Version()
+	if info, ok := debug.ReadBuildInfo(); ok {
+		goVersion = info.GoVersion
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				commit = setting.Value
+			}
+		}
+	}
+	fmt.Fprintf(w, "erebus %s (commit %s, %s)\n", version, commit, goVersion)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestPrintVersion(t *testing.T) {
+	var buf bytes.Buffer
+	printVersion(&buf)
+	if got := buf.String(); !strings.HasPrefix(got, "erebus dev ") || !strings.Contains(got, runtime.Version()) {
+		t.Fatalf("got version %q; want the version and the Go version", got)
+	}
+}
+
+// TestVersionFlag runs main (by re-executing the test binary) with -version and a configuration file which
+// doesn't exist; if main went on to start the server, it would fail.
+func TestVersionFlag(t *testing.T) {
+	if os.Getenv("EREBUS_TEST_MAIN") == "1" {
+		os.Args = []string{"erebus", "-version", "-conf", "/nonexistent/conf.json"}
+		main()
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestVersionFlag$")
+	cmd.Env = append(os.Environ(), "EREBUS_TEST_MAIN=1")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("erebus -version failed (%s); output:\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "erebus dev ") {
+		t.Fatalf("erebus -version printed %q; want the version", out)
+	}
+}